@@ -0,0 +1,76 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/pkg/database"
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "<redacted>"
+
+// configCommand checks or prints the effective configuration.
+func configCommand(args []string) error {
+	act, args, err := action("config", args, "check", "print")
+	if err != nil {
+		return err
+	}
+
+	fs, configPath := newFlagSet("config " + act)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	switch act {
+	case "check":
+		fmt.Println("Configuration OK")
+	case "print":
+		return printConfig(cfg)
+	}
+
+	return nil
+}
+
+// printConfig prints the configuration as YAML with the environment
+// variables applied, secrets are redacted.
+func printConfig(cfg config.ServerConfig) error {
+	if cfg.MailerConfig.SMTPPassword != "" {
+		cfg.MailerConfig.SMTPPassword = redacted
+	}
+	if cfg.Admin.Token != "" {
+		cfg.Admin.Token = redacted
+	}
+	// inline signing key
+	if _, err := base64.StdEncoding.DecodeString(cfg.SigningPGPKey); err == nil && cfg.SigningPGPKey != "" {
+		cfg.SigningPGPKey = redacted
+	}
+
+	// print the database configuration with the environment applied
+	db, _ := database.GetDatabaseEngine(cfg.DBEngine)
+	b, err := yaml.Marshal(db.NewConfig())
+	if err != nil {
+		return err
+	}
+	cfg.DBConfig = nil
+	if err := yaml.Unmarshal(b, &cfg.DBConfig); err != nil {
+		return err
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(4)
+	if err := enc.Encode(&cfg); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/internal/pkg/signingkey"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// keyPageSize is the number of keys read at once by the commands
+// going through all the stored keys.
+const keyPageSize = 1000
+
+// dbCommand maintains the database.
+func dbCommand(args []string) error {
+	act, args, err := action("db", args, "dump", "restore", "compact", "check")
+	if err != nil {
+		return err
+	}
+
+	fs, configPath := newFlagSet("db " + act)
+	output := fs.String("o", "", "output file (dump only), standard output by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return withDatabase(*configPath, func(cfg *config.ServerConfig, db database.Engine) error {
+		switch act {
+		case "dump":
+			return writeOutput(*output, func(w io.Writer) error {
+				return dumpDatabase(db, w)
+			})
+		case "restore":
+			return restoreDatabase(db, fs.Args())
+		case "compact":
+			c, ok := database.GetCompacter(db)
+			if !ok {
+				return fmt.Errorf("database engine %s doesn't support compaction", cfg.DBEngine)
+			}
+			if err := c.Compact(); err != nil {
+				return fmt.Errorf("while compacting database: %s", err)
+			}
+			fmt.Println("Database compacted")
+		case "check":
+			return checkDatabase(db, cfg.MailLocalPartFolding)
+		}
+		return nil
+	})
+}
+
+// dumpDatabase writes the signing keys with their private part followed
+// by the public keys. The server state (tokens, pending submissions) is
+// not part of the dump.
+func dumpDatabase(db database.Engine, w io.Writer) error {
+	signingKeys, err := signingkey.List(db)
+	if err != nil {
+		return err
+	}
+
+	if len(signingKeys) > 0 {
+		aw, err := armor.Encode(w, openpgp.PrivateKeyType, nil)
+		if err != nil {
+			return err
+		}
+		for _, e := range signingKeys {
+			if err := keyring.SerializePrivate(aw, e); err != nil {
+				return fmt.Errorf("while serializing signing key: %s", err)
+			}
+		}
+		if err := aw.Close(); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+
+	aw, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+
+	err = eachKey(db, func(e *openpgp.Entity) error {
+		return keyring.Serialize(aw, e)
+	})
+	if err != nil {
+		return err
+	}
+
+	return aw.Close()
+}
+
+// eachKey calls fn for each stored key, the keys are read by pages
+// of keyPageSize keys so the whole keyring isn't held in memory.
+func eachKey(db database.Engine, fn func(*openpgp.Entity) error) error {
+	for offset := 0; ; offset += keyPageSize {
+		el, err := db.Get("", database.SearchOptions{Offset: offset, Limit: keyPageSize})
+		if err != nil {
+			return fmt.Errorf("while reading keys: %s", err)
+		}
+		for _, e := range el {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if len(el) < keyPageSize {
+			return nil
+		}
+	}
+}
+
+// restoreDatabase reads the armored blocks produced by dump, signing
+// keys are restored as is and public keys are merged with the stored keys.
+func restoreDatabase(db database.Engine, paths []string) error {
+	keys, signingKeys := 0, 0
+
+	err := readInputs(paths, func(r io.Reader) error {
+		br := bufio.NewReader(r)
+		for {
+			block, err := armor.Decode(br)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			el, err := openpgp.ReadKeyRing(block.Body)
+			if err != nil {
+				return err
+			}
+			for _, e := range el {
+				if e.PrivateKey != nil {
+					if err := signingkey.Add(db, openpgp.EntityList{e}, nil); err != nil {
+						return err
+					}
+					signingKeys++
+					continue
+				}
+				if err := database.Merge(db, openpgp.EntityList{e}); err != nil {
+					return err
+				}
+				keys++
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d signing key(s) and %d public key(s) restored\n", signingKeys, keys)
+	return nil
+}
+
+// checkDatabase reports inconsistencies in the stored keys, email
+// addresses are compared with the configured local part folding.
+func checkDatabase(db database.Engine, folding database.LocalPartFolding) error {
+	var issues []string
+
+	signingKeys, err := signingkey.List(db)
+	if err != nil {
+		return err
+	}
+	if signingkey.Select(signingKeys) == nil {
+		issues = append(issues, "no usable signing key")
+	}
+
+	emails := make(map[string][]string)
+	isSigningKey := make(map[string]bool)
+
+	for _, e := range signingKeys {
+		isSigningKey[fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])] = true
+	}
+
+	keys := 0
+
+	err = eachKey(db, func(e *openpgp.Entity) error {
+		keys++
+		fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+		if len(e.Identities) == 0 {
+			issues = append(issues, fmt.Sprintf("key %s has no identity", fp))
+			return nil
+		}
+		// rotated signing keys share the admin email address
+		if len(e.Revocations) > 0 || isSigningKey[fp] {
+			return nil
+		}
+		for _, id := range e.Identities {
+			if id.UserId.Email == "" || keyring.IdentityRevoked(e, id) {
+				continue
+			}
+			email := folding.Normalize(id.UserId.Email)
+			emails[email] = append(emails[email], fp)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for email, fps := range emails {
+		if len(fps) > 1 {
+			issues = append(issues, fmt.Sprintf("email %s is used by keys %s", email, strings.Join(fps, ", ")))
+		}
+	}
+
+	fmt.Printf("%d key(s) and %d signing key(s) checked\n", keys, len(signingKeys))
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%d issue(s) found", len(issues))
+	}
+
+	return nil
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/internal/pkg/fsdb"
+	"github.com/ctrliq/spks/internal/pkg/signingkey"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+)
+
+// keyCommand manages the stored public keys.
+func keyCommand(args []string) error {
+	act, args, err := action("key", args, "import", "export", "list", "delete", "show")
+	if err != nil {
+		return err
+	}
+
+	fs, configPath := newFlagSet("key " + act)
+	exact := fs.Bool("exact", false, "exact search match")
+	output := fs.String("o", "", "output file (export only), standard output by default")
+	dir := fs.String("dir", "", "output directory with one armored file per key fingerprint (export only)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return withDatabase(*configPath, func(cfg *config.ServerConfig, db database.Engine) error {
+		switch act {
+		case "import":
+			return importKeys(db, fs.Args())
+		case "export":
+			el, err := searchKeys(db, fs.Arg(0), *exact)
+			if err != nil {
+				return err
+			}
+			if *dir != "" {
+				return exportKeyDir(*dir, el)
+			}
+			return writeOutput(*output, func(w io.Writer) error {
+				return keyring.WriteArmoredKeyRing(w, el)
+			})
+		case "list":
+			el, err := searchKeys(db, fs.Arg(0), *exact)
+			if err != nil {
+				return err
+			}
+			return listKeys(db, el)
+		case "delete":
+			return deleteKey(db, fs.Arg(0))
+		case "show":
+			e, err := fingerprintKey(db, fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			return showKey(db, e)
+		}
+		return nil
+	})
+}
+
+// writeOutput calls fn with the output file or the standard output
+// if path is empty.
+func writeOutput(path string, fn func(io.Writer) error) error {
+	if path == "" {
+		return fn(os.Stdout)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readInputs calls fn with each input file or the standard input
+// if there is no file.
+func readInputs(paths []string, fn func(io.Reader) error) error {
+	if len(paths) == 0 {
+		return fn(os.Stdin)
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = fn(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("while reading %s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// searchKeys searches keys like HKP lookups do, all keys are returned
+// for an empty search.
+func searchKeys(db database.Engine, search string, exact bool) (openpgp.EntityList, error) {
+	isFingerprint := strings.HasPrefix(search, "0x")
+	if isFingerprint {
+		search = strings.ToUpper(strings.TrimPrefix(search, "0x"))
+		length := len(search)
+		if length < 8 {
+			return nil, fmt.Errorf("fingerprint search must have at least 8 characters")
+		} else if length < 16 {
+			search = search[length-8:]
+		} else if length < 40 {
+			search = search[length-16:]
+		}
+	}
+	return db.Get(search, database.SearchOptions{Fingerprint: isFingerprint, Exact: exact})
+}
+
+// fingerprintKey returns the stored key matching the full fingerprint.
+func fingerprintKey(db database.Engine, fp string) (*openpgp.Entity, error) {
+	fp = strings.ToUpper(strings.TrimPrefix(fp, "0x"))
+	if len(fp) != 40 {
+		return nil, fmt.Errorf("a full key fingerprint is required")
+	}
+	el, err := db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range el {
+		if fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]) == fp {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("no key found with fingerprint %s", fp)
+}
+
+// importKeys merges the armored public keys with the stored keys,
+// imported keys don't go through the verification process.
+func importKeys(db database.Engine, paths []string) error {
+	n := 0
+
+	err := readInputs(paths, func(r io.Reader) error {
+		el, err := openpgp.ReadArmoredKeyRing(r)
+		if err != nil {
+			return err
+		}
+		for _, e := range el {
+			if e.PrivateKey != nil {
+				return fmt.Errorf("key %X contains a private key", e.PrimaryKey.Fingerprint[:])
+			}
+		}
+		if err := database.Merge(db, el); err != nil {
+			return err
+		}
+		n += len(el)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d key(s) imported\n", n)
+	return nil
+}
+
+// exportKeyDir writes each key into its own armored file named after
+// the key fingerprint, as served by the fs database engine.
+func exportKeyDir(dir string, el openpgp.EntityList) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, e := range el {
+		path := filepath.Join(dir, fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])+fsdb.KeyExt)
+		err := writeOutput(path, func(w io.Writer) error {
+			return keyring.WriteArmoredKeyRing(w, openpgp.EntityList{e})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%d key(s) exported\n", len(el))
+	return nil
+}
+
+func listKeys(db database.Engine, el openpgp.EntityList) error {
+	signingKeys, err := signingkey.List(db)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FINGERPRINT\tIDENTITY\tCERTIFIED\tREVOKED")
+	for _, e := range el {
+		name, certified := "", false
+		if id := keyring.PrimaryIdentity(e); id != nil {
+			name = id.Name
+			certified = keyring.IdentityCertifiedBy(e, id, signingKeys)
+		}
+		fmt.Fprintf(tw, "%X\t%s\t%t\t%t\n", e.PrimaryKey.Fingerprint[:], name, certified, len(e.Revocations) > 0)
+	}
+	return tw.Flush()
+}
+
+func deleteKey(db database.Engine, fp string) error {
+	e, err := fingerprintKey(db, fp)
+	if err != nil {
+		return err
+	}
+
+	signingKeys, err := signingkey.List(db)
+	if err != nil {
+		return err
+	}
+	for _, sk := range signingKeys {
+		if sk.PrimaryKey.Fingerprint == e.PrimaryKey.Fingerprint {
+			return fmt.Errorf("signing keys can't be deleted")
+		}
+	}
+
+	if err := db.Del(openpgp.EntityList{e}); err != nil {
+		return fmt.Errorf("while deleting key: %s", err)
+	}
+
+	fmt.Printf("Key %X deleted\n", e.PrimaryKey.Fingerprint[:])
+	return nil
+}
+
+func formatExpiration(created time.Time, lifetime *uint32) string {
+	if lifetime == nil || *lifetime == 0 {
+		return "never"
+	}
+	return created.Add(time.Duration(*lifetime) * time.Second).UTC().Format(time.RFC3339)
+}
+
+func showKey(db database.Engine, e *openpgp.Entity) error {
+	signingKeys, err := signingkey.List(db)
+	if err != nil {
+		return err
+	}
+
+	pk := e.PrimaryKey
+
+	fmt.Printf("fingerprint: %X\n", pk.Fingerprint[:])
+	fmt.Printf("created:     %s\n", pk.CreationTime.UTC().Format(time.RFC3339))
+	if id := keyring.PrimaryIdentity(e); id != nil && id.SelfSignature != nil {
+		fmt.Printf("expires:     %s\n", formatExpiration(pk.CreationTime, id.SelfSignature.KeyLifetimeSecs))
+	}
+	fmt.Printf("revoked:     %t\n", len(e.Revocations) > 0)
+
+	for _, id := range keyring.SortedIdentities(e) {
+		var status []string
+		if keyring.IdentityCertifiedBy(e, id, signingKeys) {
+			status = append(status, "certified")
+		}
+		if keyring.IdentityRevoked(e, id) {
+			status = append(status, "revoked")
+		}
+		fmt.Printf("identity:    %s", id.Name)
+		if len(status) > 0 {
+			fmt.Printf(" [%s]", strings.Join(status, ", "))
+		}
+		fmt.Println()
+	}
+
+	for _, sk := range e.Subkeys {
+		expires := "never"
+		if sk.Sig != nil {
+			expires = formatExpiration(sk.PublicKey.CreationTime, sk.Sig.KeyLifetimeSecs)
+		}
+		fmt.Printf("subkey:      %X created %s expires %s\n",
+			sk.PublicKey.Fingerprint[:],
+			sk.PublicKey.CreationTime.UTC().Format(time.RFC3339),
+			expires,
+		)
+	}
+
+	return nil
+}
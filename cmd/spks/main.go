@@ -4,149 +4,162 @@
 package main
 
 import (
-	"bytes"
-	"context"
-	"crypto"
-	"encoding/base64"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
-	"os/signal"
 	"path/filepath"
-	"syscall"
+	"sort"
+	"strings"
 
 	"github.com/ctrliq/spks/internal/pkg/config"
-	"github.com/ctrliq/spks/internal/pkg/mailverifier"
 	"github.com/ctrliq/spks/pkg/database"
-	"github.com/ctrliq/spks/pkg/hkpserver"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/packet"
 )
 
 // set by mage at build time
 var version string
 
-func addSigningKey(el openpgp.EntityList, db database.Engine) error {
-	if len(el) != 1 {
-		return fmt.Errorf("found %d signing pgp key(s), only one can be set", len(el))
-	}
+// command describes a spks subcommand.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
 
-	e := el[0]
-	if e.PrivateKey == nil {
-		return fmt.Errorf("signing key requires private key")
-	} else if e.PrivateKey.Encrypted {
-		return fmt.Errorf("private key is encrypted")
+var commands = map[string]command{
+	"serve": {
+		usage: "serve [-config path]\n\trun the key server (default command)",
+		run:   serveCommand,
+	},
+	"key": {
+		usage: "key import|export|list|delete|show [-config path] [args]\n\tmanage the stored public keys",
+		run:   keyCommand,
+	},
+	"db": {
+		usage: "db dump|restore|compact|check [-config path] [args]\n\tmaintain the database",
+		run:   dbCommand,
+	},
+	"signing-key": {
+		usage: "signing-key show|export|rotate|import-signatures [-config path] [args]\n\tmanage the server signing key",
+		run:   signingKeyCommand,
+	},
+	"config": {
+		usage: "config check|print [-config path]\n\tcheck or print the effective configuration",
+		run:   configCommand,
+	},
+	"pending": {
+		usage: "pending list|purge [-config path] [fingerprint]\n\tlist or purge the submissions waiting for verification",
+		run:   pendingCommand,
+	},
+}
+
+func usage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	return db.Add(el)
+	fmt.Fprintf(w, "Usage: spks <command> [options]\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "  spks %s\n", commands[name].usage)
+	}
 }
 
-func execute(args []string) error {
-	configPath := filepath.Join(config.Dir, config.File)
-	if len(args) > 0 {
-		configPath = args[0]
-	}
+// newFlagSet returns a flag set with the configuration file path option.
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := fs.String("config", filepath.Join(config.Dir, config.File), "configuration file path")
+	return fs, configPath
+}
 
-	cfg, err := config.Parse(configPath)
+// loadConfig parses and checks the configuration file, the environment
+// variables take precedence over the configuration file.
+func loadConfig(path string) (config.ServerConfig, error) {
+	cfg, err := config.Parse(path)
 	if err != nil {
-		return fmt.Errorf("while parsing configuration file: %s", err)
+		return cfg, fmt.Errorf("while parsing configuration file: %s", err)
 	}
-
 	if err := config.CheckServerConfig(&cfg); err != nil {
-		return fmt.Errorf("while checking configuration: %s", err)
+		return cfg, fmt.Errorf("while checking configuration: %s", err)
 	}
+	return cfg, nil
+}
 
+// openDatabase connects to the configured database engine, identities
+// are normalized with the configured local part folding.
+func openDatabase(cfg *config.ServerConfig) (database.Engine, error) {
 	db, ok := database.GetDatabaseEngine(cfg.DBEngine)
 	if !ok {
-		return fmt.Errorf("no database engine %s", cfg.DBEngine)
+		return nil, fmt.Errorf("no database engine %s", cfg.DBEngine)
+	}
+	if err := database.SetLocalPartFolding(db, cfg.MailLocalPartFolding); err != nil {
+		return nil, err
 	}
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-
-	ctx, cancel := context.WithCancel(context.Background())
-
-	go func() {
-		s := <-c
-		logrus.WithField("signal", s).Info("Server interrupted by signal")
-		cancel()
-	}()
-
 	if err := db.Connect(); err != nil {
-		return fmt.Errorf("while connecting to database: %s", err)
+		return nil, fmt.Errorf("while connecting to database: %s", err)
 	}
-	defer db.Disconnect()
-
-	var signingKey *openpgp.Entity
+	return db, nil
+}
 
-	// check if there is a signing key in the database
-	eldb, err := db.Get("", true, false, database.SigningKey)
+// withDatabase parses the configuration file and runs fn with the
+// configured database engine, in-memory databases are rejected as
+// they don't outlive the command.
+func withDatabase(configPath string, fn func(*config.ServerConfig, database.Engine) error) error {
+	cfg, err := loadConfig(configPath)
 	if err != nil {
-		return fmt.Errorf("while searching for signing key in database: %s", err)
+		return err
 	}
-	for _, e := range eldb {
-		if len(eldb[0].Revocations) == 0 {
-			signingKey = e
-			break
-		}
+	if db, ok := database.GetDatabaseEngine(cfg.DBEngine); ok && database.IsVolatile(db) {
+		return fmt.Errorf("%s database is in-memory, configure a persistent database", cfg.DBEngine)
 	}
-
-	if cfg.SigningPGPKey != "" && signingKey == nil {
-		// look first if the signing key is provided as a base64 encoded string
-		b, err := base64.StdEncoding.DecodeString(cfg.SigningPGPKey)
-		if err != nil {
-			b, err = ioutil.ReadFile(cfg.SigningPGPKey)
-			if err != nil {
-				return fmt.Errorf("while reading signing pgp key: %s", err)
-			}
-		}
-		el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
-		if err != nil {
-			return fmt.Errorf("while decoding signing pgp key: %s", err)
-		} else if len(el) == 0 {
-			return fmt.Errorf("no signing key found")
-		}
-		logrus.WithField("identity", el[0].PrimaryIdentity().Name).Info("Using signing PGP key")
-		if err := addSigningKey(el, db); err != nil {
-			return err
-		}
-		signingKey = el[0]
+	db, err := openDatabase(&cfg)
+	if err != nil {
+		return err
 	}
+	defer db.Disconnect()
 
-	if signingKey == nil {
-		logrus.Info("Generating signing PGP key")
-
-		conf := &packet.Config{RSABits: 4096, DefaultHash: crypto.SHA384}
-		e, err := openpgp.NewEntity("Admin", "Signing Key", cfg.AdminEmail, conf)
-		if err != nil {
-			return fmt.Errorf("while generating signing pgp key: %s", err)
-		}
-		logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).Info("Signing PGP key generated")
+	return fn(&cfg, db)
+}
 
-		if err := addSigningKey(openpgp.EntityList{e}, db); err != nil {
-			return err
+// action splits the action of a command group from its arguments.
+func action(group string, args []string, actions ...string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("usage: spks %s %s [-config path] [args]", group, strings.Join(actions, "|"))
+	}
+	for _, a := range actions {
+		if args[0] == a {
+			return a, args[1:], nil
 		}
-		signingKey = e
 	}
+	return "", nil, fmt.Errorf("unknown %s command %q, must be one of %s", group, args[0], strings.Join(actions, ", "))
+}
 
-	scfg := hkpserver.Config{
-		Addr:             cfg.BindAddr,
-		PublicPem:        cfg.Certificate.PublicKeyPath,
-		PrivatePem:       cfg.Certificate.PrivateKeyPath,
-		DB:               db,
-		CustomHandler:    hkpserver.LogRequestHandler,
-		Verifier:         mailverifier.New(&cfg, signingKey),
-		KeyPushRateLimit: cfg.KeyPushRateLimit,
+func execute(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			usage(os.Stdout)
+			return nil
+		}
+		if cmd, ok := commands[args[0]]; ok {
+			return cmd.run(args[1:])
+		}
+		// keep supporting "spks [config path]" to run the server
+		if strings.HasPrefix(args[0], "-") || len(args) > 1 {
+			usage(os.Stderr)
+			return fmt.Errorf("unknown command %q", args[0])
+		}
+		return serve(args[0])
 	}
-
-	logrus.WithField("listen", cfg.BindAddr).Infof("Server started (version %s)", version)
-
-	return hkpserver.Start(ctx, scfg)
+	return serve(filepath.Join(config.Dir, config.File))
 }
 
 func main() {
 	if err := execute(os.Args[1:]); err != nil {
-		logrus.WithError(err).Fatal("while running server")
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		}
+		logrus.WithError(err).Fatal("while running spks")
 	}
 }
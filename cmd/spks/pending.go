@@ -0,0 +1,62 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/pending"
+)
+
+// pendingCommand lists or purges the key submissions waiting for
+// verification.
+func pendingCommand(args []string) error {
+	act, args, err := action("pending", args, "list", "purge")
+	if err != nil {
+		return err
+	}
+
+	fs, configPath := newFlagSet("pending " + act)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return withDatabase(*configPath, func(cfg *config.ServerConfig, db database.Engine) error {
+		store, err := pending.NewStore(db)
+		if err != nil {
+			return err
+		}
+
+		switch act {
+		case "list":
+			list, err := store.List()
+			if err != nil {
+				return fmt.Errorf("while listing pending submissions: %s", err)
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "FINGERPRINT\tEMAIL\tREMOTE IP\tSUBMITTED\tEXPIRES")
+			for _, s := range list {
+				fmt.Fprintf(
+					tw, "%s\t%s\t%s\t%s\t%s\n",
+					s.Fingerprint, s.Email, s.RemoteIP,
+					s.Submitted.Format(time.RFC3339), s.Expires.Format(time.RFC3339),
+				)
+			}
+			return tw.Flush()
+		case "purge":
+			n, err := store.Purge(fs.Arg(0))
+			if err != nil {
+				return fmt.Errorf("while purging pending submissions: %s", err)
+			}
+			fmt.Printf("%d pending submission(s) removed\n", n)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/internal/pkg/mailverifier"
+	"github.com/ctrliq/spks/internal/pkg/signingkey"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/hkpserver"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+func serveCommand(args []string) error {
+	fs, configPath := newFlagSet("serve")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() > 0 {
+		return fmt.Errorf("usage: spks serve [-config path]")
+	}
+	return serve(*configPath)
+}
+
+func serve(configPath string) error {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		s := <-c
+		logrus.WithField("signal", s).Info("Server interrupted by signal")
+		cancel()
+	}()
+
+	db, err := openDatabase(&cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect()
+
+	var signingKey *openpgp.Entity
+	var verifier hkpserver.Verifier
+
+	if database.IsReadOnly(db) {
+		// keys are published as is, submissions are rejected
+		logrus.Info("Serving keys from a read-only database, verification disabled")
+	} else {
+		passphrase, err := config.SigningKeyPassphrase(&cfg)
+		if err != nil {
+			return err
+		}
+		signingKey, err = signingkey.Load(db, cfg.SigningPGPKey, cfg.AdminEmail, passphrase)
+		if err != nil {
+			return err
+		}
+		release, err := signingkey.MarkInUse(db)
+		if err != nil {
+			return err
+		}
+		defer release()
+		verifier = mailverifier.New(&cfg, signingKey)
+	}
+
+	scfg := hkpserver.Config{
+		Addr:             cfg.BindAddr,
+		PublicPem:        cfg.Certificate.PublicKeyPath,
+		PrivatePem:       cfg.Certificate.PrivateKeyPath,
+		DB:               db,
+		CustomHandler:    hkpserver.LogRequestHandler,
+		Verifier:         verifier,
+		KeyPushRateLimit: cfg.KeyPushRateLimit,
+		MaxResults:       cfg.MaxResults,
+		WKDDomains:       cfg.MailIdentityDomains,
+		AdminAddr:        cfg.Admin.BindAddr,
+		AdminToken:       cfg.Admin.Token,
+		AdminClientCA:    cfg.Admin.ClientCA,
+		SigningKey:       signingKey,
+		CertLifetime:     cfg.CertificationLifetime,
+	}
+
+	logrus.WithField("listen", cfg.BindAddr).Infof("Server started (version %s)", version)
+	if cfg.Admin.BindAddr != "" {
+		logrus.WithField("listen", cfg.Admin.BindAddr).Info("Administrative API enabled")
+	}
+
+	return hkpserver.Start(ctx, scfg)
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/internal/pkg/signingkey"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// signingKeyCommand manages the server signing key.
+func signingKeyCommand(args []string) error {
+	act, args, err := action("signing-key", args, "show", "export", "rotate", "import-signatures")
+	if err != nil {
+		return err
+	}
+
+	fs, configPath := newFlagSet("signing-key " + act)
+	output := fs.String("o", "", "output file (export only), standard output by default")
+	private := fs.Bool("private", false, "export the private key")
+	key := fs.String("key", "", "path to (or base64 encoded) armored key to rotate to, a new key is generated if empty, or holding the signatures to import")
+	revoke := fs.Bool("revoke", false, "revoke the previous signing key (rotate only)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return withDatabase(*configPath, func(cfg *config.ServerConfig, db database.Engine) error {
+		switch act {
+		case "show":
+			return showSigningKeys(db)
+		case "export":
+			current, err := signingkey.Current(db)
+			if err != nil {
+				return err
+			} else if current == nil {
+				return fmt.Errorf("no signing key found")
+			}
+			return writeOutput(*output, func(w io.Writer) error {
+				if !*private {
+					return keyring.WriteArmoredKeyRing(w, openpgp.EntityList{current})
+				}
+				aw, err := armor.Encode(w, openpgp.PrivateKeyType, nil)
+				if err != nil {
+					return err
+				}
+				if err := keyring.SerializePrivate(aw, current); err != nil {
+					return err
+				}
+				return aw.Close()
+			})
+		case "rotate":
+			return rotateSigningKey(cfg, db, *key, *revoke)
+		case "import-signatures":
+			return importSignatures(db, *key)
+		}
+		return nil
+	})
+}
+
+func showSigningKeys(db database.Engine) error {
+	el, err := signingkey.List(db)
+	if err != nil {
+		return err
+	}
+	current := signingkey.Select(el)
+
+	for _, e := range el {
+		status := "rotated"
+		if e == current {
+			status = "current"
+		} else if len(e.Revocations) > 0 {
+			status = "revoked"
+		}
+		if e.PrivateKey.Encrypted {
+			status += ",encrypted"
+		}
+		name := ""
+		if id := keyring.PrimaryIdentity(e); id != nil {
+			name = id.Name
+		}
+		fmt.Printf("%X  %s  %s  %s\n",
+			e.PrimaryKey.Fingerprint[:],
+			e.PrimaryKey.CreationTime.UTC().Format(time.RFC3339),
+			status, name,
+		)
+	}
+
+	return nil
+}
+
+// rotateSigningKey stores a new signing key which becomes the current
+// signing key, the new key is cross-certified by the previous one and
+// the verified identities are certified with the new key. Previous
+// signing keys are kept.
+func rotateSigningKey(cfg *config.ServerConfig, db database.Engine, key string, revoke bool) error {
+	var e *openpgp.Entity
+
+	if key != "" {
+		el, err := signingkey.Decode(key)
+		if err != nil {
+			return err
+		} else if err := signingkey.Check(el); err != nil {
+			return err
+		}
+		e = el[0]
+	} else {
+		var err error
+		if e, err = signingkey.Generate(cfg.AdminEmail); err != nil {
+			return err
+		}
+	}
+
+	passphrase, err := config.SigningKeyPassphrase(cfg)
+	if err != nil {
+		return err
+	}
+
+	result, err := signingkey.Rotate(db, e, revoke, passphrase)
+	if err != nil && result != nil {
+		return fmt.Errorf("%s\nthe new signing key %X is stored, rotate again to this key to resume the rotation, it's exported by 'signing-key export -private'", err, e.PrimaryKey.Fingerprint[:])
+	} else if err != nil {
+		return err
+	}
+
+	if result.Resumed {
+		fmt.Printf("Interrupted rotation to %X resumed\n", e.PrimaryKey.Fingerprint[:])
+	}
+	fmt.Printf("Signing key rotated to %X\n", e.PrimaryKey.Fingerprint[:])
+	if result.Previous != nil {
+		status := "kept"
+		if result.Revoked {
+			status = "revoked"
+		}
+		fmt.Printf("Previous signing key %X cross-certified the new key and was %s\n", result.Previous.PrimaryKey.Fingerprint[:], status)
+	}
+	fmt.Printf("%d identities certified with the new signing key\n", result.Recertified)
+	fmt.Println("Start the server to use the new signing key")
+
+	return nil
+}
+
+// importSignatures imports the certifications found in an export of
+// the signing keys signed by third parties, like the trust signature
+// of an organisation key, so they are published with the signing keys.
+func importSignatures(db database.Engine, key string) error {
+	if key == "" {
+		return fmt.Errorf("a key holding the signatures to import is required")
+	}
+	el, opaque, err := signingkey.DecodeSignatures(key)
+	if err != nil {
+		return err
+	}
+
+	count, err := signingkey.ImportSignatures(db, el, opaque)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d signatures imported\n", count)
+
+	return nil
+}
@@ -8,12 +8,14 @@ require (
 	github.com/sirupsen/logrus v1.9.0
 	github.com/tidwall/buntdb v1.2.9
 	github.com/tidwall/gjson v1.14.1
-	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/text v0.3.7
 	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
 	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
+	modernc.org/sqlite v1.14.2
 )
 
 replace golang.org/x/crypto => github.com/ProtonMail/crypto v0.0.0-20200720171902-c800c6275507
@@ -4,14 +4,19 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	_ "github.com/ctrliq/spks/internal/pkg/fsdb" // register the read-only filesystem database engine
 	"github.com/ctrliq/spks/internal/pkg/mailer"
+	_ "github.com/ctrliq/spks/internal/pkg/sqldb" // register the SQL database engine
 	"github.com/ctrliq/spks/pkg/database"
 	"github.com/ctrliq/spks/pkg/hkpserver"
 	"gopkg.in/yaml.v3"
@@ -26,35 +31,85 @@ const (
 	bindAddrEnv                 = "SPKS_BIND_ADDRESS"
 	publicURLEnv                = "SPKS_PUBLIC_URL"
 	signingKeyEnv               = "SPKS_SIGNING_PGPKEY"
+	signingKeyPassphraseEnv     = "SPKS_SIGNING_PGPKEY_PASSPHRASE"
+	signingKeyPassphraseFileEnv = "SPKS_SIGNING_PGPKEY_PASSPHRASE_FILE"
 	publicKeyEnv                = "SPKS_PUBLIC_KEY_CERT"
 	privateKeyEnv               = "SPKS_PRIVATE_KEY_CERT"
 	adminEmailEnv               = "SPKS_ADMIN_EMAIL"
 	mailIdentityDomainsEnv      = "SPKS_MAIL_IDENTITY_DOMAINS"
 	mailIdentityVerificationEnv = "SPKS_MAIL_IDENTITY_VERIFICATION"
+	mailIdentityChallengeEnv    = "SPKS_MAIL_IDENTITY_CHALLENGE"
+	mailIdentityMultipleEnv     = "SPKS_MAIL_IDENTITY_MULTIPLE"
+	mailLocalPartFoldingEnv     = "SPKS_MAIL_LOCAL_PART_FOLDING"
 	keyPushRateLimitEnv         = "SPKS_KEY_PUSH_RATE_LIMIT"
+	maxResultsEnv               = "SPKS_MAX_RESULTS"
+	verificationTokenTTLEnv     = "SPKS_VERIFICATION_TOKEN_TTL"
+	certificationLifetimeEnv    = "SPKS_CERTIFICATION_LIFETIME"
+	certificationRenewalEnv     = "SPKS_CERTIFICATION_RENEWAL"
+	adminBindAddrEnv            = "SPKS_ADMIN_BIND_ADDRESS"
+	adminTokenEnv               = "SPKS_ADMIN_TOKEN"
+	adminClientCAEnv            = "SPKS_ADMIN_CLIENT_CA"
 )
 
+// SigningKeyPassphraseCredential is the name of the systemd credential
+// holding the signing PGP key passphrase.
+const SigningKeyPassphraseCredential = "signing-pgpkey-passphrase"
+
+// DefaultVerificationTokenTTL is the default lifetime of the
+// tokens sent in verification mails.
+const DefaultVerificationTokenTTL = 24 * time.Hour
+
+// DefaultMaxResults is the default maximum number of keys returned
+// by lookups.
+const DefaultMaxResults = 100
+
+// DefaultCertificationRenewal is the default period before the
+// expiration of a server certification during which its renewal
+// is requested by mail.
+const DefaultCertificationRenewal = 30 * 24 * time.Hour
+
 type Certificate struct {
 	PublicKeyPath  string `yaml:"public-key"`
 	PrivateKeyPath string `yaml:"private-key"`
 }
 
+// AdminConfig describes the administrative API configuration.
+type AdminConfig struct {
+	BindAddr string `yaml:"bind-address"`
+	Token    string `yaml:"token"`
+	ClientCA string `yaml:"client-ca"`
+}
+
 type ServerConfig struct {
 	BindAddr   string `yaml:"bind-address"`
 	PublicURL  string `yaml:"public-url"`
 	AdminEmail string `yaml:"admin-email"`
 
-	SigningPGPKey string `yaml:"signing-pgpkey"`
+	SigningPGPKey               string `yaml:"signing-pgpkey"`
+	SigningPGPKeyPassphraseFile string `yaml:"signing-pgpkey-passphrase-file"`
 
 	Certificate Certificate `yaml:"certificate"`
 
+	Admin AdminConfig `yaml:"admin"`
+
 	MailerConfig mailer.Config `yaml:"mail"`
 
 	MailIdentityDomains      []string `yaml:"mail-identity-domains"`
 	MailIdentityVerification bool     `yaml:"mail-identity-verification"`
+	MailIdentityChallenge    bool     `yaml:"mail-identity-challenge"`
+	MailIdentityMultiple     bool     `yaml:"mail-identity-multiple"`
+
+	MailLocalPartFolding database.LocalPartFolding `yaml:"mail-local-part-folding"`
+
+	VerificationTokenTTL time.Duration `yaml:"verification-token-ttl"`
+
+	CertificationLifetime time.Duration `yaml:"certification-lifetime"`
+	CertificationRenewal  time.Duration `yaml:"certification-renewal"`
 
 	KeyPushRateLimit hkpserver.RateLimit `yaml:"key-push-rate-limit"`
 
+	MaxResults int `yaml:"max-results"`
+
 	DBEngine string                 `yaml:"db"`
 	DBConfig map[string]interface{} `yaml:"db-config"`
 }
@@ -65,6 +120,9 @@ var DefaultServerConfig ServerConfig = ServerConfig{
 	MailerConfig: mailer.DefaultConfig,
 	DBEngine:     defaultdb.Name,
 	AdminEmail:   "root@localhost",
+
+	VerificationTokenTTL: DefaultVerificationTokenTTL,
+	MaxResults:           DefaultMaxResults,
 }
 
 func Parse(path string) (ServerConfig, error) {
@@ -115,6 +173,10 @@ func CheckServerConfig(cfg *ServerConfig) error {
 	if env != "" {
 		cfg.SigningPGPKey = env
 	}
+	env = os.Getenv(signingKeyPassphraseFileEnv)
+	if env != "" {
+		cfg.SigningPGPKeyPassphraseFile = env
+	}
 	env = os.Getenv(publicKeyEnv)
 	if env != "" {
 		cfg.Certificate.PublicKeyPath = env
@@ -135,6 +197,26 @@ func CheckServerConfig(cfg *ServerConfig) error {
 		}
 		cfg.MailIdentityVerification = b
 	}
+	env = os.Getenv(mailIdentityChallengeEnv)
+	if env != "" {
+		b, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("while parsing %s: %s", mailIdentityChallengeEnv, err)
+		}
+		cfg.MailIdentityChallenge = b
+	}
+	env = os.Getenv(mailIdentityMultipleEnv)
+	if env != "" {
+		b, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("while parsing %s: %s", mailIdentityMultipleEnv, err)
+		}
+		cfg.MailIdentityMultiple = b
+	}
+	env = os.Getenv(mailLocalPartFoldingEnv)
+	if env != "" {
+		cfg.MailLocalPartFolding = database.LocalPartFolding(env)
+	}
 	env = os.Getenv(mailIdentityDomainsEnv)
 	if env != "" {
 		cfg.MailIdentityDomains = strings.Split(env, ",")
@@ -146,6 +228,51 @@ func CheckServerConfig(cfg *ServerConfig) error {
 	if env != "" {
 		cfg.KeyPushRateLimit = hkpserver.RateLimit(env)
 	}
+	env = os.Getenv(maxResultsEnv)
+	if env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("while parsing %s: %s", maxResultsEnv, err)
+		}
+		cfg.MaxResults = n
+	}
+	env = os.Getenv(verificationTokenTTLEnv)
+	if env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			return fmt.Errorf("while parsing %s: %s", verificationTokenTTLEnv, err)
+		}
+		cfg.VerificationTokenTTL = d
+	}
+	env = os.Getenv(certificationLifetimeEnv)
+	if env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			return fmt.Errorf("while parsing %s: %s", certificationLifetimeEnv, err)
+		}
+		cfg.CertificationLifetime = d
+	}
+	env = os.Getenv(certificationRenewalEnv)
+	if env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			return fmt.Errorf("while parsing %s: %s", certificationRenewalEnv, err)
+		}
+		cfg.CertificationRenewal = d
+	}
+
+	env = os.Getenv(adminBindAddrEnv)
+	if env != "" {
+		cfg.Admin.BindAddr = env
+	}
+	env = os.Getenv(adminTokenEnv)
+	if env != "" {
+		cfg.Admin.Token = env
+	}
+	env = os.Getenv(adminClientCAEnv)
+	if env != "" {
+		cfg.Admin.ClientCA = env
+	}
 
 	if cfg.AdminEmail == "" {
 		return fmt.Errorf("admin email address within is missing or empty within configuration")
@@ -153,13 +280,83 @@ func CheckServerConfig(cfg *ServerConfig) error {
 	if cfg.PublicURL == "" {
 		return fmt.Errorf("configuration public-url is missing or empty")
 	}
-	if err := mailer.CheckConfig(&cfg.MailerConfig); err != nil {
-		return err
+	if cfg.Admin.BindAddr != "" && cfg.Admin.Token == "" && cfg.Admin.ClientCA == "" {
+		return fmt.Errorf("administrative API requires either a token or a client CA certificate")
+	}
+	if cfg.VerificationTokenTTL == 0 {
+		cfg.VerificationTokenTTL = DefaultVerificationTokenTTL
+	} else if cfg.VerificationTokenTTL < 0 {
+		return fmt.Errorf("configuration verification-token-ttl must be a positive duration")
+	}
+	// a negative maximum disables the lookup limit
+	if cfg.MaxResults == 0 {
+		cfg.MaxResults = DefaultMaxResults
+	}
+	switch cfg.MailLocalPartFolding {
+	case "":
+		cfg.MailLocalPartFolding = database.FullFolding
+	case database.FullFolding, database.ASCIIFolding, database.NoFolding:
+	default:
+		return fmt.Errorf("configuration mail-local-part-folding must be either %s, %s or %s", database.FullFolding, database.ASCIIFolding, database.NoFolding)
+	}
+	if cfg.CertificationLifetime < 0 {
+		return fmt.Errorf("configuration certification-lifetime must be a positive duration")
+	} else if cfg.CertificationRenewal < 0 {
+		return fmt.Errorf("configuration certification-renewal must be a positive duration")
+	} else if cfg.CertificationLifetime > 0 {
+		if cfg.CertificationRenewal == 0 {
+			cfg.CertificationRenewal = DefaultCertificationRenewal
+			if cfg.CertificationRenewal >= cfg.CertificationLifetime {
+				cfg.CertificationRenewal = cfg.CertificationLifetime / 2
+			}
+		} else if cfg.CertificationRenewal >= cfg.CertificationLifetime {
+			return fmt.Errorf("configuration certification-renewal must be shorter than certification-lifetime")
+		}
 	}
 	db, _ := database.GetDatabaseEngine(cfg.DBEngine)
 	if err := db.CheckConfig(); err != nil {
 		return err
 	}
+	// read-only databases are served without verification
+	if database.IsReadOnly(db) {
+		return nil
+	}
+	if err := mailer.CheckConfig(&cfg.MailerConfig); err != nil {
+		return err
+	}
 
 	return nil
 }
+
+// SigningKeyPassphrase returns the passphrase of the signing PGP key
+// taken from the SPKS_SIGNING_PGPKEY_PASSPHRASE environment variable,
+// the configured passphrase file or the systemd credential, in this
+// order. It returns nil if no passphrase is provided.
+func SigningKeyPassphrase(cfg *ServerConfig) ([]byte, error) {
+	if env := os.Getenv(signingKeyPassphraseEnv); env != "" {
+		return []byte(env), nil
+	}
+
+	path := cfg.SigningPGPKeyPassphraseFile
+	if path == "" {
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return nil, nil
+		}
+		path = filepath.Join(dir, SigningKeyPassphraseCredential)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("while reading signing pgp key passphrase: %s", err)
+	}
+	b = bytes.TrimRight(b, "\r\n")
+	if len(b) == 0 {
+		return nil, fmt.Errorf("signing pgp key passphrase file %s is empty", path)
+	}
+
+	return b, nil
+}
@@ -7,13 +7,18 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
 	"github.com/tidwall/buntdb"
 	"github.com/tidwall/gjson"
 	"golang.org/x/crypto/openpgp"
@@ -29,21 +34,71 @@ const (
 	keySep         = ":"
 	keyPrefix      = "key" + keySep
 	sigKeyPrefix   = "sigkey" + keySep
+	uidPrefix      = "uid" + keySep
+	sigUIDPrefix   = "siguid" + keySep
+	subkeyPrefix   = "subkey" + keySep
+	gramPrefix     = "gram" + keySep
+	sigGramPrefix  = "siggram" + keySep
+	statePrefix    = "state" + keySep
 )
 
+// recordVersion is the version of the key records layout, records of
+// previous versions are migrated when connecting to the database.
+const recordVersion = 2
+
+// gramSize is the length in bytes of the n-grams indexing the user ID
+// names and emails, substring searches only go through the keys holding
+// the least frequent n-gram of the search, see gramKey.
+const gramSize = 3
+
+// recordPrefixes are the prefixes of the records describing a key.
+type recordPrefixes struct {
+	key  string
+	uid  string
+	gram string
+}
+
+var (
+	publicPrefixes  = recordPrefixes{keyPrefix, uidPrefix, gramPrefix}
+	signingPrefixes = recordPrefixes{sigKeyPrefix, sigUIDPrefix, sigGramPrefix}
+)
+
+// identityRecord describes a key user ID, each user ID is also stored
+// in its own record under the uid prefix followed by the key ID and
+// the user ID position, so the name and email indexes cover all the
+// key user IDs. Name and email are normalized with the local part
+// folding of the database, see database.LocalPartFolding.
+type identityRecord struct {
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// entityRecord describes a key record, the user IDs are sorted with
+// the primary user ID first. Subkeys are listed by fingerprint, each
+// public key subkey is also indexed by a record under the subkey prefix
+// followed by the subkey ID and the primary key ID, holding the subkey
+// fingerprint.
 type entityRecord struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Key   []byte `json:"key"`
+	Version    int              `json:"version"`
+	Identities []identityRecord `json:"identities"`
+	Subkeys    []string         `json:"subkeys"`
+	Key        []byte           `json:"key"`
 }
 
 type Config struct {
 	Dir string `yaml:"dir"`
 }
 
+// errLocked is returned when the database directory is locked by
+// another process.
+var errLocked = errors.New("database is used by another process")
+
 type bunt struct {
-	db  *buntdb.DB
-	cfg Config
+	db      *buntdb.DB
+	cfg     Config
+	lock    *os.File
+	folding database.LocalPartFolding
 }
 
 func (b *bunt) NewConfig() database.Config {
@@ -64,22 +119,36 @@ func (b *bunt) CheckConfig() error {
 	return nil
 }
 
+// SetLocalPartFolding sets the folding used to normalize identities.
+func (b *bunt) SetLocalPartFolding(f database.LocalPartFolding) {
+	b.folding = f
+}
+
 func (b *bunt) Connect() error {
 	var err error
 
 	createIndexes := map[string]struct{}{
-		keyPrefix + "name":     {},
-		keyPrefix + "email":    {},
-		sigKeyPrefix + "name":  {},
-		sigKeyPrefix + "email": {},
+		uidPrefix + "name":     {},
+		uidPrefix + "email":    {},
+		sigUIDPrefix + "name":  {},
+		sigUIDPrefix + "email": {},
 	}
 
 	if b.cfg.Dir == "" {
 		b.db, err = buntdb.Open(":memory:")
 	} else {
+		// buntdb doesn't lock the database file which is appended
+		// and replaced on compaction, a single process must use it
+		b.lock, err = lockFile(filepath.Join(b.cfg.Dir, "db.lock"))
+		if err == errLocked {
+			return fmt.Errorf("%s: %s, stop the server or use the administrative API", b.cfg.Dir, err)
+		} else if err != nil {
+			return fmt.Errorf("while locking database directory %s: %s", b.cfg.Dir, err)
+		}
 		b.db, err = buntdb.Open(filepath.Join(b.cfg.Dir, "db"))
 	}
 	if err != nil {
+		b.unlock()
 		return err
 	}
 
@@ -101,33 +170,94 @@ func (b *bunt) Connect() error {
 		}
 	}
 
-	return err
+	if err := b.migrate(); err != nil {
+		return fmt.Errorf("while migrating database records: %s", err)
+	}
+
+	return nil
+}
+
+// migrate rewrites the records of previous versions.
+func (b *bunt) migrate() error {
+	return b.db.Update(func(tx *buntdb.Tx) error {
+		for _, prefix := range []recordPrefixes{publicPrefixes, signingPrefixes} {
+			records := make(map[string]string)
+			err := tx.AscendKeys(prefix.key+"*", func(key, val string) bool {
+				if gjson.Get(val, "version").Int() < recordVersion {
+					records[strings.TrimPrefix(key, prefix.key)] = val
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+			for keyID, val := range records {
+				var er entityRecord
+				if err := json.Unmarshal([]byte(val), &er); err != nil {
+					return err
+				}
+				e, err := readEntity(er.Key)
+				if err != nil {
+					return fmt.Errorf("while reading key %s: %s", keyID, err)
+				}
+				// the key is kept as is, signing keys may be
+				// encrypted
+				if err := b.setEntity(tx, prefix, keyID, e, er.Key); err != nil {
+					return err
+				}
+				if prefix == publicPrefixes {
+					if err := setSubkeys(tx, keyID, e); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
 }
 
 func (b *bunt) Disconnect() error {
+	defer b.unlock()
 	return b.db.Close()
 }
 
+// Volatile reports whether the keys are only kept in memory.
+func (b *bunt) Volatile() bool {
+	return b.cfg.Dir == ""
+}
+
+// unlock releases the database directory lock if any.
+func (b *bunt) unlock() {
+	if b.lock != nil {
+		b.lock.Close()
+		b.lock = nil
+	}
+}
+
 func (b *bunt) Add(el openpgp.EntityList) error {
 	return b.db.Update(func(tx *buntdb.Tx) error {
 		for _, e := range el {
 			fp := e.PrimaryKey.KeyIdString()
-			val, err := marshalEntityRecord(e, false)
-			if err != nil {
+			buf := new(bytes.Buffer)
+			if err := keyring.Serialize(buf, e); err != nil {
 				return err
 			}
-			_, _, err = tx.Set(keyPrefix+fp, val, nil)
-			if err != nil {
+			if err := delSubkeys(tx, fp); err != nil {
+				return err
+			}
+			if err := b.setEntity(tx, publicPrefixes, fp, e, buf.Bytes()); err != nil {
+				return err
+			}
+			if err := setSubkeys(tx, fp, e); err != nil {
 				return err
 			}
 			// key entity with a private part is a signing key
 			if e.PrivateKey != nil {
-				val, err := marshalEntityRecord(e, true)
-				if err != nil {
+				buf := new(bytes.Buffer)
+				if err := keyring.SerializePrivate(buf, e); err != nil {
 					return err
 				}
-				_, _, err = tx.Set(sigKeyPrefix+fp, val, nil)
-				if err != nil {
+				if err := b.setEntity(tx, signingPrefixes, fp, e, buf.Bytes()); err != nil {
 					return err
 				}
 			}
@@ -140,10 +270,13 @@ func (b *bunt) Del(el openpgp.EntityList) error {
 	return b.db.Update(func(tx *buntdb.Tx) error {
 		for _, e := range el {
 			fpKey := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[12:20])
-			if _, err := tx.Delete(sigKeyPrefix + fpKey); err != buntdb.ErrNotFound {
+			if err := delEntity(tx, signingPrefixes, fpKey); err != nil {
+				return err
+			}
+			if err := delSubkeys(tx, fpKey); err != nil {
 				return err
 			}
-			if _, err := tx.Delete(keyPrefix + fpKey); err != buntdb.ErrNotFound {
+			if err := delEntity(tx, publicPrefixes, fpKey); err != nil {
 				return err
 			}
 		}
@@ -151,16 +284,16 @@ func (b *bunt) Del(el openpgp.EntityList) error {
 	})
 }
 
-func (b *bunt) Get(search string, isFingerprint bool, exact bool, kt database.KeyType) (openpgp.EntityList, error) {
+func (b *bunt) Get(search string, opts database.SearchOptions) (openpgp.EntityList, error) {
 	var dbErr error
 	var el openpgp.EntityList
 
-	kp := keyPrefix
-	if kt == database.SigningKey {
-		kp = sigKeyPrefix
+	p := publicPrefixes
+	if opts.KeyType == database.SigningKey {
+		p = signingPrefixes
 	}
 
-	if isFingerprint {
+	if opts.Fingerprint {
 		// fingerprint search
 		fp, err := hex.DecodeString(search)
 		if err != nil {
@@ -168,149 +301,523 @@ func (b *bunt) Get(search string, isFingerprint bool, exact bool, kt database.Ke
 		}
 
 		fpKey := ""
+		fullFp := ""
 
 		switch len(fp) {
 		case 4, 8:
 			fpKey = fmt.Sprintf("%X", fp)
 		case 20:
+			// full fingerprints are compared once the
+			// candidate keys are read
 			fpKey = fmt.Sprintf("%X", fp[12:20])
+			fullFp = fmt.Sprintf("%X", fp)
 		default:
 			// allow to query the signing key internally
 			// without specifying a fingerprint
-			if kt != database.SigningKey {
+			if opts.KeyType != database.SigningKey {
 				return nil, fmt.Errorf("fingerprint must be either 4, 8 or 20 bytes length")
 			}
 		}
 
 		dbErr = b.db.View(func(tx *buntdb.Tx) error {
-			if exact {
-				val, err := tx.Get(kp + fpKey)
-				if err != nil {
-					if err == buntdb.ErrNotFound {
-						return nil
-					}
+			var keyIDs []string
+
+			// primary key IDs first
+			if opts.Exact {
+				if _, err := tx.Get(p.key + fpKey); err == nil {
+					keyIDs = append(keyIDs, fpKey)
+				} else if err != buntdb.ErrNotFound {
 					return err
 				}
-				e, err := unmarshalEntityRecord(val)
+			} else {
+				err := tx.AscendKeys(fmt.Sprintf("%s*%s", p.key, fpKey), func(key, val string) bool {
+					keyIDs = append(keyIDs, strings.TrimPrefix(key, p.key))
+					return true
+				})
 				if err != nil {
 					return err
 				}
-				el = append(el, e)
-				return nil
 			}
+			primaries, err := getEntities(tx, p.key, keyIDs, func(e *openpgp.Entity) bool {
+				return fullFp == "" || fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]) == fullFp
+			})
+			if err != nil {
+				return err
+			}
+			el = append(el, primaries...)
 
-			keyPattern := fmt.Sprintf("%s*%s", kp, fpKey)
+			if fpKey == "" {
+				return nil
+			}
 
-			return tx.AscendKeys(keyPattern, func(key, val string) bool {
-				e, err := unmarshalEntityRecord(val)
-				if err != nil {
-					return false
+			// then keys owning a matching subkey
+			subkeyPattern := subkeyPrefix + fpKey + keySep + "*"
+			if !opts.Exact {
+				subkeyPattern = subkeyPrefix + "*" + fpKey + keySep + "*"
+			}
+			found := make(map[string]bool)
+			for _, e := range el {
+				found[e.PrimaryKey.KeyIdString()] = true
+			}
+			keyIDs = keyIDs[:0]
+			err = tx.AscendKeys(subkeyPattern, func(key, val string) bool {
+				keyID := key[strings.LastIndex(key, keySep)+1:]
+				if (fullFp == "" || val == fullFp) && !found[keyID] {
+					found[keyID] = true
+					keyIDs = append(keyIDs, keyID)
 				}
-				el = append(el, e)
 				return true
 			})
+			if err != nil {
+				return err
+			}
+			owners, err := getEntities(tx, p.key, keyIDs, nil)
+			if err != nil {
+				return err
+			}
+			el = append(el, owners...)
+
+			low, high := opts.Bounds(len(el))
+			el = el[low:high]
+
+			return nil
 		})
 	} else {
 		// text search
+		search = b.folding.Normalize(search)
 		dbErr = b.db.View(func(tx *buntdb.Tx) error {
-			if exact {
-				// first search for email
-				err := tx.AscendEqual(kp+"email", search, func(key, val string) bool {
-					e, err := unmarshalEntityRecord(val)
+			var keyIDs []string
+
+			// collect the IDs of the keys having a matching
+			// user ID, a key may match through several user IDs
+			found := make(map[string]bool)
+			collect := func(key string) {
+				keyID := strings.SplitN(strings.TrimPrefix(key, p.uid), keySep, 2)[0]
+				if !found[keyID] {
+					found[keyID] = true
+					keyIDs = append(keyIDs, keyID)
+				}
+			}
+
+			if opts.Exact {
+				// index pivots are compared as JSON records
+				pivot, err := json.Marshal(&identityRecord{Name: search, Email: search})
+				if err != nil {
+					return err
+				}
+				// first search for email then for name
+				for _, index := range []string{p.uid + "email", p.uid + "name"} {
+					err := tx.AscendEqual(index, string(pivot), func(key, val string) bool {
+						collect(key)
+						return true
+					})
 					if err != nil {
-						return false
+						return err
+					} else if len(keyIDs) > 0 {
+						break
 					}
-					el = append(el, e)
-					return false
-				})
+				}
+			} else if len(search) >= gramSize {
+				var err error
+				keyIDs, err = gramSearch(tx, p, search)
 				if err != nil {
 					return err
 				}
-				if len(el) == 1 {
-					return nil
+			} else {
+				// searches shorter than n-grams go through
+				// all the user IDs
+				err := scanSearch(tx, p, search, collect)
+				if err != nil {
+					return err
 				}
-				// search for name
-				return tx.AscendEqual(kp+"name", search, func(key, val string) bool {
-					e, err := unmarshalEntityRecord(val)
-					if err != nil {
-						return false
-					}
-					el = append(el, e)
-					return false
-				})
 			}
-			return tx.Ascend(kp+"email", func(key, val string) bool {
-				r := gjson.GetMany(val, "name", "email")
-				if len(r) != 2 {
-					return true
-				}
-				name := r[0].String()
-				email := r[1].String()
 
-				if strings.Contains(name, search) || strings.Contains(email, search) {
-					e, err := unmarshalEntityRecord(val)
-					if err != nil {
-						return true
-					}
-					el = append(el, e)
-				}
-				return true
-			})
+			// keys are paginated in key ID order before
+			// being read
+			sort.Strings(keyIDs)
+			low, high := opts.Bounds(len(keyIDs))
+
+			var err error
+			el, err = getEntities(tx, p.key, keyIDs[low:high], nil)
+			return err
 		})
 	}
 
 	return el, dbErr
 }
 
-func marshalEntityRecord(e *openpgp.Entity, private bool) (string, error) {
-	var identity *openpgp.Identity
+func (b *bunt) SetState(key string, value []byte, ttl time.Duration) error {
+	return b.db.Update(func(tx *buntdb.Tx) error {
+		var opts *buntdb.SetOptions
+		if ttl > 0 {
+			opts = &buntdb.SetOptions{Expires: true, TTL: ttl}
+		}
+		_, _, err := tx.Set(statePrefix+key, string(value), opts)
+		return err
+	})
+}
+
+func (b *bunt) GetState(key string) ([]byte, error) {
+	var value []byte
+
+	err := b.db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(statePrefix + key)
+		if err == buntdb.ErrNotFound {
+			return database.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		value = []byte(val)
+		return nil
+	})
+
+	return value, err
+}
+
+func (b *bunt) DelState(key string) error {
+	return b.db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(statePrefix + key)
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (b *bunt) ListState(prefix string, fn func(key string, value []byte) bool) error {
+	return b.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(statePrefix+prefix+"*", func(key, val string) bool {
+			return fn(strings.TrimPrefix(key, statePrefix), []byte(val))
+		})
+	})
+}
+
+// Compact rewrites the database file to remove deleted and
+// outdated records.
+func (b *bunt) Compact() error {
+	return b.db.Shrink()
+}
+
+// scanSearch calls collect with the user ID records whose name or email
+// contains the normalized search.
+func scanSearch(tx *buntdb.Tx, p recordPrefixes, search string, collect func(key string)) error {
+	return tx.Ascend(p.uid+"email", func(key, val string) bool {
+		r := gjson.GetMany(val, "name", "email")
+		if len(r) != 2 {
+			return true
+		}
+		name := r[0].String()
+		email := r[1].String()
+
+		if strings.Contains(name, search) || strings.Contains(email, search) {
+			collect(key)
+		}
+		return true
+	})
+}
+
+// gramSearch returns the IDs of the keys having a user ID whose name or
+// email contains the normalized search. The candidate keys are the keys
+// holding the least frequent search n-gram, they are then checked
+// against the user IDs of their record.
+func gramSearch(tx *buntdb.Tx, p recordPrefixes, search string) ([]string, error) {
+	rarest := ""
+	min := 0
 
-	for _, id := range e.Identities {
-		identity = id
-		break
+	for gram := range grams(search) {
+		n, err := gramCount(tx, p, gram)
+		if err != nil {
+			return nil, err
+		} else if n == 0 {
+			return nil, nil
+		}
+		if rarest == "" || n < min {
+			rarest, min = gram, n
+		}
 	}
 
-	if identity == nil {
-		return "", fmt.Errorf("no suitable identity found")
+	var keyIDs []string
+
+	prefix := gramKey(p, rarest) + keySep
+	err := tx.AscendKeys(prefix+"*", func(key, val string) bool {
+		keyIDs = append(keyIDs, strings.TrimPrefix(key, prefix))
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	buf := new(bytes.Buffer)
+	matches := keyIDs[:0]
 
-	// if the entity has a private key, we know this key is the signing
-	// key set and used by the server.
-	if private {
-		if err := e.SerializePrivateWithoutSigning(buf, nil); err != nil {
-			return "", err
+	for _, keyID := range keyIDs {
+		val, err := tx.Get(p.key + keyID)
+		if err == buntdb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
 		}
-	} else {
-		if err := e.Serialize(buf); err != nil {
-			return "", err
+		match := false
+		gjson.Get(val, "identities").ForEach(func(_, id gjson.Result) bool {
+			match = strings.Contains(id.Get("name").String(), search) || strings.Contains(id.Get("email").String(), search)
+			return !match
+		})
+		if match {
+			matches = append(matches, keyID)
+		}
+	}
+
+	return matches, nil
+}
+
+// getEntities returns the keys stored under the key IDs for which
+// match returns true, all the keys are returned if match is nil.
+func getEntities(tx *buntdb.Tx, kp string, keyIDs []string, match func(*openpgp.Entity) bool) (openpgp.EntityList, error) {
+	var el openpgp.EntityList
+
+	for _, keyID := range keyIDs {
+		val, err := tx.Get(kp + keyID)
+		if err == buntdb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		e, err := unmarshalEntityRecord(val)
+		if err != nil {
+			return nil, err
+		}
+		if match == nil || match(e) {
+			el = append(el, e)
 		}
 	}
 
+	return el, nil
+}
+
+// setEntity stores the key record along with its user ID and n-gram
+// records under the key ID, replacing the previous ones.
+func (b *bunt) setEntity(tx *buntdb.Tx, p recordPrefixes, keyID string, e *openpgp.Entity, key []byte) error {
+	if len(e.Identities) == 0 {
+		return fmt.Errorf("no suitable identity found")
+	}
+	if err := delGrams(tx, p, keyID); err != nil {
+		return err
+	}
+
 	er := entityRecord{
-		Name:  identity.UserId.Name,
-		Email: identity.UserId.Email,
-		Key:   buf.Bytes(),
+		Version: recordVersion,
+		Subkeys: make([]string, 0, len(e.Subkeys)),
+		Key:     key,
+	}
+	for _, subkey := range e.Subkeys {
+		er.Subkeys = append(er.Subkeys, fmt.Sprintf("%X", subkey.PublicKey.Fingerprint[:]))
+	}
+
+	primary := keyring.PrimaryIdentity(e)
+	for _, id := range keyring.SortedIdentities(e) {
+		er.Identities = append(er.Identities, identityRecord{
+			Name:    b.folding.Normalize(id.UserId.Name),
+			Email:   b.folding.Normalize(id.UserId.Email),
+			Primary: id == primary,
+		})
 	}
 
-	b, err := json.Marshal(&er)
+	val, err := json.Marshal(&er)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if _, _, err := tx.Set(p.key+keyID, string(val), nil); err != nil {
+		return err
+	}
+
+	if err := delIdentities(tx, p.uid, keyID); err != nil {
+		return err
+	}
+	for i, ir := range er.Identities {
+		val, err := json.Marshal(&ir)
+		if err != nil {
+			return err
+		}
+		if _, _, err := tx.Set(fmt.Sprintf("%s%s%s%d", p.uid, keyID, keySep, i), string(val), nil); err != nil {
+			return err
+		}
 	}
 
-	return string(b), nil
+	return setGrams(tx, p, keyID, &er)
+}
+
+// delEntity removes the key record and its user ID and n-gram records.
+func delEntity(tx *buntdb.Tx, p recordPrefixes, keyID string) error {
+	if err := delGrams(tx, p, keyID); err != nil {
+		return err
+	}
+	if _, err := tx.Delete(p.key + keyID); err != nil && err != buntdb.ErrNotFound {
+		return err
+	}
+	return delIdentities(tx, p.uid, keyID)
+}
+
+// delIdentities removes the user ID records of the key.
+func delIdentities(tx *buntdb.Tx, up, keyID string) error {
+	var keys []string
+
+	err := tx.AscendKeys(up+keyID+keySep+"*", func(key, val string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, err := tx.Delete(key); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// texts returns the searchable user ID names and emails.
+func (er *entityRecord) texts() []string {
+	texts := make([]string, 0, 2*len(er.Identities))
+	for _, id := range er.Identities {
+		texts = append(texts, id.Name, id.Email)
+	}
+	return texts
+}
+
+// grams returns the distinct n-grams of the texts.
+func grams(texts ...string) map[string]bool {
+	g := make(map[string]bool)
+	for _, s := range texts {
+		for i := 0; i+gramSize <= len(s); i++ {
+			g[s[i:i+gramSize]] = true
+		}
+	}
+	return g
+}
+
+// gramKey returns the key of the n-gram record counting the keys
+// holding the n-gram, n-grams are hex encoded as they may contain
+// pattern characters. The keys are listed by records under the n-gram
+// record key followed by the key ID.
+func gramKey(p recordPrefixes, gram string) string {
+	return p.gram + hex.EncodeToString([]byte(gram))
+}
+
+// gramCount returns the number of keys holding the n-gram.
+func gramCount(tx *buntdb.Tx, p recordPrefixes, gram string) (int, error) {
+	val, err := tx.Get(gramKey(p, gram))
+	if err == buntdb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(val)
+}
+
+// setGrams adds the key to the records of its n-grams.
+func setGrams(tx *buntdb.Tx, p recordPrefixes, keyID string, er *entityRecord) error {
+	for gram := range grams(er.texts()...) {
+		n, err := gramCount(tx, p, gram)
+		if err != nil {
+			return err
+		}
+		if _, _, err := tx.Set(gramKey(p, gram), strconv.Itoa(n+1), nil); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set(gramKey(p, gram)+keySep+keyID, "", nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delGrams removes the stored key from the records of its n-grams.
+func delGrams(tx *buntdb.Tx, p recordPrefixes, keyID string) error {
+	val, err := tx.Get(p.key + keyID)
+	if err == buntdb.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var er entityRecord
+	if err := json.Unmarshal([]byte(val), &er); err != nil {
+		return err
+	}
+
+	for gram := range grams(er.texts()...) {
+		if _, err := tx.Delete(gramKey(p, gram) + keySep + keyID); err == buntdb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		n, err := gramCount(tx, p, gram)
+		if err != nil {
+			return err
+		}
+		if n > 1 {
+			_, _, err = tx.Set(gramKey(p, gram), strconv.Itoa(n-1), nil)
+		} else {
+			_, err = tx.Delete(gramKey(p, gram))
+		}
+		if err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setSubkeys indexes the key subkeys by subkey ID.
+func setSubkeys(tx *buntdb.Tx, keyID string, e *openpgp.Entity) error {
+	for _, subkey := range e.Subkeys {
+		key := subkeyPrefix + subkey.PublicKey.KeyIdString() + keySep + keyID
+		if _, _, err := tx.Set(key, fmt.Sprintf("%X", subkey.PublicKey.Fingerprint[:]), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delSubkeys removes the subkey index records of the stored public
+// key.
+func delSubkeys(tx *buntdb.Tx, keyID string) error {
+	val, err := tx.Get(keyPrefix + keyID)
+	if err == buntdb.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var er entityRecord
+	if err := json.Unmarshal([]byte(val), &er); err != nil {
+		return err
+	}
+
+	for _, fp := range er.Subkeys {
+		key := subkeyPrefix + fp[24:] + keySep + keyID
+		if _, err := tx.Delete(key); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func unmarshalEntityRecord(val string) (*openpgp.Entity, error) {
-	var e *openpgp.Entity
 	var er entityRecord
 
 	if err := json.Unmarshal([]byte(val), &er); err != nil {
 		return nil, err
 	}
 
-	packets := packet.NewReader(bytes.NewReader(er.Key))
+	return readEntity(er.Key)
+}
+
+func readEntity(key []byte) (*openpgp.Entity, error) {
+	packets := packet.NewReader(bytes.NewReader(key))
 	e, err := openpgp.ReadEntity(packets)
 	if err != nil && err != io.EOF {
 		return nil, err
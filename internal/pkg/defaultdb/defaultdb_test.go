@@ -0,0 +1,559 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package defaultdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/tidwall/buntdb"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func newDB(tb testing.TB) *bunt {
+	db := new(bunt)
+	if err := db.Connect(); err != nil {
+		tb.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	return db
+}
+
+// populate stores n keys sharing the same key material under distinct
+// key IDs and identities.
+func populate(tb testing.TB, db *bunt, n int) {
+	e, err := openpgp.NewEntity("Template", "", "template@example.com", nil)
+	if err != nil {
+		tb.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := keyring.Serialize(buf, e); err != nil {
+		tb.Fatalf("unexpected error while serializing key: %s", err)
+	}
+
+	err = db.db.Update(func(tx *buntdb.Tx) error {
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("User %d", i)
+			uid := packet.NewUserId(name, "", fmt.Sprintf("user%d@example%d.com", i, i%10))
+			e.Identities = map[string]*openpgp.Identity{
+				uid.Id: {Name: uid.Id, UserId: uid},
+			}
+			if err := db.setEntity(tx, publicPrefixes, fmt.Sprintf("%016X", i), e, buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		tb.Fatalf("unexpected error while storing keys: %s", err)
+	}
+}
+
+// search returns the IDs of the keys matching the search with either
+// the n-gram index or a scan of the user IDs.
+func search(db *bunt, s string, indexed bool) ([]string, error) {
+	var keyIDs []string
+
+	err := db.db.View(func(tx *buntdb.Tx) error {
+		if indexed {
+			var err error
+			keyIDs, err = gramSearch(tx, publicPrefixes, s)
+			return err
+		}
+		found := make(map[string]bool)
+		err := scanSearch(tx, publicPrefixes, s, func(key string) {
+			keyID := strings.SplitN(strings.TrimPrefix(key, uidPrefix), keySep, 2)[0]
+			if !found[keyID] {
+				found[keyID] = true
+				keyIDs = append(keyIDs, keyID)
+			}
+		})
+		sort.Strings(keyIDs)
+		return err
+	})
+
+	return keyIDs, err
+}
+
+func TestGramSearch(t *testing.T) {
+	db := newDB(t)
+	defer db.Disconnect()
+
+	populate(t, db, 200)
+
+	for _, s := range []string{"user", "user1", "user12@", "ser 19", "example3.com", "r15@example5", "nobody", "%3@"} {
+		scanned, err := search(db, s, false)
+		if err != nil {
+			t.Fatalf("unexpected error while scanning for %s: %s", s, err)
+		}
+		indexed, err := search(db, s, true)
+		if err != nil {
+			t.Fatalf("unexpected error while searching for %s: %s", s, err)
+		}
+		if strings.Join(scanned, ",") != strings.Join(indexed, ",") {
+			t.Errorf("unexpected keys for %s: got %d keys instead of %d", s, len(indexed), len(scanned))
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	db := newDB(t)
+	defer db.Disconnect()
+
+	var el openpgp.EntityList
+
+	for _, name := range []string{"Alice", "Bob", "Bobby"} {
+		e, err := openpgp.NewEntity(name, "", fmt.Sprintf("%s@example.com", name), nil)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		el = append(el, e)
+	}
+	if err := db.Add(el); err != nil {
+		t.Fatalf("unexpected error while adding keys: %s", err)
+	}
+
+	tests := []struct {
+		search string
+		exact  bool
+		keys   int
+	}{
+		{"Bob@example.com", true, 1},
+		{"bob@EXAMPLE.com", true, 1},
+		{"bob", false, 2},
+		{"BOBBY@", false, 1},
+		{"b", false, 2},
+		{"", false, 3},
+		{"carol", false, 0},
+	}
+
+	for _, tt := range tests {
+		keys, err := db.Get(tt.search, database.SearchOptions{Exact: tt.exact})
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", tt.search, err)
+		} else if len(keys) != tt.keys {
+			t.Errorf("unexpected number of keys for %q: got %d instead of %d", tt.search, len(keys), tt.keys)
+		}
+	}
+
+	// pages follow the order of the matching keys
+	all, err := db.Get("", database.SearchOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error while getting keys: %s", err)
+	}
+	for i := range all {
+		keys, err := db.Get("", database.SearchOptions{Offset: i, Limit: 1})
+		if err != nil {
+			t.Fatalf("unexpected error while getting page %d: %s", i, err)
+		} else if len(keys) != 1 || keys[0].PrimaryKey.Fingerprint != all[i].PrimaryKey.Fingerprint {
+			t.Errorf("unexpected keys for page %d", i)
+		}
+	}
+	if keys, _ := db.Get("", database.SearchOptions{Offset: len(all)}); len(keys) != 0 {
+		t.Errorf("unexpected number of keys past the last page: got %d instead of 0", len(keys))
+	}
+
+	// n-grams are updated with the key identities
+	bob := el[1]
+	sig := *keyring.PrimaryIdentity(bob).SelfSignature
+	for name := range bob.Identities {
+		delete(bob.Identities, name)
+	}
+	uid := packet.NewUserId("Carol", "", "carol@example.com")
+	if err := sig.SignUserId(uid.Id, bob.PrimaryKey, bob.PrivateKey, nil); err != nil {
+		t.Fatalf("unexpected error while signing user ID: %s", err)
+	}
+	bob.Identities[uid.Id] = &openpgp.Identity{
+		Name:          uid.Id,
+		UserId:        uid,
+		SelfSignature: &sig,
+		Signatures:    []*packet.Signature{&sig},
+	}
+	if err := db.Add(openpgp.EntityList{bob}); err != nil {
+		t.Fatalf("unexpected error while updating key: %s", err)
+	}
+	if keys, _ := db.Get("bob", database.SearchOptions{}); len(keys) != 1 {
+		t.Errorf("unexpected number of keys after update: got %d instead of 1", len(keys))
+	}
+	if keys, _ := db.Get("carol", database.SearchOptions{}); len(keys) != 1 {
+		t.Errorf("unexpected number of keys after update: got %d instead of 1", len(keys))
+	}
+
+	if err := db.Del(el); err != nil {
+		t.Fatalf("unexpected error while deleting keys: %s", err)
+	}
+	err = db.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(gramPrefix+"*", func(key, val string) bool {
+			t.Errorf("n-gram record %s not deleted", key)
+			return true
+		})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error while listing n-grams: %s", err)
+	}
+}
+
+// records returns the keys of the records matching the pattern.
+func records(t *testing.T, db *bunt, pattern string) []string {
+	var keys []string
+
+	err := db.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(pattern, func(key, val string) bool {
+			keys = append(keys, key)
+			return true
+		})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error while listing records %s: %s", pattern, err)
+	}
+
+	return keys
+}
+
+// keyRecord returns the stored record of the key.
+func keyRecord(t *testing.T, db *bunt, keyID string) *entityRecord {
+	var er entityRecord
+
+	err := db.db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(keyPrefix + keyID)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(val), &er)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error while reading key record: %s", err)
+	}
+
+	return &er
+}
+
+// addIdentity adds a self-signed identity to the key.
+func addIdentity(t *testing.T, e *openpgp.Entity, name, email string, primary bool) {
+	sig := *keyring.PrimaryIdentity(e).SelfSignature
+	sig.IsPrimaryId = &primary
+	if primary {
+		// the previous primary identity is superseded
+		for _, id := range e.Identities {
+			notPrimary := false
+			id.SelfSignature.IsPrimaryId = &notPrimary
+		}
+	}
+
+	uid := packet.NewUserId(name, "", email)
+	if err := sig.SignUserId(uid.Id, e.PrimaryKey, e.PrivateKey, nil); err != nil {
+		t.Fatalf("unexpected error while signing user ID: %s", err)
+	}
+	e.Identities[uid.Id] = &openpgp.Identity{
+		Name:          uid.Id,
+		UserId:        uid,
+		SelfSignature: &sig,
+		Signatures:    []*packet.Signature{&sig},
+	}
+}
+
+func TestIdentities(t *testing.T) {
+	db := newDB(t)
+	defer db.Disconnect()
+
+	e, err := openpgp.NewEntity("Dave", "", "dave@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	addIdentity(t, e, "David", "david@example.org", false)
+	addIdentity(t, e, "Dave Work", "dave@work.example.com", true)
+
+	if err := db.Add(openpgp.EntityList{e}); err != nil {
+		t.Fatalf("unexpected error while adding key: %s", err)
+	}
+
+	tests := []struct {
+		search string
+		exact  bool
+		keys   int
+	}{
+		{"dave@example.com", true, 1},
+		{"David@Example.org", true, 1},
+		{"dave work", true, 1},
+		{"david@", false, 1},
+		{"work.example", false, 1},
+	}
+
+	for _, tt := range tests {
+		keys, err := db.Get(tt.search, database.SearchOptions{Exact: tt.exact})
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", tt.search, err)
+		} else if len(keys) != tt.keys {
+			t.Errorf("unexpected number of keys for %q: got %d instead of %d", tt.search, len(keys), tt.keys)
+		}
+	}
+
+	// the primary user ID is recorded first and flagged
+	keyID := e.PrimaryKey.KeyIdString()
+	er := keyRecord(t, db, keyID)
+	if len(er.Identities) != 3 {
+		t.Fatalf("unexpected number of identities: got %d instead of 3", len(er.Identities))
+	}
+	for i, ir := range er.Identities {
+		if primary := i == 0; ir.Primary != primary {
+			t.Errorf("unexpected primary flag for %s: got %v instead of %v", ir.Email, ir.Primary, primary)
+		}
+	}
+	if er.Identities[0].Email != "dave@work.example.com" {
+		t.Errorf("unexpected primary identity %s", er.Identities[0].Email)
+	}
+	if uids := records(t, db, uidPrefix+keyID+keySep+"*"); len(uids) != 3 {
+		t.Errorf("unexpected number of user ID records: got %d instead of 3", len(uids))
+	}
+
+	// user ID records of removed identities are deleted on update
+	for name, id := range e.Identities {
+		if id.UserId.Email == "david@example.org" {
+			delete(e.Identities, name)
+		}
+	}
+	if err := db.Add(openpgp.EntityList{e}); err != nil {
+		t.Fatalf("unexpected error while updating key: %s", err)
+	}
+	if uids := records(t, db, uidPrefix+keyID+keySep+"*"); len(uids) != 2 {
+		t.Errorf("unexpected number of user ID records after update: got %d instead of 2", len(uids))
+	}
+	if keys, _ := db.Get("david@example.org", database.SearchOptions{Exact: true}); len(keys) != 0 {
+		t.Errorf("removed identity still found after update")
+	}
+
+	if err := db.Del(openpgp.EntityList{e}); err != nil {
+		t.Fatalf("unexpected error while deleting key: %s", err)
+	}
+	if uids := records(t, db, uidPrefix+"*"); len(uids) != 0 {
+		t.Errorf("user ID records not deleted: %v", uids)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := newDB(t)
+	defer db.Disconnect()
+
+	e, err := openpgp.NewEntity("Erin", "", "erin@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := keyring.Serialize(buf, e); err != nil {
+		t.Fatalf("unexpected error while serializing key: %s", err)
+	}
+
+	// records were first stored with the primary identity only
+	// and without user ID, n-gram and subkey records
+	old, err := json.Marshal(&struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+		Key   []byte `json:"key"`
+	}{"erin", "erin@example.com", buf.Bytes()})
+	if err != nil {
+		t.Fatalf("unexpected error while encoding record: %s", err)
+	}
+	keyID := e.PrimaryKey.KeyIdString()
+	err = db.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(keyPrefix+keyID, string(old), nil)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error while storing record: %s", err)
+	}
+
+	if err := db.migrate(); err != nil {
+		t.Fatalf("unexpected error while migrating records: %s", err)
+	}
+
+	for _, search := range []string{"erin@example.com", "Erin"} {
+		keys, err := db.Get(search, database.SearchOptions{Exact: true})
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", search, err)
+		} else if len(keys) != 1 || keys[0].PrimaryKey.Fingerprint != e.PrimaryKey.Fingerprint {
+			t.Errorf("migrated key not found for %q", search)
+		}
+	}
+	if keys, _ := db.Get("rin@exa", database.SearchOptions{}); len(keys) != 1 {
+		t.Errorf("migrated key not found by substring")
+	}
+	subkeyID := e.Subkeys[0].PublicKey.KeyIdString()
+	if keys, _ := db.Get(subkeyID, database.SearchOptions{Fingerprint: true, Exact: true}); len(keys) != 1 {
+		t.Errorf("migrated key not found by subkey ID")
+	}
+
+	// migrated records are at the current version
+	er := keyRecord(t, db, keyID)
+	if er.Version != recordVersion {
+		t.Errorf("unexpected record version: got %d instead of %d", er.Version, recordVersion)
+	} else if len(er.Identities) != 1 || !er.Identities[0].Primary {
+		t.Errorf("unexpected migrated identities: %v", er.Identities)
+	}
+}
+
+func TestSubkeys(t *testing.T) {
+	db := newDB(t)
+	defer db.Disconnect()
+
+	var el openpgp.EntityList
+
+	for _, name := range []string{"Frank", "Grace"} {
+		e, err := openpgp.NewEntity(name, "", fmt.Sprintf("%s@example.com", name), nil)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		el = append(el, e)
+	}
+	e, other := el[0], el[1]
+	otherSubkey := other.Subkeys[0]
+
+	// the other key subkey is also bound to the key
+	sig := *e.Subkeys[0].Sig
+	if err := sig.SignKey(otherSubkey.PublicKey, e.PrivateKey, nil); err != nil {
+		t.Fatalf("unexpected error while binding subkey: %s", err)
+	}
+	e.Subkeys = append(e.Subkeys, openpgp.Subkey{PublicKey: otherSubkey.PublicKey, Sig: &sig})
+	subkey := e.Subkeys[0]
+	for _, e := range el {
+		e.PrivateKey = nil
+	}
+
+	if err := db.Add(el); err != nil {
+		t.Fatalf("unexpected error while adding keys: %s", err)
+	}
+
+	fp := func(fp [20]byte) string {
+		return fmt.Sprintf("%X", fp[:])
+	}
+	// a fingerprint sharing the key ID of the subkey
+	sameID := subkey.PublicKey.Fingerprint
+	sameID[0] ^= 0xff
+
+	tests := []struct {
+		name   string
+		search string
+		exact  bool
+		keys   int
+	}{
+		{"primary fingerprint", fp(e.PrimaryKey.Fingerprint), true, 1},
+		{"subkey ID", subkey.PublicKey.KeyIdString(), true, 1},
+		{"subkey short ID", subkey.PublicKey.KeyIdShortString(), false, 1},
+		{"subkey fingerprint", fp(subkey.PublicKey.Fingerprint), true, 1},
+		{"other fingerprint with subkey ID", fp(sameID), true, 0},
+		{"shared subkey ID", otherSubkey.PublicKey.KeyIdString(), true, 2},
+		{"shared subkey fingerprint", fp(otherSubkey.PublicKey.Fingerprint), true, 2},
+	}
+
+	for _, tt := range tests {
+		keys, err := db.Get(tt.search, database.SearchOptions{Fingerprint: true, Exact: tt.exact})
+		if err != nil {
+			t.Errorf("unexpected error for %s: %s", tt.name, err)
+		} else if len(keys) != tt.keys {
+			t.Errorf("unexpected number of keys for %s: got %d instead of %d", tt.name, len(keys), tt.keys)
+		}
+	}
+
+	keyID := e.PrimaryKey.KeyIdString()
+	if subkeys := records(t, db, subkeyPrefix+"*"+keySep+keyID); len(subkeys) != 2 {
+		t.Errorf("unexpected number of subkey records: got %d instead of 2", len(subkeys))
+	}
+
+	// subkey records of removed subkeys are deleted on update
+	e.Subkeys = e.Subkeys[1:]
+	if err := db.Add(openpgp.EntityList{e}); err != nil {
+		t.Fatalf("unexpected error while updating key: %s", err)
+	}
+	if subkeys := records(t, db, subkeyPrefix+"*"+keySep+keyID); len(subkeys) != 1 {
+		t.Errorf("unexpected number of subkey records after update: got %d instead of 1", len(subkeys))
+	}
+	if keys, _ := db.Get(subkey.PublicKey.KeyIdString(), database.SearchOptions{Fingerprint: true, Exact: true}); len(keys) != 0 {
+		t.Errorf("removed subkey still found after update")
+	}
+
+	if err := db.Del(openpgp.EntityList{e}); err != nil {
+		t.Fatalf("unexpected error while deleting key: %s", err)
+	}
+	if subkeys := records(t, db, subkeyPrefix+"*"+keySep+keyID); len(subkeys) != 0 {
+		t.Errorf("subkey records not deleted: %v", subkeys)
+	}
+	// the other key keeps its subkey
+	if keys, _ := db.Get(fp(otherSubkey.PublicKey.Fingerprint), database.SearchOptions{Fingerprint: true, Exact: true}); len(keys) != 1 {
+		t.Errorf("unexpected number of keys for subkey of remaining key: got %d instead of 1", len(keys))
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		db := newDB(b)
+		populate(b, db, n)
+
+		for _, s := range []string{"user1234@", "example3"} {
+			for _, indexed := range []bool{false, true} {
+				impl := "scan"
+				if indexed {
+					impl = "index"
+				}
+				b.Run(fmt.Sprintf("%s/%d/%s", impl, n, s), func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						if _, err := search(db, s, indexed); err != nil {
+							b.Fatalf("unexpected error while searching: %s", err)
+						}
+					}
+				})
+			}
+		}
+
+		b.Run(fmt.Sprintf("get/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get("user1234@", database.SearchOptions{}); err != nil {
+					b.Fatalf("unexpected error while searching: %s", err)
+				}
+			}
+		})
+
+		db.Disconnect()
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spks-defaultdb-")
+	if err != nil {
+		t.Fatalf("unexpected error while creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := &bunt{cfg: Config{Dir: dir}}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	if db.Volatile() {
+		t.Errorf("unexpected volatile database")
+	}
+
+	// a second connection is rejected until the first one is closed
+	other := &bunt{cfg: Config{Dir: dir}}
+	if err := other.Connect(); err == nil {
+		other.Disconnect()
+		t.Fatalf("unexpected success while connecting to locked database")
+	}
+	if err := db.Disconnect(); err != nil {
+		t.Fatalf("unexpected error while disconnecting from database: %s", err)
+	}
+	if err := other.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to unlocked database: %s", err)
+	}
+	other.Disconnect()
+
+	if !new(bunt).Volatile() {
+		t.Errorf("in-memory database not reported as volatile")
+	}
+}
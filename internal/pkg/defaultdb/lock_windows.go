@@ -0,0 +1,14 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package defaultdb
+
+import (
+	"os"
+)
+
+// lockFile opens the file at path, Windows already prevents the
+// database file from being replaced while it's open.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
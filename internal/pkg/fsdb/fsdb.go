@@ -0,0 +1,429 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fsdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	Name = "fs"
+)
+
+const (
+	// KeyExt is the extension of the armored key files served
+	// from the directory tree.
+	KeyExt = ".asc"
+	// DefaultReloadInterval is the default interval between checks
+	// of the directory tree for changes.
+	DefaultReloadInterval = time.Minute
+)
+
+const (
+	databaseDirEnv            = "SPKS_DBCONFIG_DIR"
+	databaseReloadIntervalEnv = "SPKS_DBCONFIG_RELOAD_INTERVAL"
+)
+
+type Config struct {
+	// Dir is the directory tree holding the armored key files.
+	Dir string `yaml:"dir"`
+	// ReloadInterval is the interval between checks of the directory
+	// tree for changes, a negative interval disables reloading.
+	ReloadInterval time.Duration `yaml:"reload-interval"`
+}
+
+// record is an index entry of a key read from the directory tree,
+// subkeys are indexed by fingerprint, names and emails are normalized.
+type record struct {
+	fingerprint string
+	keyID       string
+	subkeys     []string
+	names       []string
+	emails      []string
+	data        []byte
+}
+
+// fileStamp identifies a version of a key file.
+type fileStamp struct {
+	size    int64
+	modTime int64
+}
+
+// fsDB is a read-only database engine serving the keys of a directory
+// tree of armored files from an in-memory index, the index is rebuilt
+// when the files change.
+type fsDB struct {
+	cfg     Config
+	folding database.LocalPartFolding
+
+	mutex   sync.RWMutex
+	records []*record
+	files   map[string]fileStamp
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (d *fsDB) NewConfig() database.Config {
+	return &d.cfg
+}
+
+func (d *fsDB) CheckConfig() error {
+	if env := os.Getenv(databaseDirEnv); env != "" {
+		d.cfg.Dir = env
+	}
+	if env := os.Getenv(databaseReloadIntervalEnv); env != "" {
+		i, err := time.ParseDuration(env)
+		if err != nil {
+			return fmt.Errorf("while parsing %s: %s", databaseReloadIntervalEnv, err)
+		}
+		d.cfg.ReloadInterval = i
+	}
+	if d.cfg.Dir == "" {
+		return fmt.Errorf("fs database requires a key directory")
+	}
+	if fi, err := os.Stat(d.cfg.Dir); err != nil {
+		return fmt.Errorf("could not use key directory %s: %s", d.cfg.Dir, err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("could not use key directory %s: not a directory", d.cfg.Dir)
+	}
+	return nil
+}
+
+// SetLocalPartFolding sets the folding used to normalize identities.
+func (d *fsDB) SetLocalPartFolding(f database.LocalPartFolding) {
+	d.folding = f
+}
+
+func (d *fsDB) Connect() error {
+	if err := d.reload(); err != nil {
+		return err
+	}
+
+	interval := d.cfg.ReloadInterval
+	if interval == 0 {
+		interval = DefaultReloadInterval
+	} else if interval < 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.done = make(chan struct{})
+
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// keep serving the previous keys until the
+				// directory tree is fixed
+				if err := d.reload(); err != nil {
+					logrus.WithError(err).Error("Failed to reload key directory")
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (d *fsDB) Disconnect() error {
+	if d.cancel != nil {
+		d.cancel()
+		<-d.done
+		d.cancel = nil
+	}
+	return nil
+}
+
+func (d *fsDB) ReadOnly() bool {
+	return true
+}
+
+func (d *fsDB) Add(el openpgp.EntityList) error {
+	return database.ErrReadOnly
+}
+
+func (d *fsDB) Del(el openpgp.EntityList) error {
+	return database.ErrReadOnly
+}
+
+func (d *fsDB) Get(search string, opts database.SearchOptions) (openpgp.EntityList, error) {
+	// the directory tree only holds public keys, the server
+	// runs without signing key
+	if opts.KeyType == database.SigningKey {
+		return nil, nil
+	}
+
+	var match func(r *record) bool
+
+	// identities are indexed normalized
+	if !opts.Fingerprint {
+		search = d.folding.Normalize(search)
+	}
+
+	if opts.Fingerprint {
+		// fingerprint search
+		fp, err := hex.DecodeString(search)
+		if err != nil {
+			return nil, err
+		}
+		id := fmt.Sprintf("%X", fp)
+
+		switch len(fp) {
+		case 4, 8:
+			match = func(r *record) bool {
+				if strings.HasSuffix(r.keyID, id) {
+					return true
+				}
+				for _, fp := range r.subkeys {
+					if strings.HasSuffix(fp, id) {
+						return true
+					}
+				}
+				return false
+			}
+		case 20:
+			match = func(r *record) bool {
+				return r.fingerprint == id || contains(r.subkeys, id)
+			}
+		default:
+			return nil, fmt.Errorf("fingerprint must be either 4, 8 or 20 bytes length")
+		}
+	} else if opts.Exact {
+		// first search for email then for name
+		match = func(r *record) bool {
+			return contains(r.emails, search)
+		}
+		if d.count(match) == 0 {
+			match = func(r *record) bool {
+				return contains(r.names, search)
+			}
+		}
+	} else {
+		// text search
+		match = func(r *record) bool {
+			for i := range r.names {
+				if strings.Contains(r.names[i], search) || strings.Contains(r.emails[i], search) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	return d.find(match, opts)
+}
+
+// count returns the number of indexed keys for which match returns true.
+func (d *fsDB) count(match func(r *record) bool) int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	n := 0
+	for _, r := range d.records {
+		if match(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// find returns the indexed keys for which match returns true within the
+// bounds of the search options, keys are parsed from the index on each
+// call so callers are free to modify them.
+func (d *fsDB) find(match func(r *record) bool, opts database.SearchOptions) (openpgp.EntityList, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	var el openpgp.EntityList
+
+	skip := opts.Offset
+	for _, r := range d.records {
+		if opts.Limit > 0 && len(el) == opts.Limit {
+			break
+		} else if !match(r) {
+			continue
+		} else if skip > 0 {
+			skip--
+			continue
+		}
+		e, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(r.data)))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		el = append(el, e)
+	}
+
+	return el, nil
+}
+
+// reload rebuilds the index if the key files changed since the last
+// reload.
+func (d *fsDB) reload() error {
+	files, err := scan(d.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("while scanning key directory %s: %s", d.cfg.Dir, err)
+	}
+
+	d.mutex.RLock()
+	unchanged := d.records != nil && reflect.DeepEqual(files, d.files)
+	d.mutex.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	records, err := load(files, d.folding)
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	d.records = records
+	d.files = files
+	d.mutex.Unlock()
+
+	logrus.WithField("keys", len(records)).Info("Key directory loaded")
+
+	return nil
+}
+
+// scan returns the armored key files of the directory tree.
+func scan(dir string) (map[string]fileStamp, error) {
+	files := make(map[string]fileStamp)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && filepath.Ext(path) == KeyExt {
+			files[path] = fileStamp{
+				size:    info.Size(),
+				modTime: info.ModTime().UnixNano(),
+			}
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+// load reads the key files and returns the index records sorted by
+// fingerprint, keys found in several files are merged. Identities are
+// normalized with the local part folding.
+func load(files map[string]fileStamp, folding database.LocalPartFolding) ([]*record, error) {
+	keys := make(map[string]*openpgp.Entity)
+
+	for path := range files {
+		el, err := readKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("while reading %s: %s", path, err)
+		}
+		for _, e := range el {
+			if e.PrivateKey != nil {
+				return nil, fmt.Errorf("while reading %s: key %X contains a private key", path, e.PrimaryKey.Fingerprint[:])
+			}
+			fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+			if prev, ok := keys[fp]; ok {
+				if err := keyring.Merge(e, prev); err != nil {
+					return nil, fmt.Errorf("while merging key %s: %s", fp, err)
+				}
+			}
+			keys[fp] = e
+		}
+	}
+
+	records := make([]*record, 0, len(keys))
+
+	for fp, e := range keys {
+		buf := new(bytes.Buffer)
+		if err := keyring.Serialize(buf, e); err != nil {
+			return nil, fmt.Errorf("while serializing key %s: %s", fp, err)
+		}
+		r := &record{
+			fingerprint: fp,
+			keyID:       fp[24:],
+			data:        buf.Bytes(),
+		}
+		for _, subkey := range e.Subkeys {
+			r.subkeys = append(r.subkeys, fmt.Sprintf("%X", subkey.PublicKey.Fingerprint[:]))
+		}
+		for _, id := range e.Identities {
+			r.names = append(r.names, folding.Normalize(id.UserId.Name))
+			r.emails = append(r.emails, folding.Normalize(id.UserId.Email))
+		}
+		records = append(records, r)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].fingerprint < records[j].fingerprint
+	})
+
+	return records, nil
+}
+
+// readKeyFile reads the armored public keys of the file, the identity
+// signatures the OpenPGP library can't parse like GnuPG trust signatures
+// are dropped.
+func readKeyFile(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	block, err := armor.Decode(f)
+	if err != nil {
+		return nil, err
+	} else if block.Type != openpgp.PublicKeyType {
+		return nil, fmt.Errorf("unexpected armor block type %s", block.Type)
+	}
+
+	b, _, err := keyring.SplitOpaqueSignatures(block.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return openpgp.ReadKeyRing(bytes.NewReader(b))
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	db := new(fsDB)
+	database.RegisterDatabaseEngine(Name, db)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fsdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+)
+
+func writeKey(t *testing.T, path string, el openpgp.EntityList) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unexpected error while creating key file: %s", err)
+	}
+	defer f.Close()
+
+	if err := keyring.WriteArmoredKeyRing(f, el); err != nil {
+		t.Fatalf("unexpected error while writing key file: %s", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spks-fsdb-")
+	if err != nil {
+		t.Fatalf("unexpected error while creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("unexpected error while creating directory: %s", err)
+	}
+
+	var el openpgp.EntityList
+
+	for _, name := range []string{"Alice", "Bob", "Bob_"} {
+		e, err := openpgp.NewEntity(name, "", fmt.Sprintf("%s@example.com", name), nil)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		el = append(el, e)
+	}
+
+	fp := func(e *openpgp.Entity) string {
+		return fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+	}
+	subkeyFp := func(e *openpgp.Entity) string {
+		return fmt.Sprintf("%X", e.Subkeys[0].PublicKey.Fingerprint[:])
+	}
+
+	writeKey(t, filepath.Join(dir, fp(el[0])+KeyExt), el[:1])
+	writeKey(t, filepath.Join(dir, "sub", fp(el[1])+KeyExt), el[1:2])
+	// ignored files
+	writeKey(t, filepath.Join(dir, fp(el[2])+".txt"), el[2:3])
+
+	db := &fsDB{cfg: Config{Dir: dir, ReloadInterval: -1}}
+	if err := db.CheckConfig(); err != nil {
+		t.Fatalf("unexpected error while checking configuration: %s", err)
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	var _ database.ReadOnly = db
+
+	tests := []struct {
+		name          string
+		search        string
+		isFingerprint bool
+		exact         bool
+		kt            database.KeyType
+		keys          []*openpgp.Entity
+		wantErr       bool
+	}{
+		{"fingerprint", fp(el[1]), true, true, database.PublicKey, el[1:2], false},
+		{"key id", fp(el[1])[24:], true, true, database.PublicKey, el[1:2], false},
+		{"short key id", fp(el[1])[32:], true, false, database.PublicKey, el[1:2], false},
+		{"subkey fingerprint", subkeyFp(el[1]), true, true, database.PublicKey, el[1:2], false},
+		{"subkey id", subkeyFp(el[1])[24:], true, true, database.PublicKey, el[1:2], false},
+		{"short subkey id", subkeyFp(el[1])[32:], true, false, database.PublicKey, el[1:2], false},
+		{"unknown fingerprint", "0123456789ABCDEF", true, true, database.PublicKey, nil, false},
+		{"invalid fingerprint", "0123", true, true, database.PublicKey, nil, true},
+		{"exact email", "Bob@example.com", false, true, database.PublicKey, el[1:2], false},
+		{"case insensitive email", "BOB@Example.COM", false, true, database.PublicKey, el[1:2], false},
+		{"case insensitive substring", "ALICE", false, false, database.PublicKey, el[:1], false},
+		{"exact name", "Alice", false, true, database.PublicKey, el[:1], false},
+		{"substring", "example", false, false, database.PublicKey, el[:2], false},
+		{"ignored file", "Bob_", false, false, database.PublicKey, nil, false},
+		{"signing keys", "", true, false, database.SigningKey, nil, false},
+	}
+
+	for _, tt := range tests {
+		keys, err := db.Get(tt.search, database.SearchOptions{Fingerprint: tt.isFingerprint, Exact: tt.exact, KeyType: tt.kt})
+		if err != nil && !tt.wantErr {
+			t.Errorf("unexpected error for %s: %s", tt.name, err)
+			continue
+		} else if err == nil && tt.wantErr {
+			t.Errorf("unexpected success for %s", tt.name)
+			continue
+		}
+
+		found := make(map[string]bool)
+		for _, e := range keys {
+			found[fp(e)] = true
+		}
+		if len(found) != len(tt.keys) {
+			t.Errorf("unexpected number of keys for %s: got %d instead of %d", tt.name, len(found), len(tt.keys))
+			continue
+		}
+		for _, e := range tt.keys {
+			if !found[fp(e)] {
+				t.Errorf("key %s not returned for %s", fp(e), tt.name)
+			}
+		}
+	}
+
+	// pages follow the order of the matching keys
+	all, err := db.Get("", database.SearchOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error while getting keys: %s", err)
+	}
+	for i := range all {
+		keys, err := db.Get("", database.SearchOptions{Offset: i, Limit: 1})
+		if err != nil {
+			t.Fatalf("unexpected error while getting page %d: %s", i, err)
+		} else if len(keys) != 1 || fp(keys[0]) != fp(all[i]) {
+			t.Errorf("unexpected keys for page %d", i)
+		}
+	}
+	if keys, _ := db.Get("", database.SearchOptions{Offset: len(all)}); len(keys) != 0 {
+		t.Errorf("unexpected number of keys past the last page: got %d instead of 0", len(keys))
+	}
+
+	if err := db.Add(el); err != database.ErrReadOnly {
+		t.Errorf("unexpected error while adding keys: %v", err)
+	}
+	if err := db.Del(el); err != database.ErrReadOnly {
+		t.Errorf("unexpected error while deleting keys: %v", err)
+	}
+
+	// returned keys are copies of the indexed keys
+	keys, _ := db.Get(fp(el[0]), database.SearchOptions{Fingerprint: true, Exact: true})
+	if len(keys) != 1 {
+		t.Fatalf("unexpected number of keys: got %d instead of 1", len(keys))
+	}
+	keys[0].Identities = nil
+	if keys, _ := db.Get("Alice", database.SearchOptions{Exact: true}); len(keys) != 1 {
+		t.Errorf("indexed key modified")
+	}
+
+	// changes are picked up on reload
+	if err := os.Remove(filepath.Join(dir, fp(el[0])+KeyExt)); err != nil {
+		t.Fatalf("unexpected error while removing key file: %s", err)
+	}
+	writeKey(t, filepath.Join(dir, fp(el[2])+KeyExt), el[2:3])
+	if err := db.reload(); err != nil {
+		t.Fatalf("unexpected error while reloading directory: %s", err)
+	}
+	keys, _ = db.Get("", database.SearchOptions{})
+	if len(keys) != 2 || fp(keys[0]) == fp(el[0]) || fp(keys[1]) == fp(el[0]) {
+		t.Errorf("unexpected keys after reload")
+	}
+
+	// broken files keep the previous keys served
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken"+KeyExt), []byte("broken"), 0644); err != nil {
+		t.Fatalf("unexpected error while writing key file: %s", err)
+	}
+	if err := db.reload(); err == nil {
+		t.Errorf("unexpected success while reloading broken directory")
+	}
+	if keys, _ := db.Get("", database.SearchOptions{}); len(keys) != 2 {
+		t.Errorf("unexpected number of keys after failed reload: got %d instead of 2", len(keys))
+	}
+}
@@ -17,6 +17,10 @@ var DefaultConfig Config = Config{
 	SMTPPort:        25,
 	Subject:         DefaultSubject,
 	MessageTemplate: DefaultTemplate,
+	DeleteSubject:   DefaultDeleteSubject,
+	DeleteTemplate:  DefaultDeleteTemplate,
+	RenewSubject:    DefaultRenewSubject,
+	RenewTemplate:   DefaultRenewTemplate,
 }
 
 const (
@@ -35,31 +39,54 @@ type Config struct {
 	SMTPPassword    string `yaml:"smtp-password"`
 	Subject         string `yaml:"subject"`
 	MessageTemplate string `yaml:"message"`
+	DeleteSubject   string `yaml:"delete-subject"`
+	DeleteTemplate  string `yaml:"delete-message"`
+	RenewSubject    string `yaml:"renew-subject"`
+	RenewTemplate   string `yaml:"renew-message"`
 }
 
 type TemplateArgs struct {
-	Name          string
-	PublicURL     string
+	Name      string
+	PublicURL string
+	// PublicAuthURL is the public URL embedding the verification
+	// token as basic auth credentials, it allows to validate the
+	// key by pushing it again.
 	PublicAuthURL string
-	Fingerprint   string
+	// VerifyURL is the link validating the key once opened.
+	VerifyURL string
+	// DeleteURL is the link removing the key once opened.
+	DeleteURL string
+	// RenewURL is the link renewing the server certification of
+	// the key once opened.
+	RenewURL string
+	// Expiration is the expiration date of the verification link.
+	Expiration  string
+	Fingerprint string
+	// Challenge is the armored PGP message containing the challenge
+	// encrypted to the submitted key, the decrypted challenge must be
+	// entered when confirming the submission. Empty if challenges are
+	// disabled.
+	Challenge string
 }
 
 var DefaultSubject = "Public key validation"
 
 var DefaultTemplate = `Hello {{.Name}},
 
-You've just submitted a public key on {{.PublicURL}}, this requires you to validate
-that the key was pushed by you, so in order to finalize the validation process you
-need to enter one of the following command from the same machine you originally pushed
-the key:
+You've just submitted the public key {{.Fingerprint}} on {{.PublicURL}}, this requires
+you to validate that the key was pushed by you. In order to finalize the validation
+process, please open the following link in your browser and confirm the submission:
 
-- if you pushed it with Singularity please enter the following command in your terminal:
+{{.VerifyURL}}
+{{- if .Challenge}}
 
-singularity key push -u {{.PublicAuthURL}} {{.Fingerprint}}
+To prove that you own the private key, you will be asked for the challenge
+contained in the message below, it can be decrypted with "gpg --decrypt":
 
-- if you pushed it with gpg tool, please enter the following command in your terminal:
+{{.Challenge}}
+{{- end}}
 
-curl --data-urlencode "keytext=$(gpg --armor --export {{.Fingerprint}})" {{.PublicAuthURL}}/pks/add
+This link expires on {{.Expiration}}.
 
 ---------------------
 This message was sent from the public key server {{.PublicURL}}.
@@ -67,6 +94,40 @@ This message was sent from the public key server {{.PublicURL}}.
 Please ignore this message if you didn't submit this key or report any abuse by responding to this message.
 `
 
+var DefaultDeleteSubject = "Public key deletion"
+
+var DefaultDeleteTemplate = `Hello {{.Name}},
+
+A deletion of the public key {{.Fingerprint}} has been requested on {{.PublicURL}}.
+In order to remove the key from the server, please open the following link in
+your browser and confirm the deletion:
+
+{{.DeleteURL}}
+
+This link expires on {{.Expiration}}.
+
+---------------------
+This message was sent from the public key server {{.PublicURL}}.
+
+Please ignore this message if you didn't request the deletion of this key, the key stays published.
+`
+
+var DefaultRenewSubject = "Public key certification renewal"
+
+var DefaultRenewTemplate = `Hello {{.Name}},
+
+The certification of your public key {{.Fingerprint}} by {{.PublicURL}} expires
+on {{.Expiration}}. In order to keep your key certified, please open the following
+link in your browser and confirm that you still own this email address:
+
+{{.RenewURL}}
+
+Without confirmation, the key stays published but is no longer certified by the server.
+
+---------------------
+This message was sent from the public key server {{.PublicURL}}.
+`
+
 func CheckConfig(cfg *Config) error {
 	env := os.Getenv(mailSMTPServerEnv)
 	if env != "" {
@@ -0,0 +1,70 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mailverifier
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ctrliq/spks/pkg/pending"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const challengeSize = 16
+
+// newChallenge returns a random challenge along with the armored
+// message containing the challenge encrypted to the key, only the
+// owner of the private key is then able to answer the challenge.
+func newChallenge(e *openpgp.Entity) (string, string, error) {
+	b := make([]byte, challengeSize)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", "", fmt.Errorf("while generating challenge: %s", err)
+	}
+	challenge := hex.EncodeToString(b)
+
+	s := new(strings.Builder)
+
+	aw, err := armor.Encode(s, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", "", err
+	}
+	pw, err := openpgp.Encrypt(aw, openpgp.EntityList{e}, nil, nil, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("while encrypting challenge: %s", err)
+	}
+	if _, err := io.WriteString(pw, challenge); err != nil {
+		return "", "", err
+	}
+	if err := pw.Close(); err != nil {
+		return "", "", err
+	}
+	if err := aw.Close(); err != nil {
+		return "", "", err
+	}
+
+	return challenge, s.String(), nil
+}
+
+// challengeDigest returns the digest of the challenge stored with
+// the pending submission, the challenge itself is never stored.
+func challengeDigest(challenge string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(challenge))))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkChallenge returns whether the response matches the challenge
+// of the submission, submissions without challenge always match.
+func checkChallenge(sub *pending.Submission, response string) bool {
+	if sub.Challenge == "" {
+		return true
+	}
+	digest := challengeDigest(response)
+	return subtle.ConstantTimeCompare([]byte(digest), []byte(sub.Challenge)) == 1
+}
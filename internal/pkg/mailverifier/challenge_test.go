@@ -0,0 +1,120 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mailverifier
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/pending"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func decryptChallenge(t *testing.T, e *openpgp.Entity, msg string) string {
+	block, err := armor.Decode(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("unexpected error while decoding challenge: %s", err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{e}, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error while decrypting challenge: %s", err)
+	}
+	b, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("unexpected error while reading challenge: %s", err)
+	}
+	return string(b)
+}
+
+func TestChallenge(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	signingKey, err := openpgp.NewEntity("Admin", "Signing Key", "admin@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	e, err := openpgp.NewEntity("Test", "No comment", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+
+	cfg := config.DefaultServerConfig
+	cfg.MailIdentityChallenge = true
+	m := New(&cfg, signingKey)
+	if err := m.Init(db, http.NewServeMux()); err != nil {
+		t.Fatalf("unexpected error while initializing verifier: %s", err)
+	}
+
+	challenge, msg, err := newChallenge(e)
+	if err != nil {
+		t.Fatalf("unexpected error while generating challenge: %s", err)
+	}
+	if decrypted := decryptChallenge(t, e, msg); decrypted != challenge {
+		t.Fatalf("unexpected decrypted challenge: got %q instead of %q", decrypted, challenge)
+	}
+
+	token, err := m.generateToken(verifyToken, e, "test@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+	sub, err := pending.NewSubmission(token, e, "test@example.com", "127.0.0.1", cfg.VerificationTokenTTL)
+	if err != nil {
+		t.Fatalf("unexpected error while creating submission: %s", err)
+	}
+	sub.Challenge = challengeDigest(challenge)
+	if err := m.pending.Add(sub); err != nil {
+		t.Fatalf("unexpected error while adding pending key: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		code     int
+	}{
+		{
+			name:     "missing response",
+			response: "",
+			code:     http.StatusForbidden,
+		},
+		{
+			name:     "wrong response",
+			response: "0123456789abcdef",
+			code:     http.StatusForbidden,
+		},
+		{
+			name:     "valid response",
+			response: " " + strings.ToUpper(challenge) + "\n",
+			code:     http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		form := url.Values{"token": {token}, "challenge": {tt.response}}.Encode()
+
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://localhost"+VerifyRoute, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		m.verify(resp, req)
+
+		if resp.Code != tt.code {
+			t.Errorf("unexpected http status returned for %q: got %d instead of %d", tt.name, resp.Code, tt.code)
+		}
+	}
+}
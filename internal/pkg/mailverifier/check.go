@@ -11,6 +11,8 @@ import (
 
 	"github.com/ctrliq/spks/pkg/database"
 	"github.com/ctrliq/spks/pkg/hkpserver"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/ctrliq/spks/pkg/pending"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/openpgp"
 )
@@ -33,28 +35,62 @@ func (m *MailVerifier) checkRevocation(e *openpgp.Entity, dbe *openpgp.Entity, r
 	return nil
 }
 
-// checkSingleIdentity checks that key has only one identity.
+// checkSingleIdentity checks that key has only one identity. When
+// multiple identities are allowed, only the primary identity is verified
+// so the other identities can't claim an address within the mail
+// identity domains.
 func (m *MailVerifier) checkSingleIdentity(e *openpgp.Entity, dbe *openpgp.Entity, r *http.Request) hkpserver.Status {
-	if len(e.Identities) != 1 {
+	if len(e.Identities) == 0 {
+		logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).Info("Key rejected, no identity")
+		return hkpserver.NewBadRequestStatus("Key rejected, no identity")
+	} else if len(e.Identities) == 1 {
+		return nil
+	} else if !m.config.MailIdentityMultiple {
 		logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).Info("Key rejected, more than one identity")
 		return hkpserver.NewBadRequestStatus("Key rejected, more than one identity")
 	}
+
+	primary := keyring.PrimaryIdentity(e)
+	for _, id := range e.Identities {
+		if id == primary {
+			continue
+		}
+		email, err := mail.ParseAddress(id.UserId.Email)
+		if err != nil {
+			continue
+		}
+		if m.inDomains(m.config.MailLocalPartFolding.Normalize(email.Address)) {
+			logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).Info("Key rejected, secondary identity within mail identity domains")
+			return hkpserver.NewBadRequestStatus(fmt.Sprintf("Key rejected, %q isn't the primary identity", id.Name))
+		}
+	}
 	return nil
 }
 
-// checkEmail checks that key has an identity with a valid email
+// inDomains returns whether the normalized address belongs to one of
+// the mail identity domains.
+func (m *MailVerifier) inDomains(address string) bool {
+	for _, domain := range m.config.MailIdentityDomains {
+		if strings.HasSuffix(address, m.config.MailLocalPartFolding.Normalize(domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEmail checks that the key primary identity has a valid email
 // address and that the domain is allowed. Also ensures there is
-// no other keys in the database with the same email address.
+// no other keys in the database with the same email address once
+// normalized, so a differently capitalized address is a duplicate.
 func (m *MailVerifier) checkEmail(e *openpgp.Entity, dbe *openpgp.Entity, r *http.Request) hkpserver.Status {
-	var id *openpgp.Identity
-	isPrimary := false
+	id := keyring.PrimaryIdentity(e)
+	if id == nil {
+		return hkpserver.NewBadRequestStatus("Key rejected, no identity")
+	}
 
-	for key := range e.Identities {
-		id = e.Identities[key]
-		if id.SelfSignature != nil && id.SelfSignature.IsPrimaryId != nil {
-			isPrimary = *id.SelfSignature.IsPrimaryId
-		}
-		break
+	isPrimary := false
+	if id.SelfSignature != nil && id.SelfSignature.IsPrimaryId != nil {
+		isPrimary = *id.SelfSignature.IsPrimaryId
 	}
 
 	if !isPrimary {
@@ -66,18 +102,19 @@ func (m *MailVerifier) checkEmail(e *openpgp.Entity, dbe *openpgp.Entity, r *htt
 		return hkpserver.NewBadRequestStatus("Key rejected, invalid email address")
 	}
 
-	for _, domain := range m.config.MailIdentityDomains {
-		if strings.HasSuffix(email.Address, domain) {
-			el, err := m.db.Get(email.Address, false, true, database.PublicKey)
-			if err != nil {
-				return hkpserver.NewInternalServerErrorStatus("Database error")
-			} else if len(el) > 0 {
-				if len(el[0].Revocations) == 0 {
-					return hkpserver.NewConflictStatus("Key rejected, duplicated key identity")
-				}
+	address := m.config.MailLocalPartFolding.Normalize(email.Address)
+
+	if m.inDomains(address) {
+		el, err := m.db.Get(address, database.SearchOptions{Exact: true})
+		if err != nil {
+			return hkpserver.NewInternalServerErrorStatus("Database error")
+		}
+		for _, dbe := range el {
+			if dbe.PrimaryKey.Fingerprint != e.PrimaryKey.Fingerprint && len(dbe.Revocations) == 0 {
+				return hkpserver.NewConflictStatus("Key rejected, duplicated key identity")
 			}
-			return nil
 		}
+		return nil
 	}
 
 	if len(m.config.MailIdentityDomains) > 0 {
@@ -86,35 +123,119 @@ func (m *MailVerifier) checkEmail(e *openpgp.Entity, dbe *openpgp.Entity, r *htt
 	return nil
 }
 
-// checkValidSubmission checks that the key was submitted with credentials given
-// in the sent email.
+// checkValidSubmission checks that the key was submitted with the token
+// given in the sent email while the submission is pending, the token is
+// consumed once the key is signed and stored. When a challenge was sent,
+// the decrypted challenge must be provided as the basic auth password.
 func (m *MailVerifier) checkValidSubmission(e *openpgp.Entity, dbe *openpgp.Entity, r *http.Request) hkpserver.Status {
-	token, _, ok := r.BasicAuth()
+	token, response, ok := r.BasicAuth()
 	if !ok {
 		return nil
 	}
 
-	origToken, err := m.generateToken(e)
-	if err != nil {
-		return hkpserver.NewInternalServerErrorStatus("Token generation error")
-	} else if token != origToken {
+	id := keyring.PrimaryIdentity(e)
+
+	if err := m.checkToken(verifyToken, token, e, id.UserId.Email); err != nil {
+		logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).WithError(err).Info("Token rejected")
+		return nil
+	}
+
+	// tokens of purged submissions are rejected
+	sub, err := m.pending.Get(token)
+	if err == pending.ErrNotFound {
+		logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).Info("Token rejected, no pending submission")
 		return nil
+	} else if err != nil {
+		return hkpserver.NewInternalServerErrorStatus("Database error")
+	} else if !checkChallenge(sub, response) {
+		logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).Info("Challenge rejected")
+		return hkpserver.NewForbiddenStatus("Key rejected, challenge response doesn't match")
 	}
 
-	for key := range e.Identities {
-		// sign identity
-		if err := e.SignIdentity(key, m.signingKey, nil); err != nil {
-			return hkpserver.NewInternalServerErrorStatus("Signing error")
+	// another key may have been published for the same identity
+	// in the meantime
+	if status := m.checkEmail(e, dbe, r); status != nil && status.IsError() {
+		return status
+	}
+
+	// the token is consumed once the key is published, the key is
+	// stored here so a storage failure doesn't burn the link, the
+	// HKP handler merging it again afterwards is harmless
+	err = m.useToken(verifyToken, token, func() error {
+		if err := m.certify(e, id.Name); err != nil {
+			return fmt.Errorf("while signing key identity: %s", err)
+		}
+		if err := database.Merge(m.db, openpgp.EntityList{e}); err != nil {
+			return fmt.Errorf("while storing validated key: %s", err)
 		}
-		break
+		return nil
+	})
+	if err == errConsumedToken {
+		logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).WithError(err).Info("Token rejected")
+		return nil
+	} else if err != nil {
+		logrus.WithError(err).Error("Failed to publish validated key")
+		return hkpserver.NewInternalServerErrorStatus("Key publication failed")
+	}
+	if err := m.pending.Del(token); err != nil {
+		logrus.WithError(err).Warn("Failed to remove pending key")
 	}
 
 	return hkpserver.NewOKStatus("Key validated and signed")
 }
 
-func (m *MailVerifier) checkDuplicateKey(e *openpgp.Entity, dbe *openpgp.Entity, r *http.Request) hkpserver.Status {
-	if dbe != nil {
-		return hkpserver.NewConflictStatus("Duplicate key")
+// checkNewIdentities rejects identities added to an already published
+// key, as the submitted key is merged with the stored one it would bypass
+// the verification process. It runs before any check accepting updates
+// of a published key, revocations included.
+func (m *MailVerifier) checkNewIdentities(e *openpgp.Entity, dbe *openpgp.Entity, r *http.Request) hkpserver.Status {
+	if dbe == nil {
+		return nil
+	}
+	for name := range e.Identities {
+		if _, ok := dbe.Identities[name]; !ok {
+			logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).Info("Key rejected, identity added to a published key")
+			return hkpserver.NewConflictStatus("Key rejected, identities can't be added to a published key")
+		}
 	}
 	return nil
 }
+
+// checkDuplicateKey accepts updates of an already published key, the
+// submitted key is then merged with the stored one. A published key
+// whose identity isn't certified by the server anymore, because the
+// certification lapsed, goes through the verification process again.
+func (m *MailVerifier) checkDuplicateKey(e *openpgp.Entity, dbe *openpgp.Entity, r *http.Request) hkpserver.Status {
+	if dbe == nil {
+		return nil
+	}
+	if m.config.MailIdentityVerification {
+		certified, err := m.certified(dbe)
+		if err != nil {
+			return hkpserver.NewInternalServerErrorStatus("Database error")
+		} else if !certified {
+			logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).Info("Key update submitted, identity not certified")
+			return nil
+		}
+	}
+	logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).Info("Key update submitted")
+	return hkpserver.NewOKStatus("Key updated successfully")
+}
+
+// certified returns whether the primary identity of the published key
+// holds a valid server certification. Revoked identities and server
+// signing keys don't require any certification.
+func (m *MailVerifier) certified(dbe *openpgp.Entity) (bool, error) {
+	signingKeys, err := m.db.Get("", database.SearchOptions{Fingerprint: true, KeyType: database.SigningKey})
+	if err != nil {
+		return false, err
+	}
+	if isSigningKey(dbe, signingKeys) {
+		return true, nil
+	}
+	id := keyring.PrimaryIdentity(dbe)
+	if id == nil || keyring.IdentityRevoked(dbe, id) {
+		return true, nil
+	}
+	return keyring.IdentityCertifiedBy(dbe, id, signingKeys), nil
+}
@@ -0,0 +1,411 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mailverifier
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/hkpserver"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/ctrliq/spks/pkg/pending"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestCheckEmail(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	signingKey, err := openpgp.NewEntity("Admin", "Signing Key", "admin@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	stored, err := openpgp.NewEntity("Alice", "", "alice@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	stored.PrivateKey = nil
+	if err := db.Add(openpgp.EntityList{stored}); err != nil {
+		t.Fatalf("unexpected error while adding key: %s", err)
+	}
+
+	cfg := config.DefaultServerConfig
+	cfg.MailIdentityDomains = []string{"example.com"}
+	m := New(&cfg, signingKey)
+	if err := m.Init(db, http.NewServeMux()); err != nil {
+		t.Fatalf("unexpected error while initializing verifier: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		email  string
+		status int
+	}{
+		{"other address", "bob@example.com", 0},
+		{"duplicated address", "alice@example.com", http.StatusConflict},
+		{"capitalized duplicated address", "Alice@EXAMPLE.com", http.StatusConflict},
+		{"capitalized domain", "bob@Example.COM", 0},
+		{"other domain", "alice@example.org", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		e, err := openpgp.NewEntity("Test", "", tt.email, nil)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		status := m.checkEmail(e, nil, nil)
+		if tt.status == 0 && status != nil {
+			t.Errorf("unexpected status for %s: %v", tt.name, status)
+		} else if tt.status != 0 && (status == nil || !status.Is(tt.status)) {
+			t.Errorf("unexpected status for %s: %v", tt.name, status)
+		}
+	}
+
+	// the stored key itself isn't a duplicate
+	if status := m.checkEmail(stored, nil, nil); status != nil {
+		t.Errorf("unexpected status for stored key: %v", status)
+	}
+}
+
+func TestCheckDuplicateKey(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	signingKey, err := openpgp.NewEntity("Admin", "Signing Key", "admin@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	if err := db.Add(openpgp.EntityList{signingKey}); err != nil {
+		t.Fatalf("unexpected error while adding signing key: %s", err)
+	}
+
+	cfg := config.DefaultServerConfig
+	cfg.MailIdentityVerification = true
+	m := New(&cfg, signingKey)
+	if err := m.Init(db, http.NewServeMux()); err != nil {
+		t.Fatalf("unexpected error while initializing verifier: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		certify func(e *openpgp.Entity) error
+		status  int
+	}{
+		{
+			name: "certified key",
+			certify: func(e *openpgp.Entity) error {
+				return keyring.Certify(e, keyring.PrimaryIdentity(e).Name, signingKey, time.Hour)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:   "uncertified key",
+			status: 0,
+		},
+		{
+			name: "lapsed certification",
+			certify: func(e *openpgp.Entity) error {
+				id := keyring.PrimaryIdentity(e)
+				if err := keyring.Certify(e, id.Name, signingKey, time.Hour); err != nil {
+					return err
+				}
+				sig := id.Signatures[len(id.Signatures)-1]
+				sig.CreationTime = time.Now().Add(-2 * time.Hour)
+				return sig.SignUserId(id.Name, e.PrimaryKey, signingKey.PrivateKey, nil)
+			},
+			status: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		e, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		if tt.certify != nil {
+			if err := tt.certify(e); err != nil {
+				t.Fatalf("unexpected error while certifying identity for %s: %s", tt.name, err)
+			}
+		}
+		// the published key is the public part only
+		b := new(bytes.Buffer)
+		if err := keyring.Serialize(b, e); err != nil {
+			t.Fatalf("unexpected error while serializing key: %s", err)
+		}
+		el, err := openpgp.ReadKeyRing(b)
+		if err != nil {
+			t.Fatalf("unexpected error while reading key: %s", err)
+		}
+
+		status := m.checkDuplicateKey(e, el[0], nil)
+		if tt.status == 0 && status != nil {
+			t.Errorf("unexpected status for %s: %v", tt.name, status)
+		} else if tt.status != 0 && (status == nil || !status.Is(tt.status)) {
+			t.Errorf("unexpected status for %s: %v", tt.name, status)
+		}
+	}
+
+	// identities can't be added to a published key
+	e, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	dbe := *e
+	dbe.Identities = map[string]*openpgp.Identity{}
+	if status := m.checkNewIdentities(e, &dbe, nil); status == nil || !status.Is(http.StatusConflict) {
+		t.Errorf("unexpected status for added identity: %v", status)
+	}
+}
+
+func TestCheckRevocation(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	cfg := config.DefaultServerConfig
+	cfg.MailIdentityMultiple = true
+	m := New(&cfg, nil)
+	if err := m.Init(db, http.NewServeMux()); err != nil {
+		t.Fatalf("unexpected error while initializing verifier: %s", err)
+	}
+
+	e, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	// the published key is the public part only
+	b := new(bytes.Buffer)
+	if err := keyring.Serialize(b, e); err != nil {
+		t.Fatalf("unexpected error while serializing key: %s", err)
+	}
+	el, err := openpgp.ReadKeyRing(b)
+	if err != nil {
+		t.Fatalf("unexpected error while reading key: %s", err)
+	}
+	if err := db.Add(el); err != nil {
+		t.Fatalf("unexpected error while adding key: %s", err)
+	}
+
+	if err := e.RevokeKey(packet.KeyRetired, "", nil); err != nil {
+		t.Fatalf("unexpected error while revoking key: %s", err)
+	}
+	if _, status := m.Verify(openpgp.EntityList{e}, nil); status == nil || !status.Is(http.StatusOK) {
+		t.Errorf("unexpected status for revoked key: %v", status)
+	}
+
+	// a revocation can't bring unverified identities
+	addIdentity(t, e, "Test", "other@example.org")
+	if _, status := m.Verify(openpgp.EntityList{e}, nil); status == nil || !status.Is(http.StatusConflict) {
+		t.Errorf("unexpected status for revoked key with an added identity: %v", status)
+	}
+}
+
+// addIdentity adds a secondary identity self-signed by the key.
+func addIdentity(t *testing.T, e *openpgp.Entity, name, email string) {
+	sig := *keyring.PrimaryIdentity(e).SelfSignature
+	primary := false
+	sig.IsPrimaryId = &primary
+
+	uid := packet.NewUserId(name, "", email)
+	if err := sig.SignUserId(uid.Id, e.PrimaryKey, e.PrivateKey, nil); err != nil {
+		t.Fatalf("unexpected error while signing user ID: %s", err)
+	}
+	e.Identities[uid.Id] = &openpgp.Identity{
+		Name:          uid.Id,
+		UserId:        uid,
+		SelfSignature: &sig,
+		Signatures:    []*packet.Signature{&sig},
+	}
+}
+
+func TestCheckSingleIdentity(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	tests := []struct {
+		name     string
+		multiple bool
+		emails   []string
+		status   int
+	}{
+		{"single identity", false, nil, 0},
+		{"multiple identities", false, []string{"test@example.org"}, http.StatusBadRequest},
+		{"multiple identities allowed", true, []string{"test@example.org"}, 0},
+		{"secondary identity within domains", true, []string{"test@example.org", "other@EXAMPLE.com"}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		cfg := config.DefaultServerConfig
+		cfg.MailIdentityDomains = []string{"example.com"}
+		cfg.MailIdentityMultiple = tt.multiple
+		m := New(&cfg, nil)
+		if err := m.Init(db, nil); err != nil {
+			t.Fatalf("unexpected error while initializing verifier: %s", err)
+		}
+
+		e, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		for _, email := range tt.emails {
+			addIdentity(t, e, "Test", email)
+		}
+
+		status := m.checkSingleIdentity(e, nil, nil)
+		if tt.status == 0 && status != nil {
+			t.Errorf("unexpected status for %s: %v", tt.name, status)
+		} else if tt.status != 0 && (status == nil || !status.Is(tt.status)) {
+			t.Errorf("unexpected status for %s: %v", tt.name, status)
+		}
+		// the primary identity is the one checked
+		if tt.status == 0 && len(tt.emails) > 0 {
+			if status := m.checkEmail(e, nil, nil); status != nil {
+				t.Errorf("unexpected email status for %s: %v", tt.name, status)
+			}
+		}
+	}
+}
+
+func TestCheckValidSubmission(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	signingKey, err := openpgp.NewEntity("Admin", "Signing Key", "admin@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	if err := db.Add(openpgp.EntityList{signingKey}); err != nil {
+		t.Fatalf("unexpected error while adding signing key: %s", err)
+	}
+	stored, err := openpgp.NewEntity("Alice", "", "alice@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	stored.PrivateKey = nil
+	if err := db.Add(openpgp.EntityList{stored}); err != nil {
+		t.Fatalf("unexpected error while adding key: %s", err)
+	}
+
+	cfg := config.DefaultServerConfig
+	cfg.MailIdentityDomains = []string{"example.com"}
+	m := New(&cfg, signingKey)
+	if err := m.Init(db, http.NewServeMux()); err != nil {
+		t.Fatalf("unexpected error while initializing verifier: %s", err)
+	}
+
+	submit := func(e *openpgp.Entity, email string) (string, hkpserver.Status) {
+		token, err := m.generateToken(verifyToken, e, email)
+		if err != nil {
+			t.Fatalf("unexpected error while generating token: %s", err)
+		}
+		sub, err := pending.NewSubmission(token, e, email, "127.0.0.1", cfg.VerificationTokenTTL)
+		if err != nil {
+			t.Fatalf("unexpected error while creating submission: %s", err)
+		}
+		if err := m.pending.Add(sub); err != nil {
+			t.Fatalf("unexpected error while adding pending key: %s", err)
+		}
+		r := httptest.NewRequest("POST", "http://localhost/pks/add", nil)
+		r.SetBasicAuth(token, "")
+		return token, m.checkValidSubmission(e, nil, r)
+	}
+
+	// another key was published for the identity in the meantime
+	dup, err := openpgp.NewEntity("Alice", "", "alice@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	dup.PrivateKey = nil
+	token, status := submit(dup, "alice@example.com")
+	if status == nil || !status.Is(http.StatusConflict) {
+		t.Errorf("unexpected status for duplicated identity: %v", status)
+	}
+	if err := m.checkToken(verifyToken, token, dup, "alice@example.com"); err != nil {
+		t.Errorf("token consumed for rejected submission: %s", err)
+	}
+
+	e, err := openpgp.NewEntity("Bob", "", "bob@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	e.PrivateKey = nil
+
+	// the token of a purged submission is rejected
+	fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+	token, err = m.generateToken(verifyToken, e, "bob@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+	sub, err := pending.NewSubmission(token, e, "bob@example.com", "127.0.0.1", cfg.VerificationTokenTTL)
+	if err != nil {
+		t.Fatalf("unexpected error while creating submission: %s", err)
+	}
+	if err := m.pending.Add(sub); err != nil {
+		t.Fatalf("unexpected error while adding pending key: %s", err)
+	}
+	if _, err := m.pending.Purge(fp); err != nil {
+		t.Fatalf("unexpected error while purging pending key: %s", err)
+	}
+	r := httptest.NewRequest("POST", "http://localhost/pks/add", nil)
+	r.SetBasicAuth(token, "")
+	if status := m.checkValidSubmission(e, nil, r); status != nil {
+		t.Errorf("unexpected status for purged submission: %v", status)
+	}
+
+	token, status = submit(e, "bob@example.com")
+	if status == nil || !status.Is(http.StatusOK) {
+		t.Fatalf("unexpected status for valid submission: %v", status)
+	}
+	if err := m.checkToken(verifyToken, token, e, "bob@example.com"); err != errConsumedToken {
+		t.Errorf("token not consumed once the key is published: %v", err)
+	}
+
+	el, err := db.Get("bob@example.com", database.SearchOptions{Exact: true})
+	if err != nil {
+		t.Fatalf("unexpected error while retrieving key: %s", err)
+	} else if len(el) != 1 {
+		t.Fatalf("unexpected number of keys stored: %d", len(el))
+	}
+	id := keyring.PrimaryIdentity(el[0])
+	if !keyring.IdentityCertifiedBy(el[0], id, openpgp.EntityList{signingKey}) {
+		t.Errorf("stored key identity not certified")
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mailverifier
+
+import (
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/mailer"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// DeleteRoute is the route used to request and confirm key deletions.
+	DeleteRoute = "/pks/delete"
+)
+
+const (
+	// deleteMailPrefix is the state key prefix recording the deletion
+	// mails recently sent for a key.
+	deleteMailPrefix = "mailverifier" + database.StateSep + "delete" + database.StateSep
+	// deleteMailInterval is the minimum interval between two deletion
+	// mails sent for the same key.
+	deleteMailInterval = 10 * time.Minute
+)
+
+var deleteTemplate = template.Must(template.New("delete").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Public key deletion</title>
+</head>
+<body>
+<h1>Public key deletion</h1>
+{{- if .Error}}
+<p>{{.Error}}</p>
+{{- else if .Message}}
+<p>{{.Message}}</p>
+{{- else if .Token}}
+<p>Please confirm the deletion of the key {{.Fingerprint}} for {{.Identity}}.</p>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="fingerprint" value="{{.Fingerprint}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="submit" value="Delete">
+</form>
+{{- else}}
+<p>A confirmation link will be sent to the verified email address of the key.</p>
+<form method="post" action="{{.Action}}">
+<p><label for="fingerprint">Key fingerprint:</label>
+<input type="text" id="fingerprint" name="fingerprint" size="42"></p>
+<input type="submit" value="Request deletion">
+</form>
+{{- end}}
+</body>
+</html>
+`))
+
+// parseFingerprint returns the uppercased fingerprint or an empty
+// string if the fingerprint is not a full V4 key fingerprint.
+func parseFingerprint(fp string) string {
+	fp = strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(fp), "0x"))
+	fp = strings.ReplaceAll(fp, " ", "")
+	if len(fp) != 40 {
+		return ""
+	} else if _, err := hex.DecodeString(fp); err != nil {
+		return ""
+	}
+	return fp
+}
+
+// lookupKey returns the stored key matching the fingerprint, if any,
+// along with the server signing keys.
+func (m *MailVerifier) lookupKey(fp string) (*openpgp.Entity, openpgp.EntityList, error) {
+	el, err := m.db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var e *openpgp.Entity
+
+	for _, dbe := range el {
+		if fmt.Sprintf("%X", dbe.PrimaryKey.Fingerprint[:]) == fp {
+			e = dbe
+			break
+		}
+	}
+	if e == nil {
+		return nil, nil, nil
+	}
+
+	signingKeys, err := m.db.Get("", database.SearchOptions{Fingerprint: true, KeyType: database.SigningKey})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return e, signingKeys, nil
+}
+
+// isSigningKey returns whether the key is one of the signing keys.
+func isSigningKey(e *openpgp.Entity, signingKeys openpgp.EntityList) bool {
+	for _, sk := range signingKeys {
+		if sk.PrimaryKey.Fingerprint == e.PrimaryKey.Fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// publishedKey returns the published key matching the fingerprint and
+// its primary identity if the identity has been verified by the server.
+// The identity must be unrevoked, its email address must belong to
+// one of the verified domains and it must hold a certification issued
+// by a server signing key, an expired certification is enough so the
+// owner of a lapsed identity is still able to delete the key.
+func (m *MailVerifier) publishedKey(fp string) (*openpgp.Entity, *openpgp.Identity, error) {
+	e, signingKeys, err := m.lookupKey(fp)
+	if err != nil || e == nil {
+		return nil, nil, err
+	}
+
+	// the server signing key identity is self certified
+	if isSigningKey(e, signingKeys) {
+		return e, nil, nil
+	}
+
+	id := keyring.PrimaryIdentity(e)
+	if id == nil || id.UserId.Email == "" || keyring.IdentityRevoked(e, id) {
+		return e, nil, nil
+	}
+
+	email, err := mail.ParseAddress(id.UserId.Email)
+	if err != nil || !m.inDomains(m.config.MailLocalPartFolding.Normalize(email.Address)) {
+		return e, nil, nil
+	} else if _, certified := keyring.CertificationExpiry(e, id, signingKeys); !certified {
+		return e, nil, nil
+	}
+
+	return e, id, nil
+}
+
+// deleteURL returns the deletion link for the key and the token.
+func (m *MailVerifier) deleteURL(fp, token string) (string, error) {
+	u, err := webURL(m.config.PublicURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = DeleteRoute
+	u.RawQuery = url.Values{"fingerprint": {fp}, "token": {token}}.Encode()
+	return u.String(), nil
+}
+
+// delete provides the handler of key deletions, a deletion is first
+// requested for a key fingerprint which sends a confirmation link to
+// the verified email address of the key, the key is then removed once
+// the deletion is confirmed.
+func (m *MailVerifier) delete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeKeyPage(w, deleteTemplate, http.StatusMethodNotAllowed, &keyPage{Error: "Method not allowed."})
+		return
+	}
+
+	if !m.config.MailIdentityVerification {
+		writeKeyPage(w, deleteTemplate, http.StatusNotImplemented, &keyPage{Error: "Key deletion requires mail identity verification."})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeKeyPage(w, deleteTemplate, http.StatusBadRequest, &keyPage{Error: "Bad request."})
+		return
+	}
+
+	page := &keyPage{Action: DeleteRoute}
+
+	token := r.Form.Get("token")
+	fingerprint := r.Form.Get("fingerprint")
+
+	if token == "" && fingerprint == "" && r.Method == http.MethodGet {
+		writeKeyPage(w, deleteTemplate, http.StatusOK, page)
+		return
+	}
+
+	fp := parseFingerprint(fingerprint)
+	if fp == "" {
+		page.Error = "Invalid key fingerprint, a full fingerprint is required."
+		writeKeyPage(w, deleteTemplate, http.StatusBadRequest, page)
+		return
+	}
+
+	e, id, err := m.publishedKey(fp)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to retrieve key")
+		page.Error = "Internal server error."
+		writeKeyPage(w, deleteTemplate, http.StatusInternalServerError, page)
+		return
+	} else if e == nil {
+		page.Error = "Key not found."
+		writeKeyPage(w, deleteTemplate, http.StatusNotFound, page)
+		return
+	} else if id == nil {
+		page.Error = "Key has no verified identity, it can't be deleted."
+		writeKeyPage(w, deleteTemplate, http.StatusForbidden, page)
+		return
+	}
+
+	page.Fingerprint = fp
+	page.Identity = id.Name
+
+	if token == "" {
+		m.requestDeletion(w, r, e, id, page)
+		return
+	}
+
+	page.Token = token
+
+	if err := m.checkToken(deleteToken, token, e, id.UserId.Email); err != nil {
+		page.Error = fmt.Sprintf("Deletion link rejected: %s.", err)
+		writeKeyPage(w, deleteTemplate, http.StatusForbidden, page)
+		return
+	}
+
+	// GET requests only display the confirmation form, so the key
+	// isn't deleted by mail scanners following links
+	if r.Method == http.MethodGet {
+		writeKeyPage(w, deleteTemplate, http.StatusOK, page)
+		return
+	}
+
+	// the token is consumed once the key is deleted
+	err = m.useToken(deleteToken, token, func() error {
+		return m.db.Del(openpgp.EntityList{e})
+	})
+	if err == errConsumedToken {
+		page.Error = fmt.Sprintf("Deletion link rejected: %s.", err)
+		writeKeyPage(w, deleteTemplate, http.StatusForbidden, page)
+		return
+	} else if err != nil {
+		logrus.WithError(err).Error("Failed to delete key")
+		page.Error = "Internal server error."
+		writeKeyPage(w, deleteTemplate, http.StatusInternalServerError, page)
+		return
+	}
+	if _, err := m.pending.Purge(fp); err != nil {
+		logrus.WithError(err).Warn("Failed to remove pending submissions of deleted key")
+	}
+
+	logrus.WithField("fingerprint", fp).Info("Key deleted by its owner")
+
+	page.Message = fmt.Sprintf("The key %s for %s has been deleted.", fp, id.Name)
+	writeKeyPage(w, deleteTemplate, http.StatusOK, page)
+}
+
+// requestDeletion sends the deletion confirmation link to the verified
+// email address of the key.
+func (m *MailVerifier) requestDeletion(w http.ResponseWriter, r *http.Request, e *openpgp.Entity, id *openpgp.Identity, page *keyPage) {
+	if r.Method != http.MethodPost {
+		writeKeyPage(w, deleteTemplate, http.StatusMethodNotAllowed, &keyPage{Error: "Method not allowed."})
+		return
+	}
+
+	// limit the number of mails sent for a key
+	mailKey := deleteMailPrefix + page.Fingerprint
+	if _, err := m.state.GetState(mailKey); err == nil {
+		page.Error = "A deletion has already been requested recently for this key, please check your mailbox."
+		writeKeyPage(w, deleteTemplate, http.StatusTooManyRequests, page)
+		return
+	} else if err != database.ErrNotFound {
+		logrus.WithError(err).Error("Failed to retrieve deletion state")
+		page.Error = "Internal server error."
+		writeKeyPage(w, deleteTemplate, http.StatusInternalServerError, page)
+		return
+	}
+
+	token, err := m.generateToken(deleteToken, e, id.UserId.Email)
+	if err != nil {
+		page.Error = "Token generation failed."
+		writeKeyPage(w, deleteTemplate, http.StatusInternalServerError, page)
+		return
+	}
+	deleteURL, err := m.deleteURL(page.Fingerprint, token)
+	if err != nil {
+		page.Error = "Bad server configuration."
+		writeKeyPage(w, deleteTemplate, http.StatusInternalServerError, page)
+		return
+	}
+
+	args := &mailer.TemplateArgs{
+		Name:        id.UserId.Name,
+		PublicURL:   m.config.PublicURL,
+		DeleteURL:   deleteURL,
+		Expiration:  time.Now().Add(m.config.VerificationTokenTTL).UTC().Format(time.RFC1123),
+		Fingerprint: fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[12:20]),
+	}
+
+	templateMsg := m.config.MailerConfig.DeleteTemplate
+	if templateMsg == "" {
+		templateMsg = mailer.DefaultDeleteTemplate
+	}
+	subject := m.config.MailerConfig.DeleteSubject
+	if subject == "" {
+		subject = mailer.DefaultDeleteSubject
+	}
+
+	logrus.WithField("to", id.UserId.Email).Info("Sending deletion confirmation")
+
+	if err := m.sendMail(id.UserId.Email, subject, templateMsg, args); err != nil {
+		logrus.WithError(err).Error("Failed to send deletion confirmation")
+		page.Error = "Failed to send the confirmation mail."
+		writeKeyPage(w, deleteTemplate, http.StatusInternalServerError, page)
+		return
+	}
+	if err := m.state.SetState(mailKey, []byte{1}, deleteMailInterval); err != nil {
+		logrus.WithError(err).Warn("Failed to record deletion request")
+	}
+
+	page.Message = fmt.Sprintf("Deletion instructions sent to %s.", id.UserId.Email)
+	writeKeyPage(w, deleteTemplate, http.StatusAccepted, page)
+}
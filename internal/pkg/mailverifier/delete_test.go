@@ -0,0 +1,246 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mailverifier
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestParseFingerprint(t *testing.T) {
+	tests := []struct {
+		fp       string
+		expected string
+	}{
+		{"0x0123456789abcdef0123456789abcdef01234567", "0123456789ABCDEF0123456789ABCDEF01234567"},
+		{"0123 4567 89AB CDEF 0123  4567 89AB CDEF 0123 4567", "0123456789ABCDEF0123456789ABCDEF01234567"},
+		{"0x0123456789ABCDEF", ""},
+		{"Z123456789ABCDEF0123456789ABCDEF01234567", ""},
+	}
+
+	for _, tt := range tests {
+		if fp := parseFingerprint(tt.fp); fp != tt.expected {
+			t.Errorf("unexpected fingerprint for %q: got %q instead of %q", tt.fp, fp, tt.expected)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	signingKey, err := openpgp.NewEntity("Admin", "Signing Key", "admin@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	e, err := openpgp.NewEntity("Test", "No comment", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	id := keyring.PrimaryIdentity(e)
+	if err := e.SignIdentity(id.Name, signingKey, nil); err != nil {
+		t.Fatalf("unexpected error while signing identity: %s", err)
+	}
+
+	// the certification of the identity has lapsed
+	lapsed, err := openpgp.NewEntity("Lapsed", "No comment", "lapsed@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	lapsedID := keyring.PrimaryIdentity(lapsed)
+	if err := keyring.Certify(lapsed, lapsedID.Name, signingKey, time.Hour); err != nil {
+		t.Fatalf("unexpected error while certifying identity: %s", err)
+	}
+	sig := lapsedID.Signatures[len(lapsedID.Signatures)-1]
+	sig.CreationTime = time.Now().Add(-2 * time.Hour)
+	if err := sig.SignUserId(lapsedID.Name, lapsed.PrimaryKey, signingKey.PrivateKey, nil); err != nil {
+		t.Fatalf("unexpected error while certifying identity: %s", err)
+	}
+
+	// the identity email address is outside of the verified domains
+	other, err := openpgp.NewEntity("Other", "No comment", "other@example.org", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	otherID := keyring.PrimaryIdentity(other)
+	if err := other.SignIdentity(otherID.Name, signingKey, nil); err != nil {
+		t.Fatalf("unexpected error while signing identity: %s", err)
+	}
+
+	// store the public part only
+	b := new(bytes.Buffer)
+	for _, k := range []*openpgp.Entity{e, lapsed, other} {
+		if err := keyring.Serialize(b, k); err != nil {
+			t.Fatalf("unexpected error while serializing key: %s", err)
+		}
+	}
+	el, err := openpgp.ReadKeyRing(b)
+	if err != nil {
+		t.Fatalf("unexpected error while reading key: %s", err)
+	}
+	if err := db.Add(append(el, signingKey)); err != nil {
+		t.Fatalf("unexpected error while adding keys: %s", err)
+	}
+
+	cfg := config.DefaultServerConfig
+	cfg.MailIdentityVerification = true
+	cfg.MailIdentityDomains = []string{"example.com"}
+	m := New(&cfg, signingKey)
+	if err := m.Init(db, http.NewServeMux()); err != nil {
+		t.Fatalf("unexpected error while initializing verifier: %s", err)
+	}
+
+	fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+	signingFp := fmt.Sprintf("%X", signingKey.PrimaryKey.Fingerprint[:])
+	lapsedFp := fmt.Sprintf("%X", lapsed.PrimaryKey.Fingerprint[:])
+	otherFp := fmt.Sprintf("%X", other.PrimaryKey.Fingerprint[:])
+
+	token, err := m.generateToken(deleteToken, e, "test@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+	verifyTok, err := m.generateToken(verifyToken, e, "test@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+	lapsedTok, err := m.generateToken(deleteToken, lapsed, "lapsed@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+	otherTok, err := m.generateToken(deleteToken, other, "other@example.org")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		fingerprint string
+		token       string
+		code        int
+	}{
+		{
+			name:   "request form",
+			method: "GET",
+			code:   http.StatusOK,
+		},
+		{
+			name:        "bad fingerprint",
+			method:      "POST",
+			fingerprint: "0x0123",
+			code:        http.StatusBadRequest,
+		},
+		{
+			name:        "unknown key",
+			method:      "POST",
+			fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567",
+			code:        http.StatusNotFound,
+		},
+		{
+			name:        "signing key",
+			method:      "POST",
+			fingerprint: signingFp,
+			code:        http.StatusForbidden,
+		},
+		{
+			name:        "identity outside of domains",
+			method:      "GET",
+			fingerprint: otherFp,
+			token:       otherTok,
+			code:        http.StatusForbidden,
+		},
+		{
+			name:        "lapsed certification",
+			method:      "GET",
+			fingerprint: lapsedFp,
+			token:       lapsedTok,
+			code:        http.StatusOK,
+		},
+		{
+			name:        "verification token",
+			method:      "POST",
+			fingerprint: fp,
+			token:       verifyTok,
+			code:        http.StatusForbidden,
+		},
+		{
+			name:        "confirmation form",
+			method:      "GET",
+			fingerprint: fp,
+			token:       token,
+			code:        http.StatusOK,
+		},
+		{
+			name:        "confirm",
+			method:      "POST",
+			fingerprint: fp,
+			token:       token,
+			code:        http.StatusOK,
+		},
+		{
+			name:        "confirm twice",
+			method:      "POST",
+			fingerprint: fp,
+			token:       token,
+			code:        http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		var req *http.Request
+
+		form := url.Values{}
+		if tt.fingerprint != "" {
+			form.Set("fingerprint", tt.fingerprint)
+		}
+		if tt.token != "" {
+			form.Set("token", tt.token)
+		}
+
+		resp := httptest.NewRecorder()
+		if tt.method == "POST" {
+			req = httptest.NewRequest(tt.method, "http://localhost"+DeleteRoute, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(tt.method, "http://localhost"+DeleteRoute+"?"+form.Encode(), nil)
+		}
+
+		m.delete(resp, req)
+
+		if resp.Code != tt.code {
+			t.Errorf("unexpected http status returned for %q: got %d instead of %d", tt.name, resp.Code, tt.code)
+		}
+	}
+
+	el, err = db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true})
+	if err != nil {
+		t.Fatalf("unexpected error while retrieving key: %s", err)
+	} else if len(el) != 0 {
+		t.Errorf("deleted key still published")
+	}
+	el, err = db.Get(signingFp, database.SearchOptions{Fingerprint: true, Exact: true, KeyType: database.SigningKey})
+	if err != nil {
+		t.Fatalf("unexpected error while retrieving signing key: %s", err)
+	} else if len(el) != 1 {
+		t.Errorf("signing key deleted")
+	}
+}
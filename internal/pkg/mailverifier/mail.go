@@ -4,31 +4,38 @@
 package mailverifier
 
 import (
-	"crypto/rand"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/ctrliq/spks/internal/pkg/config"
 	"github.com/ctrliq/spks/internal/pkg/mailer"
 	"github.com/ctrliq/spks/pkg/database"
 	"github.com/ctrliq/spks/pkg/hkpserver"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/ctrliq/spks/pkg/pending"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/openpgp"
 )
 
-var _ hkpserver.Verifier = &MailVerifier{}
+var (
+	_ hkpserver.Verifier           = &MailVerifier{}
+	_ hkpserver.BackgroundVerifier = &MailVerifier{}
+)
 
 type MailVerifier struct {
 	config     *config.ServerConfig
 	processing []processingFunc
 	db         database.Engine
 	signingKey *openpgp.Entity
-	passphrase [64]byte
-	sessionKey [64]byte
+	state      database.StateEngine
+	pending    *pending.Store
+	secret     []byte
+	tokenMutex sync.Mutex
 }
 
 func New(config *config.ServerConfig, signingKey *openpgp.Entity) *MailVerifier {
@@ -37,9 +44,10 @@ func New(config *config.ServerConfig, signingKey *openpgp.Entity) *MailVerifier
 		signingKey: signingKey,
 	}
 	v.processing = []processingFunc{
-		v.checkSingleIdentity,  // ensure keys have only one identity
+		v.checkSingleIdentity,  // ensure keys have only one identity unless allowed
+		v.checkNewIdentities,   // reject identities added to a published key
 		v.checkRevocation,      // accept key revocation without validation
-		v.checkDuplicateKey,    // fail if a key exist with the same fingerprint
+		v.checkDuplicateKey,    // merge updates of a key with the same fingerprint
 		v.checkValidSubmission, // validation process via basic auth token
 		v.checkEmail,           // check if mail address in key identity is whitelisted
 	}
@@ -51,14 +59,34 @@ func New(config *config.ServerConfig, signingKey *openpgp.Entity) *MailVerifier
 	return v
 }
 
-func (m *MailVerifier) Init(db database.Engine, _ *http.ServeMux) error {
+// certify certifies the key identity with the signing key, the
+// certification expires after the configured certification lifetime.
+func (m *MailVerifier) certify(e *openpgp.Entity, identity string) error {
+	return keyring.Certify(e, identity, m.signingKey, m.config.CertificationLifetime)
+}
+
+func (m *MailVerifier) Init(db database.Engine, mux *http.ServeMux) error {
+	var ok bool
+
 	m.db = db
-	_, err := io.ReadFull(rand.Reader, m.sessionKey[:])
+	m.state, ok = database.GetStateEngine(db)
+	if !ok {
+		return fmt.Errorf("database engine doesn't support state storage required by verification tokens")
+	}
+
+	store, err := pending.NewStore(db)
 	if err != nil {
 		return err
 	}
-	_, err = io.ReadFull(rand.Reader, m.passphrase[:])
-	return err
+	m.pending = store
+
+	if mux != nil {
+		mux.HandleFunc(VerifyRoute, m.verify)
+		mux.HandleFunc(DeleteRoute, m.delete)
+		mux.HandleFunc(RenewRoute, m.renew)
+	}
+
+	return m.loadSecret()
 }
 
 func (m *MailVerifier) Verify(el openpgp.EntityList, r *http.Request) (openpgp.EntityList, hkpserver.Status) {
@@ -74,7 +102,7 @@ func (m *MailVerifier) Verify(el openpgp.EntityList, r *http.Request) (openpgp.E
 	var dbEntity *openpgp.Entity
 
 	fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
-	eldb, err := m.db.Get(fp, true, true, database.PublicKey)
+	eldb, err := m.db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true})
 	if err != nil {
 		return nil, hkpserver.NewInternalServerErrorStatus("Database access failed")
 	} else if len(eldb) > 1 {
@@ -103,14 +131,10 @@ func (m *MailVerifier) Verify(el openpgp.EntityList, r *http.Request) (openpgp.E
 }
 
 func (m *MailVerifier) sendEmail(e *openpgp.Entity, dbe *openpgp.Entity, r *http.Request) hkpserver.Status {
-	var id *openpgp.Identity
-	for key := range e.Identities {
-		id = e.Identities[key]
-		break
-	}
+	id := keyring.PrimaryIdentity(e)
 
 	// process auth token
-	token, err := m.generateToken(e)
+	token, err := m.generateToken(verifyToken, e, id.UserId.Email)
 	if err != nil {
 		return hkpserver.NewInternalServerErrorStatus("Token generation failed")
 	}
@@ -121,13 +145,43 @@ func (m *MailVerifier) sendEmail(e *openpgp.Entity, dbe *openpgp.Entity, r *http
 	}
 	u.User = url.User(token)
 
-	from := m.config.AdminEmail
+	verifyURL, err := m.verifyURL(token)
+	if err != nil {
+		return hkpserver.NewInternalServerErrorStatus("Bad server configuration")
+	}
+
+	// keep the key until the verification link is opened
+	sub, err := pending.NewSubmission(token, e, id.UserId.Email, hkpserver.RemoteIP(r), m.config.VerificationTokenTTL)
+	if err != nil {
+		return hkpserver.NewInternalServerErrorStatus("Key serialization failed")
+	}
+
+	var encryptedChallenge string
+
+	if m.config.MailIdentityChallenge {
+		var challenge string
+
+		challenge, encryptedChallenge, err = newChallenge(e)
+		if err != nil {
+			logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).WithError(err).Info("Key rejected, challenge encryption failed")
+			return hkpserver.NewBadRequestStatus("Key rejected, no valid encryption key to send the challenge")
+		}
+		sub.Challenge = challengeDigest(challenge)
+	}
+
+	if err := m.pending.Add(sub); err != nil {
+		return hkpserver.NewInternalServerErrorStatus("Database error")
+	}
+
 	to := id.UserId.Email
 	args := &mailer.TemplateArgs{
 		Name:          id.UserId.Name,
 		PublicURL:     m.config.PublicURL,
 		PublicAuthURL: u.String(),
+		VerifyURL:     verifyURL,
+		Expiration:    sub.Expires.Format(time.RFC1123),
 		Fingerprint:   fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[12:20]),
+		Challenge:     encryptedChallenge,
 	}
 
 	templateMsg := m.config.MailerConfig.MessageTemplate
@@ -139,25 +193,31 @@ func (m *MailVerifier) sendEmail(e *openpgp.Entity, dbe *openpgp.Entity, r *http
 		subject = mailer.DefaultSubject
 	}
 
+	logrus.WithField("to", to).Info("Sending mail verification")
+
+	if err := m.sendMail(to, subject, templateMsg, args); err != nil {
+		logrus.WithError(err).Error("Failed to send mail verification")
+		return hkpserver.NewInternalServerErrorStatus("Mail sending failed")
+	}
+
+	return hkpserver.NewAcceptedStatus("Key accepted, validation instructions sent to", to)
+}
+
+// sendMail sends the message generated from the template to the
+// email address.
+func (m *MailVerifier) sendMail(to, subject, templateMsg string, args *mailer.TemplateArgs) error {
 	tmpl, err := template.New("message").Parse(templateMsg)
 	if err != nil {
-		return hkpserver.NewInternalServerErrorStatus("Mail message parsing failed")
+		return fmt.Errorf("while parsing mail message: %s", err)
 	}
 	s := new(strings.Builder)
-	err = tmpl.Execute(s, args)
-	if err != nil {
-		return hkpserver.NewInternalServerErrorStatus("Mail message processing failed")
+	if err := tmpl.Execute(s, args); err != nil {
+		return fmt.Errorf("while processing mail message: %s", err)
 	}
 
-	logrus.WithField("to", to).Info("Sending mail verification")
+	msg := mailer.NewMessage(m.config.AdminEmail, to, subject, s.String())
 
-	msg := mailer.NewMessage(from, to, subject, s.String())
-
-	if err := mailer.Send(&m.config.MailerConfig, msg); err != nil {
-		return hkpserver.NewInternalServerErrorStatus(err.Error())
-	}
-
-	return hkpserver.NewAcceptedStatus("Key accepted, validation instructions sent to", to)
+	return mailer.Send(&m.config.MailerConfig, msg)
 }
 
 func (m *MailVerifier) noEmail(e *openpgp.Entity, dbe *openpgp.Entity, r *http.Request) hkpserver.Status {
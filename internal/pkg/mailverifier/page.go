@@ -0,0 +1,27 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mailverifier
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// keyPage holds the template arguments of the pages confirming an
+// operation on a published key, like its deletion or the renewal of
+// its certification.
+type keyPage struct {
+	Action      string
+	Token       string
+	Fingerprint string
+	Identity    string
+	Message     string
+	Error       string
+}
+
+func writeKeyPage(w http.ResponseWriter, t *template.Template, code int, page *keyPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	t.Execute(w, page)
+}
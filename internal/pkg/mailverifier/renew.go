@@ -0,0 +1,322 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mailverifier
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/mailer"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// RenewRoute is the route used to confirm certification renewals.
+	RenewRoute = "/pks/renew"
+)
+
+const (
+	// renewMailPrefix is the state key prefix recording the renewal
+	// mails sent for a key during the renewal period.
+	renewMailPrefix = "mailverifier" + database.StateSep + "renew" + database.StateSep
+	// renewCheckInterval is the interval between two lookups for
+	// certifications to renew.
+	renewCheckInterval = time.Hour
+)
+
+// renewPageSize is the number of keys read at once while looking for
+// certifications to renew, so the whole keyring isn't held in memory.
+var renewPageSize = 1000
+
+var renewTemplate = template.Must(template.New("renew").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Public key certification renewal</title>
+</head>
+<body>
+<h1>Public key certification renewal</h1>
+{{- if .Error}}
+<p>{{.Error}}</p>
+{{- else if .Message}}
+<p>{{.Message}}</p>
+{{- else}}
+<p>Please confirm the certification renewal of the key {{.Fingerprint}} for {{.Identity}}.</p>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="fingerprint" value="{{.Fingerprint}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="submit" value="Renew">
+</form>
+{{- end}}
+</body>
+</html>
+`))
+
+// renewal describes a server certification to renew.
+type renewal struct {
+	e      *openpgp.Entity
+	id     *openpgp.Identity
+	expiry time.Time
+}
+
+// Run periodically requests by mail the renewal of the server
+// certifications expiring within the renewal period, certifications
+// which are not renewed lapse.
+func (m *MailVerifier) Run(ctx context.Context) {
+	if m.config.CertificationLifetime == 0 || !m.config.MailIdentityVerification {
+		return
+	}
+
+	ticker := time.NewTicker(renewCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		m.sendRenewals(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewals returns the server certifications expiring within the
+// renewal period for which no renewal mail has been sent yet, the
+// keys are read by pages of renewPageSize keys.
+func (m *MailVerifier) renewals(now time.Time) ([]renewal, error) {
+	signingKeys, err := m.db.Get("", database.SearchOptions{Fingerprint: true, KeyType: database.SigningKey})
+	if err != nil {
+		return nil, err
+	}
+
+	var renewals []renewal
+
+	for offset := 0; ; offset += renewPageSize {
+		el, err := m.db.Get("", database.SearchOptions{Offset: offset, Limit: renewPageSize})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range el {
+			r, ok, err := m.renewal(e, signingKeys, now)
+			if err != nil {
+				return nil, err
+			} else if ok {
+				renewals = append(renewals, r)
+			}
+		}
+
+		if len(el) < renewPageSize {
+			break
+		}
+	}
+
+	return renewals, nil
+}
+
+// renewal returns whether the server certification of the key expires
+// within the renewal period and no renewal mail has been sent yet.
+func (m *MailVerifier) renewal(e *openpgp.Entity, signingKeys openpgp.EntityList, now time.Time) (renewal, bool, error) {
+	if len(e.Revocations) > 0 || isSigningKey(e, signingKeys) {
+		return renewal{}, false, nil
+	}
+	id := keyring.PrimaryIdentity(e)
+	if id == nil || id.UserId.Email == "" || keyring.IdentityRevoked(e, id) {
+		return renewal{}, false, nil
+	}
+	expiry, ok := keyring.CertificationExpiry(e, id, signingKeys)
+	if !ok || expiry.IsZero() || now.After(expiry) {
+		return renewal{}, false, nil
+	} else if expiry.Sub(now) > m.config.CertificationRenewal {
+		return renewal{}, false, nil
+	}
+
+	mailKey := renewMailPrefix + fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+	if _, err := m.state.GetState(mailKey); err == nil {
+		return renewal{}, false, nil
+	} else if err != database.ErrNotFound {
+		return renewal{}, false, err
+	}
+
+	return renewal{e: e, id: id, expiry: expiry}, true, nil
+}
+
+// sendRenewals sends the renewal mails for the certifications
+// expiring within the renewal period.
+func (m *MailVerifier) sendRenewals(now time.Time) {
+	renewals, err := m.renewals(now)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to look for certifications to renew")
+		return
+	}
+
+	for _, r := range renewals {
+		fp := fmt.Sprintf("%X", r.e.PrimaryKey.Fingerprint[:])
+
+		if err := m.sendRenewal(r); err != nil {
+			logrus.WithField("fingerprint", fp).WithError(err).Error("Failed to send certification renewal")
+			continue
+		}
+		// a single mail is sent during the renewal period
+		if err := m.state.SetState(renewMailPrefix+fp, []byte{1}, m.config.CertificationRenewal); err != nil {
+			logrus.WithError(err).Warn("Failed to record certification renewal request")
+		}
+	}
+}
+
+// sendRenewal sends the renewal link to the certified email address.
+func (m *MailVerifier) sendRenewal(r renewal) error {
+	fp := fmt.Sprintf("%X", r.e.PrimaryKey.Fingerprint[:])
+
+	token, err := m.generateToken(renewToken, r.e, r.id.UserId.Email)
+	if err != nil {
+		return fmt.Errorf("while generating token: %s", err)
+	}
+	renewURL, err := m.renewURL(fp, token)
+	if err != nil {
+		return err
+	}
+
+	args := &mailer.TemplateArgs{
+		Name:        r.id.UserId.Name,
+		PublicURL:   m.config.PublicURL,
+		RenewURL:    renewURL,
+		Expiration:  r.expiry.UTC().Format(time.RFC1123),
+		Fingerprint: fmt.Sprintf("%X", r.e.PrimaryKey.Fingerprint[12:20]),
+	}
+
+	templateMsg := m.config.MailerConfig.RenewTemplate
+	if templateMsg == "" {
+		templateMsg = mailer.DefaultRenewTemplate
+	}
+	subject := m.config.MailerConfig.RenewSubject
+	if subject == "" {
+		subject = mailer.DefaultRenewSubject
+	}
+
+	logrus.WithField("to", r.id.UserId.Email).Info("Sending certification renewal")
+
+	return m.sendMail(r.id.UserId.Email, subject, templateMsg, args)
+}
+
+// renewURL returns the renewal link for the key and the token.
+func (m *MailVerifier) renewURL(fp, token string) (string, error) {
+	u, err := webURL(m.config.PublicURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = RenewRoute
+	u.RawQuery = url.Values{"fingerprint": {fp}, "token": {token}}.Encode()
+	return u.String(), nil
+}
+
+// renew provides the handler of certification renewals, the renewal
+// link displays a confirmation form and the identity is certified
+// again once the renewal is confirmed.
+func (m *MailVerifier) renew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeKeyPage(w, renewTemplate, http.StatusMethodNotAllowed, &keyPage{Error: "Method not allowed."})
+		return
+	}
+
+	if m.config.CertificationLifetime == 0 || !m.config.MailIdentityVerification {
+		writeKeyPage(w, renewTemplate, http.StatusNotImplemented, &keyPage{Error: "Certifications don't expire on this server."})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeKeyPage(w, renewTemplate, http.StatusBadRequest, &keyPage{Error: "Bad request."})
+		return
+	}
+
+	page := &keyPage{Action: RenewRoute}
+
+	token := r.Form.Get("token")
+	fp := parseFingerprint(r.Form.Get("fingerprint"))
+	if fp == "" || token == "" {
+		page.Error = "Invalid renewal link."
+		writeKeyPage(w, renewTemplate, http.StatusBadRequest, page)
+		return
+	}
+
+	e, signingKeys, err := m.lookupKey(fp)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to retrieve key")
+		page.Error = "Internal server error."
+		writeKeyPage(w, renewTemplate, http.StatusInternalServerError, page)
+		return
+	} else if e == nil {
+		page.Error = "Key not found."
+		writeKeyPage(w, renewTemplate, http.StatusNotFound, page)
+		return
+	}
+
+	id := keyring.PrimaryIdentity(e)
+	if isSigningKey(e, signingKeys) || id == nil || keyring.IdentityRevoked(e, id) {
+		page.Error = "Key has no certified identity."
+		writeKeyPage(w, renewTemplate, http.StatusForbidden, page)
+		return
+	} else if _, ok := keyring.CertificationExpiry(e, id, signingKeys); !ok {
+		// lapsed certifications can be renewed as long as the
+		// renewal link is valid
+		page.Error = "Key has no certified identity."
+		writeKeyPage(w, renewTemplate, http.StatusForbidden, page)
+		return
+	}
+
+	page.Fingerprint = fp
+	page.Identity = id.Name
+	page.Token = token
+
+	if err := m.checkToken(renewToken, token, e, id.UserId.Email); err != nil {
+		page.Error = fmt.Sprintf("Renewal link rejected: %s.", err)
+		writeKeyPage(w, renewTemplate, http.StatusForbidden, page)
+		return
+	}
+
+	// GET requests only display the confirmation form, so the
+	// certification isn't renewed by mail scanners following links
+	if r.Method == http.MethodGet {
+		writeKeyPage(w, renewTemplate, http.StatusOK, page)
+		return
+	}
+
+	// the token is consumed once the renewed certification is stored
+	err = m.useToken(renewToken, token, func() error {
+		if err := m.certify(e, id.Name); err != nil {
+			return fmt.Errorf("while certifying identity: %s", err)
+		}
+		if err := m.db.Add(openpgp.EntityList{e}); err != nil {
+			return fmt.Errorf("while storing key: %s", err)
+		}
+		return nil
+	})
+	if err == errConsumedToken {
+		page.Error = fmt.Sprintf("Renewal link rejected: %s.", err)
+		writeKeyPage(w, renewTemplate, http.StatusForbidden, page)
+		return
+	} else if err != nil {
+		logrus.WithError(err).Error("Failed to renew certification")
+		page.Error = "Internal server error."
+		writeKeyPage(w, renewTemplate, http.StatusInternalServerError, page)
+		return
+	}
+	if err := m.state.DelState(renewMailPrefix + fp); err != nil {
+		logrus.WithError(err).Warn("Failed to clear certification renewal request")
+	}
+
+	logrus.WithField("fingerprint", fp).Info("Certification renewed")
+
+	expiry := time.Now().Add(m.config.CertificationLifetime).UTC().Format(time.RFC1123)
+	page.Message = fmt.Sprintf("The certification of the key %s for %s has been renewed until %s.", fp, id.Name, expiry)
+	writeKeyPage(w, renewTemplate, http.StatusOK, page)
+}
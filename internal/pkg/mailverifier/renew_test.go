@@ -0,0 +1,203 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mailverifier
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestRenew(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	signingKey, err := openpgp.NewEntity("Admin", "Signing Key", "admin@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	if err := db.Add(openpgp.EntityList{signingKey}); err != nil {
+		t.Fatalf("unexpected error while adding signing key: %s", err)
+	}
+
+	// keys certified with a certification expiring soon, later
+	// and never
+	lifetimes := []time.Duration{time.Hour, 100 * time.Hour, 0}
+	keys := make(openpgp.EntityList, len(lifetimes))
+
+	for i, lifetime := range lifetimes {
+		e, err := openpgp.NewEntity(fmt.Sprintf("Test%d", i), "", fmt.Sprintf("test%d@example.com", i), nil)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		if err := keyring.Certify(e, keyring.PrimaryIdentity(e).Name, signingKey, lifetime); err != nil {
+			t.Fatalf("unexpected error while certifying identity: %s", err)
+		}
+		// store the public part only
+		b := new(bytes.Buffer)
+		if err := keyring.Serialize(b, e); err != nil {
+			t.Fatalf("unexpected error while serializing key: %s", err)
+		}
+		el, err := openpgp.ReadKeyRing(b)
+		if err != nil {
+			t.Fatalf("unexpected error while reading key: %s", err)
+		}
+		if err := db.Add(el); err != nil {
+			t.Fatalf("unexpected error while adding key: %s", err)
+		}
+		keys[i] = el[0]
+	}
+
+	cfg := config.DefaultServerConfig
+	cfg.MailIdentityVerification = true
+	cfg.CertificationLifetime = 200 * time.Hour
+	cfg.CertificationRenewal = 2 * time.Hour
+	m := New(&cfg, signingKey)
+	if err := m.Init(db, http.NewServeMux()); err != nil {
+		t.Fatalf("unexpected error while initializing verifier: %s", err)
+	}
+
+	// keys are read across several pages
+	defer func(size int) { renewPageSize = size }(renewPageSize)
+	renewPageSize = 2
+
+	renewals, err := m.renewals(time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error while looking for renewals: %s", err)
+	} else if len(renewals) != 1 || renewals[0].e.PrimaryKey.Fingerprint != keys[0].PrimaryKey.Fingerprint {
+		t.Fatalf("unexpected renewals returned")
+	}
+
+	// expired certifications lapse
+	renewals, err = m.renewals(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error while looking for renewals: %s", err)
+	} else if len(renewals) != 0 {
+		t.Fatalf("unexpected renewals returned for lapsed certifications")
+	}
+
+	// a single renewal mail is sent during the renewal period
+	fp := fmt.Sprintf("%X", keys[0].PrimaryKey.Fingerprint[:])
+	if err := m.state.SetState(renewMailPrefix+fp, []byte{1}, cfg.CertificationRenewal); err != nil {
+		t.Fatalf("unexpected error while recording renewal: %s", err)
+	}
+	renewals, err = m.renewals(time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error while looking for renewals: %s", err)
+	} else if len(renewals) != 0 {
+		t.Fatalf("unexpected renewals returned once renewal mail sent")
+	}
+
+	token, err := m.generateToken(renewToken, keys[0], "test0@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+	deleteTok, err := m.generateToken(deleteToken, keys[0], "test0@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		fingerprint string
+		token       string
+		code        int
+	}{
+		{
+			name:        "missing token",
+			method:      "GET",
+			fingerprint: fp,
+			code:        http.StatusBadRequest,
+		},
+		{
+			name:        "unknown key",
+			method:      "GET",
+			fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567",
+			token:       token,
+			code:        http.StatusNotFound,
+		},
+		{
+			name:        "deletion token",
+			method:      "POST",
+			fingerprint: fp,
+			token:       deleteTok,
+			code:        http.StatusForbidden,
+		},
+		{
+			name:        "confirmation form",
+			method:      "GET",
+			fingerprint: fp,
+			token:       token,
+			code:        http.StatusOK,
+		},
+		{
+			name:        "confirm",
+			method:      "POST",
+			fingerprint: fp,
+			token:       token,
+			code:        http.StatusOK,
+		},
+		{
+			name:        "confirm twice",
+			method:      "POST",
+			fingerprint: fp,
+			token:       token,
+			code:        http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		var req *http.Request
+
+		form := url.Values{}
+		form.Set("fingerprint", tt.fingerprint)
+		if tt.token != "" {
+			form.Set("token", tt.token)
+		}
+
+		resp := httptest.NewRecorder()
+		if tt.method == "POST" {
+			req = httptest.NewRequest(tt.method, "http://localhost"+RenewRoute, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(tt.method, "http://localhost"+RenewRoute+"?"+form.Encode(), nil)
+		}
+
+		m.renew(resp, req)
+
+		if resp.Code != tt.code {
+			t.Errorf("unexpected http status returned for %q: got %d instead of %d", tt.name, resp.Code, tt.code)
+		}
+	}
+
+	el, err := db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true})
+	if err != nil || len(el) != 1 {
+		t.Fatalf("unexpected error while retrieving key: %v", err)
+	}
+	expiry, ok := keyring.CertificationExpiry(el[0], keyring.PrimaryIdentity(el[0]), openpgp.EntityList{signingKey})
+	if !ok || time.Until(expiry) < cfg.CertificationLifetime-time.Minute {
+		t.Errorf("certification not renewed: expires %s", expiry)
+	}
+	if _, err := m.state.GetState(renewMailPrefix + fp); err != database.ErrNotFound {
+		t.Errorf("renewal request not cleared")
+	}
+}
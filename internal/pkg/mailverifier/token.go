@@ -4,37 +4,172 @@
 package mailverifier
 
 import (
-	"bytes"
-	"crypto/md5"
-	"encoding/hex"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
 
+	"github.com/ctrliq/spks/pkg/database"
 	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/packet"
 )
 
-func (m *MailVerifier) generateToken(e *openpgp.Entity) (string, error) {
-	// resulting hash of the serialized and encrypted public key
-	// being submitted
-	token := md5.New()
+const (
+	// tokenSecretKey is the state key of the persisted HMAC secret.
+	tokenSecretKey = "mailverifier" + database.StateSep + "secret"
+	// tokenUsedPrefix is the state key prefix of consumed tokens.
+	tokenUsedPrefix = "mailverifier" + database.StateSep + "used" + database.StateSep
+)
+
+const (
+	tokenSecretSize = 32
+	tokenNonceSize  = 8
+	tokenTimeSize   = 8
+	tokenMACSize    = sha256.Size
+	tokenSize       = tokenTimeSize + tokenNonceSize + tokenMACSize
+)
+
+// tokenPurpose scopes a token to an operation so that a token sent
+// for one operation can't be used for another one.
+type tokenPurpose string
+
+const (
+	verifyToken tokenPurpose = ""
+	deleteToken tokenPurpose = "delete"
+	renewToken  tokenPurpose = "renew"
+)
+
+var (
+	errInvalidToken  = fmt.Errorf("invalid token")
+	errExpiredToken  = fmt.Errorf("expired token")
+	errConsumedToken = fmt.Errorf("token already used")
+)
 
-	// ensure reproducible hash
-	config := &packet.Config{
-		Rand: bytes.NewReader(m.sessionKey[:]),
+// loadSecret loads the token HMAC secret from the database state
+// or generates and persists a new one.
+func (m *MailVerifier) loadSecret() error {
+	secret, err := m.state.GetState(tokenSecretKey)
+	if err == nil && len(secret) == tokenSecretSize {
+		m.secret = secret
+		return nil
+	} else if err != nil && err != database.ErrNotFound {
+		return fmt.Errorf("while reading token secret: %s", err)
 	}
 
-	wc, err := openpgp.SymmetricallyEncrypt(token, m.passphrase[:], nil, config)
-	if err != nil {
-		return "", err
+	secret = make([]byte, tokenSecretSize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return fmt.Errorf("while generating token secret: %s", err)
+	}
+	if err := m.state.SetState(tokenSecretKey, secret, 0); err != nil {
+		return fmt.Errorf("while storing token secret: %s", err)
 	}
+	m.secret = secret
 
-	// serialize write public key to be ciphered and hashed
-	if err := e.Serialize(wc); err != nil {
-		wc.Close()
-		return "", err
+	return nil
+}
+
+// tokenTTL returns the lifetime of the tokens issued for the purpose,
+// renewal links remain valid during the whole renewal period.
+func (m *MailVerifier) tokenTTL(purpose tokenPurpose) time.Duration {
+	if purpose == renewToken && m.config.CertificationRenewal > 0 {
+		return m.config.CertificationRenewal
+	}
+	return m.config.VerificationTokenTTL
+}
+
+// tokenMAC computes the token HMAC binding the issue time and nonce
+// to the purpose, the key fingerprint and the email address. The email
+// address is normalized like the stored identities, so a token is valid
+// for the addresses designating the same identity. Every field is length
+// prefixed so that two different field sequences can't share a MAC.
+func (m *MailVerifier) tokenMAC(purpose tokenPurpose, payload []byte, e *openpgp.Entity, email string) []byte {
+	mac := hmac.New(sha256.New, m.secret)
+	for _, field := range [][]byte{
+		[]byte(purpose),
+		payload,
+		e.PrimaryKey.Fingerprint[:],
+		[]byte(m.config.MailLocalPartFolding.Normalize(email)),
+	} {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(field)))
+		mac.Write(size[:])
+		mac.Write(field)
 	}
-	if err := wc.Close(); err != nil {
+	return mac.Sum(nil)
+}
+
+// generateToken returns a token scoped to the purpose, the key and
+// the email address, carrying its issue time.
+func (m *MailVerifier) generateToken(purpose tokenPurpose, e *openpgp.Entity, email string) (string, error) {
+	token := make([]byte, tokenSize)
+
+	binary.BigEndian.PutUint64(token, uint64(time.Now().Unix()))
+	if _, err := io.ReadFull(rand.Reader, token[tokenTimeSize:tokenTimeSize+tokenNonceSize]); err != nil {
 		return "", err
 	}
 
-	return hex.EncodeToString(token.Sum(nil)), nil
+	payload := token[:tokenTimeSize+tokenNonceSize]
+	copy(token[len(payload):], m.tokenMAC(purpose, payload, e, email))
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// checkToken checks that the token was issued for the purpose, the key
+// and the email address, that it didn't expire and wasn't already consumed.
+func (m *MailVerifier) checkToken(purpose tokenPurpose, token string, e *openpgp.Entity, email string) error {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) != tokenSize {
+		return errInvalidToken
+	}
+
+	payload := b[:tokenTimeSize+tokenNonceSize]
+	if !hmac.Equal(b[len(payload):], m.tokenMAC(purpose, payload, e, email)) {
+		return errInvalidToken
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	if time.Since(issued) > m.tokenTTL(purpose) {
+		return errExpiredToken
+	}
+
+	_, err = m.state.GetState(tokenUsedPrefix + token)
+	if err == nil {
+		return errConsumedToken
+	} else if err != database.ErrNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// consumeToken marks the token as used, the mark is kept until
+// the token expires.
+func (m *MailVerifier) consumeToken(purpose tokenPurpose, token string) error {
+	return m.useToken(purpose, token, nil)
+}
+
+// useToken runs the operation authorized by the token and only marks
+// the token as used once the operation succeeded, so a link can be
+// followed again after a failure. Token uses are serialized so that
+// concurrent requests can't both run the operation with the same token.
+func (m *MailVerifier) useToken(purpose tokenPurpose, token string, fn func() error) error {
+	m.tokenMutex.Lock()
+	defer m.tokenMutex.Unlock()
+
+	if _, err := m.state.GetState(tokenUsedPrefix + token); err == nil {
+		return errConsumedToken
+	} else if err != database.ErrNotFound {
+		return err
+	}
+
+	if fn != nil {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+
+	return m.state.SetState(tokenUsedPrefix+token, []byte{1}, m.tokenTTL(purpose))
 }
@@ -0,0 +1,158 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mailverifier
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestToken(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	cfg := config.DefaultServerConfig
+	m := New(&cfg, nil)
+	if err := m.Init(db, nil); err != nil {
+		t.Fatalf("unexpected error while initializing verifier: %s", err)
+	}
+
+	e, err := openpgp.NewEntity("Test", "No comment", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	other, err := openpgp.NewEntity("Other", "No comment", "other@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+
+	token, err := m.generateToken(verifyToken, e, "test@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+
+	if err := m.checkToken(verifyToken, token, other, "test@example.com"); err != errInvalidToken {
+		t.Errorf("token accepted for another key")
+	}
+	if err := m.checkToken(verifyToken, token, e, "other@example.com"); err != errInvalidToken {
+		t.Errorf("token accepted for another email")
+	}
+	if err := m.checkToken(verifyToken, token[1:], e, "test@example.com"); err != errInvalidToken {
+		t.Errorf("truncated token accepted")
+	}
+	if err := m.checkToken(deleteToken, token, e, "test@example.com"); err != errInvalidToken {
+		t.Errorf("token accepted for another purpose")
+	}
+	if bytes.Equal(
+		m.tokenMAC(verifyToken, nil, e, "x@y.comdelete"),
+		m.tokenMAC(deleteToken, nil, e, "x@y.com"),
+	) {
+		t.Errorf("purpose and email address fields not separated in token MAC")
+	}
+	if err := m.checkToken(verifyToken, token, e, "Test@EXAMPLE.com"); err != nil {
+		t.Errorf("token rejected for the same normalized email: %s", err)
+	}
+
+	// the email address is normalized with the local part folding
+	cfg.MailLocalPartFolding = database.NoFolding
+	if err := m.checkToken(verifyToken, token, e, "test@EXAMPLE.com"); err != nil {
+		t.Errorf("token rejected for the same normalized email: %s", err)
+	}
+	if err := m.checkToken(verifyToken, token, e, "Test@example.com"); err != errInvalidToken {
+		t.Errorf("token accepted for another local part with case-sensitive local parts")
+	}
+	cfg.MailLocalPartFolding = database.FullFolding
+
+	// secret persisted across verifier instances
+	m = New(&cfg, nil)
+	if err := m.Init(db, nil); err != nil {
+		t.Fatalf("unexpected error while initializing verifier: %s", err)
+	}
+	if err := m.checkToken(verifyToken, token, e, "test@example.com"); err != nil {
+		t.Errorf("unexpected error while checking token: %s", err)
+	}
+
+	if err := m.consumeToken(verifyToken, token); err != nil {
+		t.Errorf("unexpected error while consuming token: %s", err)
+	}
+	if err := m.checkToken(verifyToken, token, e, "test@example.com"); err != errConsumedToken {
+		t.Errorf("consumed token accepted")
+	}
+	if err := m.consumeToken(verifyToken, token); err != errConsumedToken {
+		t.Errorf("token consumed twice")
+	}
+
+	cfg.VerificationTokenTTL = -time.Second
+	token, err = m.generateToken(verifyToken, e, "test@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+	if err := m.checkToken(verifyToken, token, e, "test@example.com"); err != errExpiredToken {
+		t.Errorf("expired token accepted")
+	}
+}
+
+func TestUseToken(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	cfg := config.DefaultServerConfig
+	m := New(&cfg, nil)
+	if err := m.Init(db, nil); err != nil {
+		t.Fatalf("unexpected error while initializing verifier: %s", err)
+	}
+
+	e, err := openpgp.NewEntity("Test", "No comment", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	token, err := m.generateToken(verifyToken, e, "test@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+
+	// a failed operation leaves the token usable
+	errFailed := fmt.Errorf("failed")
+	if err := m.useToken(verifyToken, token, func() error { return errFailed }); err != errFailed {
+		t.Errorf("unexpected error while using token: %v", err)
+	}
+	if err := m.checkToken(verifyToken, token, e, "test@example.com"); err != nil {
+		t.Errorf("token consumed by a failed operation: %s", err)
+	}
+
+	runs := 0
+	for i := 0; i < 2; i++ {
+		err := m.useToken(verifyToken, token, func() error {
+			runs++
+			return nil
+		})
+		if i == 0 && err != nil {
+			t.Errorf("unexpected error while using token: %s", err)
+		} else if i == 1 && err != errConsumedToken {
+			t.Errorf("token used twice")
+		}
+	}
+	if runs != 1 {
+		t.Errorf("unexpected number of operations run: got %d instead of 1", runs)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mailverifier
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/ctrliq/spks/pkg/pending"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// VerifyRoute is the route of the links sent in verification mails.
+	VerifyRoute = "/pks/verify"
+)
+
+var verifyTemplate = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Public key validation</title>
+</head>
+<body>
+<h1>Public key validation</h1>
+{{- if .Error}}
+<p>{{.Error}}</p>
+{{- else if .Done}}
+<p>The key {{.Fingerprint}} for {{.Identity}} has been validated and published.</p>
+{{- else}}
+<p>Please confirm that you submitted the key {{.Fingerprint}} for {{.Identity}}.</p>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="token" value="{{.Token}}">
+{{- if .Challenge}}
+<p><label for="challenge">Decrypted challenge:</label>
+<input type="text" id="challenge" name="challenge" autocomplete="off"></p>
+{{- end}}
+<input type="submit" value="Confirm">
+</form>
+{{- end}}
+</body>
+</html>
+`))
+
+// verifyPage holds the verification page template arguments.
+type verifyPage struct {
+	Action      string
+	Token       string
+	Fingerprint string
+	Identity    string
+	Error       string
+	Done        bool
+	Challenge   bool
+}
+
+func writeVerifyPage(w http.ResponseWriter, code int, page *verifyPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	verifyTemplate.Execute(w, page)
+}
+
+// webURL returns the public URL with an HTTP scheme so verification
+// links can be opened in a browser.
+func webURL(publicURL string) (*url.URL, error) {
+	u, err := url.Parse(publicURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "hkp":
+		u.Scheme = "http"
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "11371")
+		}
+	case "hkps":
+		u.Scheme = "https"
+	}
+
+	return u, nil
+}
+
+// verifyURL returns the verification link for the token.
+func (m *MailVerifier) verifyURL(token string) (string, error) {
+	u, err := webURL(m.config.PublicURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = VerifyRoute
+	u.RawQuery = url.Values{"token": {token}}.Encode()
+	return u.String(), nil
+}
+
+// verify provides the handler of the verification links, opening the
+// link displays a confirmation form which signs and publishes the
+// pending key once submitted.
+func (m *MailVerifier) verify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeVerifyPage(w, http.StatusMethodNotAllowed, &verifyPage{Error: "Method not allowed."})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeVerifyPage(w, http.StatusBadRequest, &verifyPage{Error: "Bad request."})
+		return
+	}
+
+	token := r.Form.Get("token")
+
+	sub, err := m.pending.Get(token)
+	if err == pending.ErrNotFound {
+		writeVerifyPage(w, http.StatusNotFound, &verifyPage{Error: "Unknown or expired validation link."})
+		return
+	} else if err != nil {
+		logrus.WithError(err).Error("Failed to retrieve pending key")
+		writeVerifyPage(w, http.StatusInternalServerError, &verifyPage{Error: "Internal server error."})
+		return
+	}
+
+	e, err := sub.Entity()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read pending key")
+		writeVerifyPage(w, http.StatusInternalServerError, &verifyPage{Error: "Internal server error."})
+		return
+	}
+
+	id := keyring.PrimaryIdentity(e)
+	fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+
+	page := &verifyPage{
+		Action:      VerifyRoute,
+		Token:       token,
+		Fingerprint: fp,
+		Identity:    id.Name,
+		Challenge:   sub.Challenge != "",
+	}
+
+	if err := m.checkToken(verifyToken, token, e, id.UserId.Email); err != nil {
+		page.Error = fmt.Sprintf("Validation link rejected: %s.", err)
+		writeVerifyPage(w, http.StatusForbidden, page)
+		return
+	}
+
+	// GET requests only display the confirmation form, so the key
+	// isn't published by mail scanners following links
+	if r.Method == http.MethodGet {
+		writeVerifyPage(w, http.StatusOK, page)
+		return
+	}
+
+	// another key may have been published for the same identity
+	// in the meantime
+	if status := m.checkEmail(e, nil, r); status != nil && status.IsError() {
+		page.Error = "Key rejected, a key is already published for this identity."
+		writeVerifyPage(w, http.StatusConflict, page)
+		return
+	}
+
+	if !checkChallenge(sub, r.PostForm.Get("challenge")) {
+		logrus.WithField("fingerprint", fp).Info("Challenge rejected")
+		page.Error = "Challenge response doesn't match."
+		writeVerifyPage(w, http.StatusForbidden, page)
+		return
+	}
+
+	// the token is consumed once the key is published
+	err = m.useToken(verifyToken, token, func() error {
+		if err := m.certify(e, id.Name); err != nil {
+			return fmt.Errorf("while signing key identity: %s", err)
+		}
+		if err := database.Merge(m.db, openpgp.EntityList{e}); err != nil {
+			return fmt.Errorf("while storing validated key: %s", err)
+		}
+		return nil
+	})
+	if err == errConsumedToken {
+		page.Error = fmt.Sprintf("Validation link rejected: %s.", err)
+		writeVerifyPage(w, http.StatusForbidden, page)
+		return
+	} else if err != nil {
+		logrus.WithError(err).Error("Failed to publish validated key")
+		page.Error = "Internal server error."
+		writeVerifyPage(w, http.StatusInternalServerError, page)
+		return
+	}
+	if err := m.pending.Del(token); err != nil {
+		logrus.WithError(err).Warn("Failed to remove pending key")
+	}
+
+	logrus.WithField("fingerprint", fp).Info("Key validated and published")
+
+	page.Done = true
+	writeVerifyPage(w, http.StatusOK, page)
+}
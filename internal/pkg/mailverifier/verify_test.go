@@ -0,0 +1,145 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mailverifier
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ctrliq/spks/internal/pkg/config"
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/ctrliq/spks/pkg/pending"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestWebURL(t *testing.T) {
+	tests := []struct {
+		publicURL string
+		expected  string
+	}{
+		{"hkp://localhost", "http://localhost:11371"},
+		{"hkp://localhost:8080", "http://localhost:8080"},
+		{"hkps://keys.example.com", "https://keys.example.com"},
+		{"https://keys.example.com", "https://keys.example.com"},
+	}
+
+	for _, tt := range tests {
+		u, err := webURL(tt.publicURL)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %s", tt.publicURL, err)
+		} else if u.String() != tt.expected {
+			t.Errorf("unexpected URL for %s: got %s instead of %s", tt.publicURL, u, tt.expected)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	signingKey, err := openpgp.NewEntity("Admin", "Signing Key", "admin@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	if err := db.Add(openpgp.EntityList{signingKey}); err != nil {
+		t.Fatalf("unexpected error while adding signing key: %s", err)
+	}
+	e, err := openpgp.NewEntity("Test", "No comment", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+
+	cfg := config.DefaultServerConfig
+	m := New(&cfg, signingKey)
+	if err := m.Init(db, http.NewServeMux()); err != nil {
+		t.Fatalf("unexpected error while initializing verifier: %s", err)
+	}
+
+	token, err := m.generateToken(verifyToken, e, "test@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error while generating token: %s", err)
+	}
+	sub, err := pending.NewSubmission(token, e, "test@example.com", "127.0.0.1", cfg.VerificationTokenTTL)
+	if err != nil {
+		t.Fatalf("unexpected error while creating submission: %s", err)
+	}
+	if err := m.pending.Add(sub); err != nil {
+		t.Fatalf("unexpected error while adding pending key: %s", err)
+	}
+
+	form := url.Values{"token": {token}}.Encode()
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		code   int
+	}{
+		{
+			name:   "unknown token",
+			method: "GET",
+			token:  "unknown",
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "confirmation form",
+			method: "GET",
+			token:  token,
+			code:   http.StatusOK,
+		},
+		{
+			name:   "confirm",
+			method: "POST",
+			token:  token,
+			code:   http.StatusOK,
+		},
+		{
+			name:   "confirm twice",
+			method: "POST",
+			token:  token,
+			code:   http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		var req *http.Request
+
+		resp := httptest.NewRecorder()
+		if tt.method == "POST" {
+			req = httptest.NewRequest(tt.method, "http://localhost"+VerifyRoute, strings.NewReader(form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(tt.method, "http://localhost"+VerifyRoute+"?token="+tt.token, nil)
+		}
+
+		m.verify(resp, req)
+
+		if resp.Code != tt.code {
+			t.Errorf("unexpected http status returned for %q: got %d instead of %d", tt.name, resp.Code, tt.code)
+		}
+	}
+
+	fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+	el, err := db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true})
+	if err != nil {
+		t.Fatalf("unexpected error while retrieving key: %s", err)
+	} else if len(el) != 1 {
+		t.Fatalf("validated key not published")
+	}
+	if !keyring.IdentityCertifiedBy(el[0], keyring.PrimaryIdentity(el[0]), openpgp.EntityList{signingKey}) {
+		t.Errorf("published key identity not signed by server")
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package signingkey
+
+import (
+	"crypto"
+	"fmt"
+	"time"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// recertifyPageSize is the number of keys read at once while
+// certifying the stored identities with a new signing key.
+var recertifyPageSize = 1000
+
+// RotateResult describes the changes made by a signing key rotation.
+type RotateResult struct {
+	// Previous is the signing key in use before the rotation, nil
+	// if there was none.
+	Previous *openpgp.Entity
+	// Recertified is the number of identities certified with the
+	// new signing key.
+	Recertified int
+	// Revoked indicates whether the previous signing key was revoked.
+	Revoked bool
+	// Resumed indicates whether an interrupted rotation to the same
+	// signing key was resumed.
+	Resumed bool
+}
+
+// CrossCertify certifies the identities of the new signing key with
+// the previous signing key, so anyone trusting the previous signing
+// key can trust the new one.
+func CrossCertify(e, previous *openpgp.Entity) error {
+	for name := range e.Identities {
+		if err := e.SignIdentity(name, previous, nil); err != nil {
+			return fmt.Errorf("while certifying %q with previous signing key: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Recertify certifies with the signing key every stored identity
+// certified by one of the unrevoked previous signing keys and not already
+// certified by the signing key, it returns the number of identities
+// certified. New certifications expire with the previous ones.
+func Recertify(db database.Engine, signingKey *openpgp.Entity, previous openpgp.EntityList) (int, error) {
+	isSigningKey := func(e *openpgp.Entity) bool {
+		if e.PrimaryKey.Fingerprint == signingKey.PrimaryKey.Fingerprint {
+			return true
+		}
+		for _, sk := range previous {
+			if e.PrimaryKey.Fingerprint == sk.PrimaryKey.Fingerprint {
+				return true
+			}
+		}
+		return false
+	}
+
+	current := openpgp.EntityList{signingKey}
+	count := 0
+
+	// keys are read by pages of recertifyPageSize keys, storing the
+	// certified keys doesn't change their position in the pages
+	for offset := 0; ; offset += recertifyPageSize {
+		el, err := db.Get("", database.SearchOptions{Offset: offset, Limit: recertifyPageSize})
+		if err != nil {
+			return count, fmt.Errorf("while retrieving keys from database: %s", err)
+		}
+
+		for _, e := range el {
+			if isSigningKey(e) || len(e.Revocations) > 0 {
+				continue
+			}
+
+			certified := 0
+
+			for _, id := range keyring.SortedIdentities(e) {
+				if keyring.IdentityRevoked(e, id) {
+					continue
+				} else if !keyring.IdentityCertifiedBy(e, id, previous) {
+					continue
+				} else if keyring.IdentityCertifiedBy(e, id, current) {
+					continue
+				}
+				// the new certification expires with the previous one
+				var lifetime time.Duration
+				if expiry, _ := keyring.CertificationExpiry(e, id, previous); !expiry.IsZero() {
+					lifetime = time.Until(expiry)
+					if lifetime <= 0 {
+						// the previous certification lapsed meanwhile
+						continue
+					}
+				}
+				if err := keyring.Certify(e, id.Name, signingKey, lifetime); err != nil {
+					return count, fmt.Errorf("while certifying %q: %s", id.Name, err)
+				}
+				certified++
+			}
+
+			if certified == 0 {
+				continue
+			}
+			if err := db.Add(openpgp.EntityList{e}); err != nil {
+				return count, fmt.Errorf("while storing key %X: %s", e.PrimaryKey.Fingerprint[:], err)
+			}
+			count += certified
+		}
+
+		if len(el) < recertifyPageSize {
+			break
+		}
+	}
+
+	return count, nil
+}
+
+// inUseState is the state key marking the signing keys as in use by a
+// running server.
+const inUseState = "signing-key" + database.StateSep + "in-use"
+
+// inUseTTL is the lifetime of the in use mark, the mark is renewed
+// while the server runs so the mark left by a crashed server expires.
+var inUseTTL = time.Minute
+
+// MarkInUse marks the signing keys as in use by the server until the
+// returned function is called, Rotate refuses to rotate the signing
+// key meanwhile as the server keeps certifying with the signing key
+// loaded at start. Database engines without state storage aren't
+// marked.
+func MarkInUse(db database.Engine) (func(), error) {
+	state, ok := database.GetStateEngine(db)
+	if !ok {
+		return func() {}, nil
+	}
+	if err := state.SetState(inUseState, []byte{1}, inUseTTL); err != nil {
+		return nil, fmt.Errorf("while marking signing keys in use: %s", err)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(inUseTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := state.SetState(inUseState, []byte{1}, inUseTTL); err != nil {
+					logrus.WithError(err).Warn("Failed to renew signing keys in use mark")
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		if err := state.DelState(inUseState); err != nil {
+			logrus.WithError(err).Warn("Failed to remove signing keys in use mark")
+		}
+	}, nil
+}
+
+// checkNotInUse returns an error if the signing keys are marked in
+// use by a running server.
+func checkNotInUse(db database.Engine) error {
+	state, ok := database.GetStateEngine(db)
+	if !ok {
+		return nil
+	}
+	if _, err := state.GetState(inUseState); err == nil {
+		return fmt.Errorf("signing key is in use by a running server, stop it before rotating the signing key")
+	} else if err != database.ErrNotFound {
+		return fmt.Errorf("while checking whether signing key is in use: %s", err)
+	}
+	return nil
+}
+
+// revoke adds a key revocation signature to the signing key with the
+// superseded reason. openpgp.Entity.RevokeKey isn't used as it assumes
+// RSA keys.
+func revoke(e *openpgp.Entity, reason string) error {
+	reasonCode := uint8(packet.KeySuperseded)
+	sig := &packet.Signature{
+		SigType:              packet.SigTypeKeyRevocation,
+		PubKeyAlgo:           e.PrivateKey.PubKeyAlgo,
+		Hash:                 crypto.SHA384,
+		CreationTime:         time.Now(),
+		RevocationReason:     &reasonCode,
+		RevocationReasonText: reason,
+		IssuerKeyId:          &e.PrimaryKey.KeyId,
+	}
+	if err := sig.RevokeKey(e.PrimaryKey, e.PrivateKey, nil); err != nil {
+		return err
+	}
+	e.Revocations = append(e.Revocations, sig)
+	return nil
+}
+
+// crossCertifier returns the signing key among el which certified the
+// stored signing key identity, nil if there is none.
+func crossCertifier(e *openpgp.Entity, el openpgp.EntityList) *openpgp.Entity {
+	id := keyring.PrimaryIdentity(e)
+	if id == nil {
+		return nil
+	}
+	for _, sig := range id.Signatures {
+		if sk := keyring.CertificationIssuer(e, id, sig, el); sk != nil {
+			return sk
+		}
+	}
+	return nil
+}
+
+// Rotate stores the new signing key which becomes the current signing
+// key. The new signing key is cross-certified by the previous signing
+// key and identities certified by any of the stored signing keys are
+// certified with the new signing key. The previous signing key is
+// revoked if requested, otherwise it's kept as a rotated key. Previous
+// signing keys always remain stored so past certifications can still
+// be checked. The passphrase decrypts the signing keys in memory and
+// encrypts them in the database, see Add. A rotation interrupted once
+// the new signing key is stored is resumed by rotating again to the
+// same key. The signing key can't be rotated while it's in use by a
+// running server, see MarkInUse.
+func Rotate(db database.Engine, e *openpgp.Entity, revokePrevious bool, passphrase []byte) (*RotateResult, error) {
+	if err := checkNotInUse(db); err != nil {
+		return nil, err
+	} else if err := Check(openpgp.EntityList{e}); err != nil {
+		return nil, err
+	} else if err := Unlock(e, passphrase); err != nil {
+		return nil, err
+	}
+
+	el, err := List(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored *openpgp.Entity
+	var others openpgp.EntityList
+
+	for _, sk := range el {
+		if sk.PrimaryKey.Fingerprint == e.PrimaryKey.Fingerprint {
+			stored = sk
+		} else {
+			others = append(others, sk)
+		}
+	}
+
+	result := &RotateResult{
+		Previous: Select(others),
+	}
+
+	if stored != nil {
+		// only the current signing key can be rotated to again, to
+		// resume an interrupted rotation
+		if Select(el) != stored {
+			return nil, fmt.Errorf("key %X is already a signing key", e.PrimaryKey.Fingerprint[:])
+		}
+		result.Resumed = true
+		result.Previous = crossCertifier(stored, others)
+	} else if result.Previous != nil {
+		// the new key wouldn't be selected as the current signing key
+		// by Select if a previous signing key is more recent
+		for _, sk := range el {
+			if sk == result.Previous && revokePrevious {
+				continue
+			} else if len(sk.Revocations) > 0 || sk.PrivateKey == nil {
+				continue
+			}
+			if !e.PrimaryKey.CreationTime.After(sk.PrimaryKey.CreationTime) {
+				return nil, fmt.Errorf("new signing key must be more recent than signing key %X", sk.PrimaryKey.Fingerprint[:])
+			}
+		}
+		if err := Unlock(result.Previous, passphrase); err != nil {
+			return nil, err
+		}
+		if err := CrossCertify(e, result.Previous); err != nil {
+			return nil, err
+		}
+	}
+
+	if stored == nil {
+		if err := Add(db, openpgp.EntityList{e}, passphrase); err != nil {
+			return nil, fmt.Errorf("while storing new signing key: %s", err)
+		}
+	}
+
+	result.Recertified, err = Recertify(db, e, others)
+	if err != nil {
+		return result, err
+	}
+
+	if result.Previous != nil && revokePrevious {
+		if len(result.Previous.Revocations) > 0 {
+			// revoked by the interrupted rotation
+			result.Revoked = true
+			return result, nil
+		}
+		if err := Unlock(result.Previous, passphrase); err != nil {
+			return result, err
+		}
+		if err := revoke(result.Previous, "Signing key rotated"); err != nil {
+			return result, fmt.Errorf("while revoking previous signing key: %s", err)
+		}
+		if err := Add(db, openpgp.EntityList{result.Previous}, passphrase); err != nil {
+			return result, fmt.Errorf("while storing revoked signing key: %s", err)
+		}
+		result.Revoked = true
+	}
+
+	return result, nil
+}
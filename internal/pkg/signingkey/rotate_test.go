@@ -0,0 +1,208 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package signingkey
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func newKey(t *testing.T, name, email string, created time.Time) *openpgp.Entity {
+	cfg := &packet.Config{Time: func() time.Time { return created }}
+	e, err := openpgp.NewEntity(name, "", email, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	return e
+}
+
+func TestRotate(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	now := time.Now()
+
+	oldKey := newKey(t, "Admin", "admin@example.com", now.Add(-time.Hour))
+	if err := Add(db, openpgp.EntityList{oldKey}, nil); err != nil {
+		t.Fatalf("unexpected error while storing signing key: %s", err)
+	}
+
+	// a verified key and a key without certification
+	verified := newKey(t, "Verified", "verified@example.com", now)
+	if err := verified.SignIdentity(keyring.PrimaryIdentity(verified).Name, oldKey, nil); err != nil {
+		t.Fatalf("unexpected error while signing identity: %s", err)
+	}
+	unverified := newKey(t, "Unverified", "unverified@example.com", now)
+
+	for _, e := range []*openpgp.Entity{verified, unverified} {
+		b := new(bytes.Buffer)
+		if err := keyring.Serialize(b, e); err != nil {
+			t.Fatalf("unexpected error while serializing key: %s", err)
+		}
+		el, err := openpgp.ReadKeyRing(b)
+		if err != nil {
+			t.Fatalf("unexpected error while reading key: %s", err)
+		}
+		if err := db.Add(el); err != nil {
+			t.Fatalf("unexpected error while storing key: %s", err)
+		}
+	}
+
+	// a key older than the current signing key can't be rotated to
+	if _, err := Rotate(db, newKey(t, "Admin", "admin@example.com", now.Add(-2*time.Hour)), false, nil); err == nil {
+		t.Fatalf("unexpected success while rotating to an older key")
+	}
+
+	newSigningKey := newKey(t, "Admin", "admin@example.com", now)
+
+	// keys are read across several pages
+	defer func(size int) { recertifyPageSize = size }(recertifyPageSize)
+	recertifyPageSize = 1
+
+	result, err := Rotate(db, newSigningKey, true, nil)
+	if err != nil {
+		t.Fatalf("unexpected error while rotating signing key: %s", err)
+	} else if result.Previous == nil || result.Previous.PrimaryKey.Fingerprint != oldKey.PrimaryKey.Fingerprint {
+		t.Fatalf("unexpected previous signing key")
+	} else if result.Recertified != 1 {
+		t.Errorf("unexpected number of certified identities: got %d instead of 1", result.Recertified)
+	} else if !result.Revoked {
+		t.Errorf("previous signing key not revoked")
+	}
+
+	// rotating again to the current signing key resumes the rotation
+	result, err = Rotate(db, newSigningKey, true, nil)
+	if err != nil {
+		t.Fatalf("unexpected error while resuming rotation: %s", err)
+	} else if !result.Resumed {
+		t.Errorf("rotation to the current signing key not resumed")
+	} else if result.Previous == nil || result.Previous.PrimaryKey.Fingerprint != oldKey.PrimaryKey.Fingerprint {
+		t.Errorf("unexpected previous signing key for resumed rotation")
+	} else if result.Recertified != 0 {
+		t.Errorf("unexpected number of certified identities: got %d instead of 0", result.Recertified)
+	} else if !result.Revoked {
+		t.Errorf("previous signing key not reported revoked")
+	}
+
+	if _, err := Rotate(db, oldKey, false, nil); err == nil {
+		t.Errorf("unexpected success while rotating to a previous signing key")
+	}
+
+	// previous signing key is kept and revoked
+	signingKeys, err := List(db)
+	if err != nil {
+		t.Fatalf("unexpected error while listing signing keys: %s", err)
+	} else if len(signingKeys) != 2 {
+		t.Fatalf("unexpected number of signing keys: got %d instead of 2", len(signingKeys))
+	}
+	current := Select(signingKeys)
+	if current == nil || current.PrimaryKey.Fingerprint != newSigningKey.PrimaryKey.Fingerprint {
+		t.Fatalf("new signing key is not the current signing key")
+	}
+	for _, e := range signingKeys {
+		if e.PrimaryKey.Fingerprint == oldKey.PrimaryKey.Fingerprint && len(e.Revocations) == 0 {
+			t.Errorf("revocation of previous signing key not stored")
+		}
+	}
+
+	// new signing key is cross-certified by the previous one
+	if !keyring.IdentityCertifiedBy(current, keyring.PrimaryIdentity(current), openpgp.EntityList{oldKey}) {
+		t.Errorf("new signing key not certified by previous signing key")
+	}
+
+	tests := []struct {
+		name      string
+		email     string
+		certified bool
+	}{
+		{"verified key", "verified@example.com", true},
+		{"unverified key", "unverified@example.com", false},
+	}
+
+	for _, tt := range tests {
+		el, err := db.Get(tt.email, database.SearchOptions{Exact: true})
+		if err != nil || len(el) != 1 {
+			t.Fatalf("unexpected error while retrieving %s: %v", tt.name, err)
+		}
+		e := el[0]
+		certified := keyring.IdentityCertifiedBy(e, keyring.PrimaryIdentity(e), openpgp.EntityList{current})
+		if certified != tt.certified {
+			t.Errorf("unexpected new signing key certification for %s: got %v instead of %v", tt.name, certified, tt.certified)
+		}
+		// certifications of the revoked previous signing key don't
+		// count anymore
+		for _, sk := range signingKeys {
+			if sk.PrimaryKey.Fingerprint != oldKey.PrimaryKey.Fingerprint {
+				continue
+			} else if keyring.IdentityCertifiedBy(e, keyring.PrimaryIdentity(e), openpgp.EntityList{sk}) {
+				t.Errorf("%s certified by the revoked previous signing key", tt.name)
+			}
+		}
+	}
+	// a rotation interrupted once the new signing key is stored
+	interrupted := newKey(t, "Admin", "admin@example.com", now.Add(time.Hour))
+	if err := CrossCertify(interrupted, current); err != nil {
+		t.Fatalf("unexpected error while cross-certifying signing key: %s", err)
+	}
+	if err := Add(db, openpgp.EntityList{interrupted}, nil); err != nil {
+		t.Fatalf("unexpected error while storing signing key: %s", err)
+	}
+
+	result, err = Rotate(db, interrupted, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error while resuming rotation: %s", err)
+	} else if !result.Resumed {
+		t.Errorf("interrupted rotation not resumed")
+	} else if result.Previous == nil || result.Previous.PrimaryKey.Fingerprint != newSigningKey.PrimaryKey.Fingerprint {
+		t.Errorf("unexpected previous signing key for interrupted rotation")
+	} else if result.Recertified != 1 {
+		t.Errorf("unexpected number of certified identities: got %d instead of 1", result.Recertified)
+	}
+}
+
+func TestMarkInUse(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	now := time.Now()
+
+	if err := Add(db, openpgp.EntityList{newKey(t, "Admin", "admin@example.com", now.Add(-time.Hour))}, nil); err != nil {
+		t.Fatalf("unexpected error while storing signing key: %s", err)
+	}
+
+	release, err := MarkInUse(db)
+	if err != nil {
+		t.Fatalf("unexpected error while marking signing key in use: %s", err)
+	}
+
+	// the signing key can't be rotated while the server runs
+	if _, err := Rotate(db, newKey(t, "Admin", "admin@example.com", now), false, nil); err == nil {
+		t.Fatalf("unexpected success while rotating signing key in use")
+	}
+
+	release()
+
+	if _, err := Rotate(db, newKey(t, "Admin", "admin@example.com", now), false, nil); err != nil {
+		t.Fatalf("unexpected error while rotating released signing key: %s", err)
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package signingkey
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/hkpserver"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// Select returns the current signing key among the signing keys, the
+// current signing key is the most recent key which is not revoked.
+func Select(el openpgp.EntityList) *openpgp.Entity {
+	var current *openpgp.Entity
+
+	for _, e := range el {
+		if len(e.Revocations) > 0 || e.PrivateKey == nil {
+			continue
+		}
+		if current == nil || e.PrimaryKey.CreationTime.After(current.PrimaryKey.CreationTime) {
+			current = e
+		}
+	}
+
+	return current
+}
+
+// List returns all the signing keys stored in the database, including
+// revoked and rotated keys.
+func List(db database.Engine) (openpgp.EntityList, error) {
+	el, err := db.Get("", database.SearchOptions{Fingerprint: true, KeyType: database.SigningKey})
+	if err != nil {
+		return nil, fmt.Errorf("while searching for signing key in database: %s", err)
+	}
+	return el, nil
+}
+
+// Current returns the current signing key stored in the database,
+// nil is returned if there is no usable signing key.
+func Current(db database.Engine) (*openpgp.Entity, error) {
+	el, err := List(db)
+	if err != nil {
+		return nil, err
+	}
+	return Select(el), nil
+}
+
+// read reads a signing key either base64 encoded or from a file.
+func read(key string) ([]byte, error) {
+	// look first if the signing key is provided as a base64 encoded string
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		b, err = ioutil.ReadFile(key)
+		if err != nil {
+			return nil, fmt.Errorf("while reading signing pgp key: %s", err)
+		}
+	}
+	return b, nil
+}
+
+// Decode reads a signing key either base64 encoded or from a file,
+// the key must be in armored ASCII format.
+func Decode(key string) (openpgp.EntityList, error) {
+	b, err := read(key)
+	if err != nil {
+		return nil, err
+	}
+	el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("while decoding signing pgp key: %s", err)
+	} else if len(el) == 0 {
+		return nil, fmt.Errorf("no signing key found")
+	}
+	return el, nil
+}
+
+// Check ensures that the key list contains exactly one key usable
+// as signing key, the private key may be encrypted.
+func Check(el openpgp.EntityList) error {
+	if len(el) != 1 {
+		return fmt.Errorf("found %d signing pgp key(s), only one can be set", len(el))
+	}
+
+	if el[0].PrivateKey == nil {
+		return fmt.Errorf("signing key requires private key")
+	}
+
+	return nil
+}
+
+// Unlock decrypts in memory the private keys of the signing key with
+// the passphrase, it's a no-op if the private keys are not encrypted.
+func Unlock(e *openpgp.Entity, passphrase []byte) error {
+	keys := []*packet.PrivateKey{e.PrivateKey}
+	for _, subkey := range e.Subkeys {
+		if subkey.PrivateKey != nil {
+			keys = append(keys, subkey.PrivateKey)
+		}
+	}
+
+	for _, k := range keys {
+		if !k.Encrypted {
+			continue
+		} else if len(passphrase) == 0 {
+			return fmt.Errorf("signing key %X is encrypted, a passphrase is required", e.PrimaryKey.Fingerprint[:])
+		}
+		if err := k.Decrypt(passphrase); err != nil {
+			return fmt.Errorf("while decrypting signing key %X: %s", e.PrimaryKey.Fingerprint[:], err)
+		}
+	}
+
+	return nil
+}
+
+// encrypt returns a copy of the signing key with its private keys
+// encrypted with the passphrase, the signing key itself is left
+// untouched so it remains usable.
+func encrypt(e *openpgp.Entity, passphrase []byte) (*openpgp.Entity, error) {
+	buf := new(bytes.Buffer)
+	if err := keyring.SerializePrivate(buf, e); err != nil {
+		return nil, err
+	}
+	el, err := openpgp.ReadKeyRing(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	c := el[0]
+	if !c.PrivateKey.Encrypted {
+		if err := c.PrivateKey.Encrypt(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	for _, subkey := range c.Subkeys {
+		if subkey.PrivateKey != nil && !subkey.PrivateKey.Encrypted {
+			if err := subkey.PrivateKey.Encrypt(passphrase); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// Add checks and stores the signing key in the database. When a
+// passphrase is provided, the private keys are stored encrypted with
+// the passphrase.
+func Add(db database.Engine, el openpgp.EntityList, passphrase []byte) error {
+	if err := Check(el); err != nil {
+		return err
+	}
+	if len(passphrase) == 0 {
+		return db.Add(el)
+	}
+
+	e, err := encrypt(el[0], passphrase)
+	if err != nil {
+		return fmt.Errorf("while encrypting signing key: %s", err)
+	}
+
+	return db.Add(openpgp.EntityList{e})
+}
+
+// DecodeSignatures reads signing keys signed by third parties either
+// base64 encoded or from a file, the keys must be in armored ASCII
+// format. The identity signatures the OpenPGP library can't parse are
+// returned separately, see keyring.SplitOpaqueSignatures.
+func DecodeSignatures(key string) (openpgp.EntityList, map[string]keyring.OpaqueSignatures, error) {
+	b, err := read(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := armor.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, fmt.Errorf("while decoding signing pgp key: %s", err)
+	}
+	keys, opaque, err := keyring.SplitOpaqueSignatures(block.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("while decoding signing pgp key: %s", err)
+	}
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(keys))
+	if err != nil {
+		return nil, nil, fmt.Errorf("while decoding signing pgp key: %s", err)
+	}
+	return el, opaque, nil
+}
+
+// ImportSignatures merges the keys with the stored signing keys sharing
+// their fingerprint, keys which are not signing keys are ignored. It's
+// used to publish the certifications issued by third parties over the
+// signing keys, like the trust signatures of an organisation key. The
+// opaque signatures are stored aside and published with the signing
+// keys. It returns the number of identity signatures imported.
+func ImportSignatures(db database.Engine, el openpgp.EntityList, opaque map[string]keyring.OpaqueSignatures) (int, error) {
+	signingKeys, err := List(db)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for _, sk := range signingKeys {
+		fp := fmt.Sprintf("%X", sk.PrimaryKey.Fingerprint[:])
+		before := identitySignatures(sk)
+
+		for _, e := range el {
+			if e.PrimaryKey.Fingerprint != sk.PrimaryKey.Fingerprint {
+				continue
+			}
+			if err := keyring.Merge(sk, e); err != nil {
+				return count, err
+			}
+		}
+
+		if imported := identitySignatures(sk) - before; imported > 0 {
+			// signing keys are stored as is, encrypted or not
+			if err := db.Add(openpgp.EntityList{sk}); err != nil {
+				return count, fmt.Errorf("while storing signing key %s: %s", fp, err)
+			}
+			count += imported
+		}
+
+		if len(opaque[fp]) == 0 {
+			continue
+		}
+		state, ok := database.GetStateEngine(db)
+		if !ok {
+			return count, fmt.Errorf("database engine doesn't support state storage required by opaque signatures")
+		}
+		stored, err := hkpserver.GetServerKeySignatures(state, fp)
+		if err != nil {
+			return count, err
+		}
+		imported := 0
+		for identity, sigs := range opaque[fp] {
+			if _, ok := sk.Identities[identity]; !ok {
+				continue
+			}
+			for _, sig := range sigs {
+				if stored.Add(identity, sig) {
+					imported++
+				}
+			}
+		}
+		if imported == 0 {
+			continue
+		}
+		if err := hkpserver.SetServerKeySignatures(state, fp, stored); err != nil {
+			return count, fmt.Errorf("while storing signing key %s signatures: %s", fp, err)
+		}
+		count += imported
+	}
+
+	return count, nil
+}
+
+func identitySignatures(e *openpgp.Entity) int {
+	n := 0
+	for _, id := range e.Identities {
+		n += len(id.Signatures)
+	}
+	return n
+}
+
+// Generate generates a new signing key for the admin email address.
+func Generate(adminEmail string) (*openpgp.Entity, error) {
+	conf := &packet.Config{RSABits: 4096, DefaultHash: crypto.SHA384}
+	e, err := openpgp.NewEntity("Admin", "Signing Key", adminEmail, conf)
+	if err != nil {
+		return nil, fmt.Errorf("while generating signing pgp key: %s", err)
+	}
+	return e, nil
+}
+
+// Load returns the current signing key from the database, if there is
+// none the configured signing key is stored and returned, otherwise a
+// new signing key is generated for the admin email address. Signing
+// keys are stored encrypted when a passphrase is provided, including
+// previously stored signing keys, and the returned signing key is
+// decrypted in memory with the passphrase.
+func Load(db database.Engine, configKey, adminEmail string, passphrase []byte) (*openpgp.Entity, error) {
+	el, err := List(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(passphrase) > 0 {
+		for _, e := range el {
+			if e.PrivateKey == nil || e.PrivateKey.Encrypted {
+				continue
+			}
+			logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).Info("Encrypting stored signing PGP key")
+			if err := Add(db, openpgp.EntityList{e}, passphrase); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if signingKey := Select(el); signingKey != nil {
+		return signingKey, Unlock(signingKey, passphrase)
+	}
+
+	if configKey != "" {
+		el, err := Decode(configKey)
+		if err != nil {
+			return nil, err
+		}
+		logrus.WithField("identity", el[0].PrimaryIdentity().Name).Info("Using signing PGP key")
+		if err := Add(db, el, passphrase); err != nil {
+			return nil, err
+		}
+		return el[0], Unlock(el[0], passphrase)
+	}
+
+	logrus.Info("Generating signing PGP key")
+
+	e, err := Generate(adminEmail)
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithField("fingerprint", e.PrimaryKey.KeyIdString()).Info("Signing PGP key generated")
+
+	if err := Add(db, openpgp.EntityList{e}, passphrase); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
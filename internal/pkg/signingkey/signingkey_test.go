@@ -0,0 +1,179 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package signingkey
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestSelect(t *testing.T) {
+	var el openpgp.EntityList
+
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		cfg := &packet.Config{Time: func() time.Time { return now.Add(time.Duration(i) * time.Hour) }}
+		e, err := openpgp.NewEntity("Admin", "Signing Key", "admin@example.com", cfg)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		el = append(el, e)
+	}
+
+	if current := Select(el); current != el[2] {
+		t.Errorf("most recent signing key not selected")
+	}
+
+	// revoked keys are never selected
+	el[2].Revocations = append(el[2].Revocations, &packet.Signature{SigType: packet.SigTypeKeyRevocation})
+	if current := Select(el); current != el[1] {
+		t.Errorf("revoked signing key selected")
+	}
+
+	// public keys can't be used as signing keys
+	el[1].PrivateKey = nil
+	if current := Select(el); current != el[0] {
+		t.Errorf("public key selected")
+	}
+
+	if current := Select(nil); current != nil {
+		t.Errorf("unexpected signing key selected from empty list")
+	}
+}
+
+func TestLoadPassphrase(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	passphrase := []byte("passphrase")
+
+	// signing key generated and stored in clear before a passphrase
+	// is configured
+	e, err := Load(db, "", "admin@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while loading signing key: %s", err)
+	}
+
+	tests := []struct {
+		name       string
+		passphrase []byte
+		wantErr    bool
+	}{
+		{"with passphrase", passphrase, false},
+		{"without passphrase", nil, true},
+		{"with wrong passphrase", []byte("wrong"), true},
+		{"with passphrase again", passphrase, false},
+	}
+
+	for _, tt := range tests {
+		signingKey, err := Load(db, "", "admin@example.com", tt.passphrase)
+		if err != nil && !tt.wantErr {
+			t.Fatalf("unexpected error while loading signing key %s: %s", tt.name, err)
+		} else if err == nil && tt.wantErr {
+			t.Fatalf("unexpected success while loading signing key %s", tt.name)
+		} else if err != nil {
+			continue
+		}
+
+		if signingKey.PrimaryKey.Fingerprint != e.PrimaryKey.Fingerprint {
+			t.Fatalf("unexpected signing key loaded %s", tt.name)
+		} else if signingKey.PrivateKey.Encrypted {
+			t.Errorf("signing key loaded %s is not decrypted", tt.name)
+		}
+
+		// the signing key is kept encrypted in the database
+		el, err := List(db)
+		if err != nil {
+			t.Fatalf("unexpected error while listing signing keys: %s", err)
+		} else if len(el) != 1 || !el[0].PrivateKey.Encrypted {
+			t.Errorf("signing key not stored encrypted %s", tt.name)
+		}
+	}
+}
+
+func TestImportSignatures(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	passphrase := []byte("passphrase")
+
+	signingKey, err := Load(db, "", "admin@example.com", passphrase)
+	if err != nil {
+		t.Fatalf("unexpected error while loading signing key: %s", err)
+	}
+	org := newKey(t, "Organisation", "pgp@example.com", time.Now())
+
+	// public export of the signing key trust signed by the organisation
+	b := new(bytes.Buffer)
+	if err := keyring.Serialize(b, signingKey); err != nil {
+		t.Fatalf("unexpected error while serializing signing key: %s", err)
+	}
+	el, err := openpgp.ReadKeyRing(b)
+	if err != nil {
+		t.Fatalf("unexpected error while reading signing key: %s", err)
+	}
+	trust := &keyring.Trust{Amount: keyring.CompleteTrust, Domains: []string{"example.com"}}
+	if err := keyring.TrustCertify(el[0], keyring.PrimaryIdentity(el[0]).Name, org, 0, trust); err != nil {
+		t.Fatalf("unexpected error while trust signing signing key: %s", err)
+	}
+	// keys which are not signing keys are ignored
+	el = append(el, org)
+
+	tests := []struct {
+		name  string
+		count int
+	}{
+		{"import", 1},
+		{"import again", 0},
+	}
+
+	for _, tt := range tests {
+		count, err := ImportSignatures(db, el, nil)
+		if err != nil {
+			t.Fatalf("unexpected error while importing signatures for %s: %s", tt.name, err)
+		} else if count != tt.count {
+			t.Errorf("unexpected number of signatures imported for %s: got %d instead of %d", tt.name, count, tt.count)
+		}
+	}
+
+	fp := fmt.Sprintf("%X", signingKey.PrimaryKey.Fingerprint[:])
+	for _, kt := range []database.KeyType{database.SigningKey, database.PublicKey} {
+		stored, err := db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true, KeyType: kt})
+		if err != nil || len(stored) != 1 {
+			t.Fatalf("unexpected error while retrieving signing key: %v", err)
+		}
+		id := keyring.PrimaryIdentity(stored[0])
+		if !keyring.IdentityCertifiedBy(stored[0], id, openpgp.EntityList{org}) {
+			t.Errorf("organisation trust signature not stored")
+		}
+		if kt == database.SigningKey && !stored[0].PrivateKey.Encrypted {
+			t.Errorf("signing key not stored encrypted")
+		}
+	}
+
+	if el, err := db.Get(fmt.Sprintf("%X", org.PrimaryKey.Fingerprint[:]), database.SearchOptions{Fingerprint: true, Exact: true}); err != nil || len(el) != 0 {
+		t.Errorf("unexpected key stored")
+	}
+}
@@ -0,0 +1,655 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package sqldb
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+
+	// SQLite driver without cgo
+	_ "modernc.org/sqlite"
+)
+
+const (
+	Name = "sql"
+)
+
+const (
+	// DefaultDriver is the database/sql driver used by default.
+	DefaultDriver = "sqlite"
+)
+
+const (
+	// normalizationKey is the state key recording how the stored
+	// user IDs are normalized.
+	normalizationKey = "sqldb" + database.StateSep + "normalization"
+	// normalizationVersion is increased when the normalization of
+	// user IDs changes, so the stored user IDs are normalized again.
+	normalizationVersion = 1
+)
+
+const (
+	databaseDriverEnv = "SPKS_DBCONFIG_DRIVER"
+	databaseDSNEnv    = "SPKS_DBCONFIG_DSN"
+)
+
+// schema creates the database tables, it's kept portable between
+// SQLite and PostgreSQL: keys and state values are stored base64
+// encoded and booleans as integers. User ID names and emails are
+// stored normalized for searches with the local part folding of the
+// database, see database.LocalPartFolding.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS keys (
+		fingerprint TEXT PRIMARY KEY,
+		key_id TEXT NOT NULL,
+		created BIGINT NOT NULL,
+		data TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS keys_key_id ON keys (key_id)`,
+	`CREATE TABLE IF NOT EXISTS signing_keys (
+		fingerprint TEXT PRIMARY KEY REFERENCES keys (fingerprint),
+		data TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_ids (
+		fingerprint TEXT NOT NULL REFERENCES keys (fingerprint),
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		email TEXT NOT NULL,
+		is_primary INTEGER NOT NULL,
+		PRIMARY KEY (fingerprint, user_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS user_ids_name ON user_ids (name)`,
+	`CREATE INDEX IF NOT EXISTS user_ids_email ON user_ids (email)`,
+	// a subkey may be bound to several keys, a key can't take
+	// over the subkey of another key
+	`CREATE TABLE IF NOT EXISTS subkeys (
+		fingerprint TEXT NOT NULL,
+		key_id TEXT NOT NULL,
+		primary_fingerprint TEXT NOT NULL REFERENCES keys (fingerprint),
+		created BIGINT NOT NULL,
+		PRIMARY KEY (fingerprint, primary_fingerprint)
+	)`,
+	`CREATE INDEX IF NOT EXISTS subkeys_key_id ON subkeys (key_id)`,
+	`CREATE INDEX IF NOT EXISTS subkeys_primary_fingerprint ON subkeys (primary_fingerprint)`,
+	`CREATE TABLE IF NOT EXISTS certifications (
+		fingerprint TEXT NOT NULL REFERENCES keys (fingerprint),
+		user_id TEXT NOT NULL,
+		issuer_key_id TEXT NOT NULL,
+		sig_type INTEGER NOT NULL,
+		created BIGINT NOT NULL,
+		expires BIGINT
+	)`,
+	`CREATE INDEX IF NOT EXISTS certifications_fingerprint ON certifications (fingerprint)`,
+	`CREATE INDEX IF NOT EXISTS certifications_issuer_key_id ON certifications (issuer_key_id)`,
+	`CREATE TABLE IF NOT EXISTS state (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		expires BIGINT
+	)`,
+}
+
+// keyTables are the tables holding the key records, children tables
+// first.
+var keyTables = []struct {
+	name   string
+	column string
+}{
+	{"certifications", "fingerprint"},
+	{"subkeys", "primary_fingerprint"},
+	{"user_ids", "fingerprint"},
+	{"signing_keys", "fingerprint"},
+	{"keys", "fingerprint"},
+}
+
+type Config struct {
+	// Driver is the database/sql driver name.
+	Driver string `yaml:"driver"`
+	// DSN is the driver data source name, for SQLite the path
+	// of the database file.
+	DSN string `yaml:"dsn"`
+}
+
+type sqlDB struct {
+	db      *sql.DB
+	cfg     Config
+	folding database.LocalPartFolding
+}
+
+func (s *sqlDB) NewConfig() database.Config {
+	return &s.cfg
+}
+
+func (s *sqlDB) CheckConfig() error {
+	if env := os.Getenv(databaseDriverEnv); env != "" {
+		s.cfg.Driver = env
+	}
+	if env := os.Getenv(databaseDSNEnv); env != "" {
+		s.cfg.DSN = env
+	}
+	if s.cfg.Driver == "" {
+		s.cfg.Driver = DefaultDriver
+	}
+
+	for _, d := range sql.Drivers() {
+		if d == s.cfg.Driver {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown sql database driver %s", s.cfg.Driver)
+}
+
+// SetLocalPartFolding sets the folding used to normalize identities.
+func (s *sqlDB) SetLocalPartFolding(f database.LocalPartFolding) {
+	s.folding = f
+}
+
+func (s *sqlDB) Connect() error {
+	var err error
+
+	driver := s.cfg.Driver
+	if driver == "" {
+		driver = DefaultDriver
+	}
+	dsn := s.cfg.DSN
+	if dsn == "" && driver == DefaultDriver {
+		dsn = ":memory:"
+	}
+
+	s.db, err = sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	if driver == DefaultDriver {
+		// SQLite allows a single writer and in-memory databases
+		// are private to their connection
+		s.db.SetMaxOpenConns(1)
+	}
+
+	for _, stmt := range schema {
+		if _, err := s.db.Exec(stmt); err != nil {
+			s.db.Close()
+			return fmt.Errorf("while creating database schema: %s", err)
+		}
+	}
+
+	if err := s.normalizeUserIDs(); err != nil {
+		s.db.Close()
+		return fmt.Errorf("while normalizing user IDs: %s", err)
+	}
+
+	return nil
+}
+
+// normalizeUserIDs normalizes again the searched names and email
+// addresses of the stored user IDs when they were normalized by a
+// previous version or with another local part folding. The applied
+// normalization is recorded in the state table so it only runs once.
+func (s *sqlDB) normalizeUserIDs() error {
+	folding := s.folding
+	if folding == "" {
+		folding = database.FullFolding
+	}
+	normalization := fmt.Sprintf("%d:%s", normalizationVersion, folding)
+
+	if b, err := s.GetState(normalizationKey); err == nil && string(b) == normalization {
+		return nil
+	} else if err != nil && err != database.ErrNotFound {
+		return err
+	}
+
+	type userID struct {
+		fingerprint, userID, name, email string
+	}
+
+	rows, err := s.db.Query("SELECT fingerprint, data FROM keys")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ids []userID
+
+	// user IDs are normalized from the stored keys, the stored
+	// names and emails may have lost their case
+	for rows.Next() {
+		var fp, data string
+		if err := rows.Scan(&fp, &data); err != nil {
+			return err
+		}
+		e, err := unmarshalEntity(data)
+		if err != nil {
+			return fmt.Errorf("while reading key %s: %s", fp, err)
+		}
+		for _, id := range e.Identities {
+			name, email := s.folding.Normalize(id.UserId.Name), s.folding.Normalize(id.UserId.Email)
+			ids = append(ids, userID{fp, id.Name, name, email})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	err = s.update(func(tx *sql.Tx) error {
+		for _, id := range ids {
+			_, err := tx.Exec(
+				"UPDATE user_ids SET name = $1, email = $2 WHERE fingerprint = $3 AND user_id = $4",
+				id.name, id.email, id.fingerprint, id.userID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.SetState(normalizationKey, []byte(normalization), 0)
+}
+
+func (s *sqlDB) Disconnect() error {
+	return s.db.Close()
+}
+
+// Volatile reports whether the keys are only kept in memory, SQLite
+// databases are in-memory without DSN or with a memory DSN.
+func (s *sqlDB) Volatile() bool {
+	if s.cfg.Driver != "" && s.cfg.Driver != DefaultDriver {
+		return false
+	}
+	dsn := s.cfg.DSN
+	if dsn == "" || dsn == ":memory:" || strings.HasPrefix(dsn, "file::memory:") {
+		return true
+	}
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		query, err := url.ParseQuery(dsn[i+1:])
+		return err == nil && query.Get("mode") == "memory"
+	}
+	return false
+}
+
+func (s *sqlDB) Add(el openpgp.EntityList) error {
+	return s.update(func(tx *sql.Tx) error {
+		for _, e := range el {
+			if err := s.addEntity(tx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlDB) Del(el openpgp.EntityList) error {
+	return s.update(func(tx *sql.Tx) error {
+		for _, e := range el {
+			if err := delEntity(tx, fingerprint(e.PrimaryKey)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlDB) Get(search string, opts database.SearchOptions) (openpgp.EntityList, error) {
+	table := "keys"
+	if opts.KeyType == database.SigningKey {
+		table = "signing_keys"
+	}
+
+	if opts.Fingerprint {
+		fp, err := hex.DecodeString(search)
+		if err != nil {
+			return nil, err
+		}
+		hexFp := fmt.Sprintf("%X", fp)
+
+		// keys are also found by their subkeys
+		switch len(fp) {
+		case 4:
+			// short key IDs match the end of key IDs
+			return s.query(table, opts, `SELECT fingerprint FROM keys WHERE key_id LIKE $1
+				UNION SELECT primary_fingerprint FROM subkeys WHERE key_id LIKE $1`, "%"+hexFp)
+		case 8:
+			return s.query(table, opts, `SELECT fingerprint FROM keys WHERE key_id = $1
+				UNION SELECT primary_fingerprint FROM subkeys WHERE key_id = $1`, hexFp)
+		case 20:
+			return s.query(table, opts, `SELECT fingerprint FROM keys WHERE fingerprint = $1
+				UNION SELECT primary_fingerprint FROM subkeys WHERE fingerprint = $1`, hexFp)
+		default:
+			// allow to query the signing key internally
+			// without specifying a fingerprint
+			if opts.KeyType != database.SigningKey {
+				return nil, fmt.Errorf("fingerprint must be either 4, 8 or 20 bytes length")
+			}
+			return s.query(table, opts, "SELECT fingerprint FROM keys")
+		}
+	}
+
+	// user IDs are stored normalized
+	search = s.folding.Normalize(search)
+
+	if !opts.Exact {
+		pattern := "%" + escapeLike(search) + "%"
+		return s.query(table, opts, `SELECT fingerprint FROM user_ids WHERE name LIKE $1 ESCAPE '\' OR email LIKE $1 ESCAPE '\'`, pattern)
+	}
+
+	// first search for email then for name
+	return s.query(table, opts, `SELECT fingerprint FROM user_ids WHERE email = $1
+		UNION SELECT fingerprint FROM user_ids WHERE name = $1
+		AND NOT EXISTS (SELECT 1 FROM user_ids WHERE email = $1)`, search)
+}
+
+// query returns the keys stored in the table whose fingerprint is
+// returned by the fingerprint query, within the bounds of the search
+// options.
+func (s *sqlDB) query(table string, opts database.SearchOptions, fpQuery string, args ...interface{}) (openpgp.EntityList, error) {
+	q := fmt.Sprintf("SELECT data FROM %s WHERE fingerprint IN (%s) ORDER BY fingerprint", table, fpQuery)
+
+	// SQLite doesn't accept an offset without limit, the rows before
+	// the offset are then skipped while reading the keys
+	skip := 0
+	if opts.Limit > 0 {
+		offset := 0
+		if opts.Offset > 0 {
+			offset = opts.Offset
+		}
+		q += fmt.Sprintf(" LIMIT %d OFFSET %d", opts.Limit, offset)
+	} else if opts.Offset > 0 {
+		skip = opts.Offset
+	}
+
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var el openpgp.EntityList
+
+	for rows.Next() {
+		if skip > 0 {
+			skip--
+			continue
+		}
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		e, err := unmarshalEntity(data)
+		if err != nil {
+			return nil, err
+		}
+		el = append(el, e)
+	}
+
+	return el, rows.Err()
+}
+
+// update runs fn within a transaction committed if fn succeeds.
+func (s *sqlDB) update(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlDB) SetState(key string, value []byte, ttl time.Duration) error {
+	var expires sql.NullInt64
+	if ttl > 0 {
+		expires = sql.NullInt64{Int64: time.Now().Add(ttl).UnixNano(), Valid: true}
+	}
+
+	_, err := s.db.Exec(
+		`INSERT INTO state (name, value, expires) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET value = excluded.value, expires = excluded.expires`,
+		key, base64.StdEncoding.EncodeToString(value), expires,
+	)
+	return err
+}
+
+func (s *sqlDB) GetState(key string) ([]byte, error) {
+	var value string
+
+	err := s.db.QueryRow(
+		"SELECT value FROM state WHERE name = $1 AND (expires IS NULL OR expires > $2)",
+		key, time.Now().UnixNano(),
+	).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, database.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(value)
+}
+
+func (s *sqlDB) DelState(key string) error {
+	_, err := s.db.Exec("DELETE FROM state WHERE name = $1", key)
+	return err
+}
+
+func (s *sqlDB) ListState(prefix string, fn func(key string, value []byte) bool) error {
+	type stateValue struct {
+		key   string
+		value []byte
+	}
+
+	rows, err := s.db.Query(
+		`SELECT name, value FROM state WHERE name LIKE $1 ESCAPE '\' AND (expires IS NULL OR expires > $2) ORDER BY name`,
+		escapeLike(prefix)+"%", time.Now().UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// values are read first so fn can access the database
+	var values []stateValue
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		values = append(values, stateValue{key, b})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, v := range values {
+		if !fn(v.key, v.value) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Compact removes the expired state values and rebuilds the database
+// to reclaim unused space.
+func (s *sqlDB) Compact() error {
+	if _, err := s.db.Exec("DELETE FROM state WHERE expires <= $1", time.Now().UnixNano()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("VACUUM")
+	return err
+}
+
+func (s *sqlDB) addEntity(tx *sql.Tx, e *openpgp.Entity) error {
+	if len(e.Identities) == 0 {
+		return fmt.Errorf("no suitable identity found")
+	}
+
+	fp := fingerprint(e.PrimaryKey)
+
+	data, err := marshalEntity(e, false)
+	if err != nil {
+		return err
+	}
+
+	// the key material is replaced, children records are rebuilt
+	for _, t := range keyTables[:3] {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = $1", t.name, t.column), fp); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO keys (fingerprint, key_id, created, data) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (fingerprint) DO UPDATE SET data = excluded.data`,
+		fp, e.PrimaryKey.KeyIdString(), e.PrimaryKey.CreationTime.Unix(), data,
+	)
+	if err != nil {
+		return err
+	}
+
+	// key entity with a private part is a signing key
+	if e.PrivateKey != nil {
+		data, err := marshalEntity(e, true)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`INSERT INTO signing_keys (fingerprint, data) VALUES ($1, $2)
+			ON CONFLICT (fingerprint) DO UPDATE SET data = excluded.data`,
+			fp, data,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	primary := keyring.PrimaryIdentity(e)
+
+	for _, id := range keyring.SortedIdentities(e) {
+		isPrimary := 0
+		if id == primary {
+			isPrimary = 1
+		}
+		_, err := tx.Exec(
+			"INSERT INTO user_ids (fingerprint, user_id, name, email, is_primary) VALUES ($1, $2, $3, $4, $5)",
+			fp, id.Name, s.folding.Normalize(id.UserId.Name), s.folding.Normalize(id.UserId.Email), isPrimary,
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, sig := range id.Signatures {
+			// self signatures aren't certifications
+			if sig.IssuerKeyId == nil || *sig.IssuerKeyId == e.PrimaryKey.KeyId {
+				continue
+			}
+			var expires sql.NullInt64
+			if sig.SigLifetimeSecs != nil && *sig.SigLifetimeSecs != 0 {
+				t := sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs) * time.Second)
+				expires = sql.NullInt64{Int64: t.Unix(), Valid: true}
+			}
+			_, err := tx.Exec(
+				"INSERT INTO certifications (fingerprint, user_id, issuer_key_id, sig_type, created, expires) VALUES ($1, $2, $3, $4, $5, $6)",
+				fp, id.Name, fmt.Sprintf("%016X", *sig.IssuerKeyId), int(sig.SigType), sig.CreationTime.Unix(), expires,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the same subkey bound to other keys remains indexed for them
+	added := make(map[string]bool)
+
+	for _, subkey := range e.Subkeys {
+		subFp := fingerprint(subkey.PublicKey)
+		if added[subFp] {
+			continue
+		}
+		added[subFp] = true
+
+		_, err := tx.Exec(
+			"INSERT INTO subkeys (fingerprint, key_id, primary_fingerprint, created) VALUES ($1, $2, $3, $4)",
+			subFp, subkey.PublicKey.KeyIdString(), fp, subkey.PublicKey.CreationTime.Unix(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func delEntity(tx *sql.Tx, fp string) error {
+	for _, t := range keyTables {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = $1", t.name, t.column), fp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fingerprint(pk *packet.PublicKey) string {
+	return fmt.Sprintf("%X", pk.Fingerprint[:])
+}
+
+// escapeLike escapes the LIKE pattern special characters.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func marshalEntity(e *openpgp.Entity, private bool) (string, error) {
+	buf := new(bytes.Buffer)
+
+	if private {
+		if err := keyring.SerializePrivate(buf, e); err != nil {
+			return "", err
+		}
+	} else if err := keyring.Serialize(buf, e); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func unmarshalEntity(data string) (*openpgp.Entity, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(b)))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func init() {
+	db := new(sqlDB)
+	database.RegisterDatabaseEngine(Name, db)
+}
@@ -0,0 +1,361 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package sqldb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+)
+
+func newDB(t *testing.T) *sqlDB {
+	db := new(sqlDB)
+	if err := db.CheckConfig(); err != nil {
+		t.Fatalf("unexpected error while checking configuration: %s", err)
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	return db
+}
+
+func TestGet(t *testing.T) {
+	db := newDB(t)
+	defer db.Disconnect()
+
+	var el openpgp.EntityList
+
+	for _, name := range []string{"Alice", "Bob", "Bob_"} {
+		e, err := openpgp.NewEntity(name, "", fmt.Sprintf("%s@example.com", name), nil)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		el = append(el, e)
+	}
+	signingKey := el[0]
+
+	// public keys are stored without their private part
+	if err := db.Add(openpgp.EntityList{signingKey}); err != nil {
+		t.Fatalf("unexpected error while adding signing key: %s", err)
+	}
+	for _, e := range el[1:] {
+		if err := keyring.Certify(e, keyring.PrimaryIdentity(e).Name, signingKey, 0); err != nil {
+			t.Fatalf("unexpected error while certifying key: %s", err)
+		}
+		e.PrivateKey = nil
+	}
+	if err := db.Add(el[1:]); err != nil {
+		t.Fatalf("unexpected error while adding keys: %s", err)
+	}
+
+	fp := func(e *openpgp.Entity) string {
+		return fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+	}
+	subkeyFp := func(e *openpgp.Entity) string {
+		return fmt.Sprintf("%X", e.Subkeys[0].PublicKey.Fingerprint[:])
+	}
+
+	tests := []struct {
+		name          string
+		search        string
+		isFingerprint bool
+		exact         bool
+		kt            database.KeyType
+		keys          []*openpgp.Entity
+		wantErr       bool
+	}{
+		{"fingerprint", fp(el[1]), true, true, database.PublicKey, el[1:2], false},
+		{"key id", fp(el[1])[24:], true, true, database.PublicKey, el[1:2], false},
+		{"short key id", fp(el[1])[32:], true, false, database.PublicKey, el[1:2], false},
+		{"subkey fingerprint", subkeyFp(el[1]), true, true, database.PublicKey, el[1:2], false},
+		{"subkey id", subkeyFp(el[1])[24:], true, true, database.PublicKey, el[1:2], false},
+		{"short subkey id", subkeyFp(el[1])[32:], true, false, database.PublicKey, el[1:2], false},
+		{"unknown fingerprint", "0123456789ABCDEF", true, true, database.PublicKey, nil, false},
+		{"invalid fingerprint", "0123", true, true, database.PublicKey, nil, true},
+		{"exact email", "Bob@example.com", false, true, database.PublicKey, el[1:2], false},
+		{"case insensitive email", "BOB@Example.COM", false, true, database.PublicKey, el[1:2], false},
+		{"case insensitive substring", "ALICE", false, false, database.PublicKey, el[:1], false},
+		{"exact name", "Bob_", false, true, database.PublicKey, el[2:3], false},
+		{"substring", "Bob", false, false, database.PublicKey, el[1:], false},
+		{"escaped substring", "b_@", false, false, database.PublicKey, el[2:3], false},
+		{"all keys", "", false, false, database.PublicKey, el, false},
+		{"signing keys", "", true, false, database.SigningKey, el[:1], false},
+		{"signing key email", "Alice@example.com", false, true, database.SigningKey, el[:1], false},
+		{"not a signing key", fp(el[1]), true, true, database.SigningKey, nil, false},
+	}
+
+	for _, tt := range tests {
+		keys, err := db.Get(tt.search, database.SearchOptions{Fingerprint: tt.isFingerprint, Exact: tt.exact, KeyType: tt.kt})
+		if err != nil && !tt.wantErr {
+			t.Errorf("unexpected error for %s: %s", tt.name, err)
+			continue
+		} else if err == nil && tt.wantErr {
+			t.Errorf("unexpected success for %s", tt.name)
+			continue
+		}
+
+		found := make(map[string]bool)
+		for _, e := range keys {
+			found[fp(e)] = true
+		}
+		if len(found) != len(tt.keys) {
+			t.Errorf("unexpected number of keys for %s: got %d instead of %d", tt.name, len(found), len(tt.keys))
+			continue
+		}
+		for _, e := range tt.keys {
+			if !found[fp(e)] {
+				t.Errorf("key %s not returned for %s", fp(e), tt.name)
+			}
+		}
+	}
+
+	// pages follow the order of the matching keys
+	all, err := db.Get("", database.SearchOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error while getting keys: %s", err)
+	}
+	for i := range all {
+		keys, err := db.Get("", database.SearchOptions{Offset: i, Limit: 1})
+		if err != nil {
+			t.Fatalf("unexpected error while getting page %d: %s", i, err)
+		} else if len(keys) != 1 || fp(keys[0]) != fp(all[i]) {
+			t.Errorf("unexpected keys for page %d", i)
+		}
+	}
+	if keys, _ := db.Get("", database.SearchOptions{Offset: 1}); len(keys) != len(all)-1 {
+		t.Errorf("unexpected number of keys after offset: got %d instead of %d", len(keys), len(all)-1)
+	}
+	if keys, _ := db.Get("", database.SearchOptions{Offset: len(all)}); len(keys) != 0 {
+		t.Errorf("unexpected number of keys past the last page: got %d instead of 0", len(keys))
+	}
+
+	// certifications survive storage
+	keys, err := db.Get(fp(el[1]), database.SearchOptions{Fingerprint: true, Exact: true})
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("unexpected error while getting key: %v", err)
+	}
+	if !keyring.IdentityCertifiedBy(keys[0], keyring.PrimaryIdentity(keys[0]), el[:1]) {
+		t.Errorf("certification not stored")
+	}
+	var count int
+	if err := db.db.QueryRow("SELECT COUNT(*) FROM certifications WHERE fingerprint = $1", fp(el[1])).Scan(&count); err != nil {
+		t.Fatalf("unexpected error while counting certifications: %s", err)
+	} else if count != 1 {
+		t.Errorf("unexpected number of certifications: got %d instead of 1", count)
+	}
+
+	// updates replace the stored key
+	if err := db.Add(el[1:2]); err != nil {
+		t.Fatalf("unexpected error while updating key: %s", err)
+	}
+	if keys, _ := db.Get("", database.SearchOptions{}); len(keys) != len(el) {
+		t.Errorf("unexpected number of keys after update: got %d instead of %d", len(keys), len(el))
+	}
+
+	if err := db.Del(el[:2]); err != nil {
+		t.Fatalf("unexpected error while deleting keys: %s", err)
+	}
+	if keys, _ := db.Get("", database.SearchOptions{}); len(keys) != 1 {
+		t.Errorf("unexpected number of keys after deletion: got %d instead of 1", len(keys))
+	}
+	if keys, _ := db.Get("", database.SearchOptions{Fingerprint: true, KeyType: database.SigningKey}); len(keys) != 0 {
+		t.Errorf("signing key not deleted")
+	}
+	for _, table := range []string{"user_ids", "subkeys", "certifications"} {
+		if err := db.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatalf("unexpected error while counting %s: %s", table, err)
+		} else if count != 1 {
+			t.Errorf("unexpected number of %s after deletion: got %d instead of 1", table, count)
+		}
+	}
+}
+
+func TestSubkeys(t *testing.T) {
+	db := newDB(t)
+	defer db.Disconnect()
+
+	var el openpgp.EntityList
+
+	for _, name := range []string{"Owner", "Thief"} {
+		e, err := openpgp.NewEntity(name, "", fmt.Sprintf("%s@example.com", name), nil)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		el = append(el, e)
+	}
+	owner, thief := el[0], el[1]
+	subkeyFp := fmt.Sprintf("%X", owner.Subkeys[0].PublicKey.Fingerprint[:])
+
+	// the thief binds the owner subkey to its key
+	sig := *thief.Subkeys[0].Sig
+	if err := sig.SignKey(owner.Subkeys[0].PublicKey, thief.PrivateKey, nil); err != nil {
+		t.Fatalf("unexpected error while binding subkey: %s", err)
+	}
+	thief.Subkeys = append(thief.Subkeys, openpgp.Subkey{
+		PublicKey: owner.Subkeys[0].PublicKey,
+		Sig:       &sig,
+	})
+	for _, e := range el {
+		e.PrivateKey = nil
+	}
+
+	if err := db.Add(el); err != nil {
+		t.Fatalf("unexpected error while adding keys: %s", err)
+	}
+
+	var count int
+
+	query := "SELECT COUNT(*) FROM subkeys WHERE fingerprint = $1"
+	if err := db.db.QueryRow(query, subkeyFp).Scan(&count); err != nil {
+		t.Fatalf("unexpected error while counting subkeys: %s", err)
+	} else if count != 2 {
+		t.Errorf("unexpected number of keys bound to shared subkey: got %d instead of 2", count)
+	}
+
+	if err := db.Del(el[1:]); err != nil {
+		t.Fatalf("unexpected error while deleting key: %s", err)
+	}
+	query = "SELECT COUNT(*) FROM subkeys WHERE fingerprint = $1 AND primary_fingerprint = $2"
+	ownerFp := fmt.Sprintf("%X", owner.PrimaryKey.Fingerprint[:])
+	if err := db.db.QueryRow(query, subkeyFp, ownerFp).Scan(&count); err != nil {
+		t.Fatalf("unexpected error while counting subkeys: %s", err)
+	} else if count != 1 {
+		t.Errorf("owner subkey lost with the other key")
+	}
+}
+
+func TestState(t *testing.T) {
+	db := newDB(t)
+	defer db.Disconnect()
+
+	var _ database.StateEngine = db
+	var _ database.Compacter = db
+
+	if err := db.SetState("test:a", []byte("a"), 0); err != nil {
+		t.Fatalf("unexpected error while setting state: %s", err)
+	}
+	if err := db.SetState("test:b", []byte("b"), time.Hour); err != nil {
+		t.Fatalf("unexpected error while setting state: %s", err)
+	}
+	if err := db.SetState("test:c", []byte("c"), time.Millisecond); err != nil {
+		t.Fatalf("unexpected error while setting state: %s", err)
+	}
+	if err := db.SetState("other", []byte("other"), 0); err != nil {
+		t.Fatalf("unexpected error while setting state: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// values are replaced
+	if err := db.SetState("test:a", []byte("A"), 0); err != nil {
+		t.Fatalf("unexpected error while setting state: %s", err)
+	}
+	if v, err := db.GetState("test:a"); err != nil || string(v) != "A" {
+		t.Errorf("unexpected state value: %q (%v)", v, err)
+	}
+	if _, err := db.GetState("test:c"); err != database.ErrNotFound {
+		t.Errorf("expired state value returned")
+	}
+
+	var keys []string
+	err := db.ListState("test:", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		// the database remains accessible during the iteration
+		return db.DelState(key) == nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error while listing state: %s", err)
+	} else if len(keys) != 2 || keys[0] != "test:a" || keys[1] != "test:b" {
+		t.Errorf("unexpected state keys listed: %v", keys)
+	}
+	if _, err := db.GetState("test:b"); err != database.ErrNotFound {
+		t.Errorf("state value not deleted")
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("unexpected error while compacting database: %s", err)
+	}
+	if v, err := db.GetState("other"); err != nil || string(v) != "other" {
+		t.Errorf("unexpected state value after compaction: %q (%v)", v, err)
+	}
+}
+
+func TestVolatile(t *testing.T) {
+	var _ database.Volatile = new(sqlDB)
+
+	tests := []struct {
+		cfg      Config
+		volatile bool
+	}{
+		{Config{}, true},
+		{Config{DSN: ":memory:"}, true},
+		{Config{DSN: "file::memory:?cache=shared"}, true},
+		{Config{DSN: "file:spks?mode=memory&cache=shared"}, true},
+		{Config{DSN: "/var/lib/spks/spks.db"}, false},
+		{Config{DSN: "file:/var/lib/spks/spks.db?mode=rwc"}, false},
+		{Config{Driver: "postgres", DSN: ""}, false},
+	}
+
+	for _, tt := range tests {
+		db := &sqlDB{cfg: tt.cfg}
+		if v := db.Volatile(); v != tt.volatile {
+			t.Errorf("unexpected volatile flag for %+v: got %v instead of %v", tt.cfg, v, tt.volatile)
+		}
+	}
+}
+
+func TestNormalizeUserIDs(t *testing.T) {
+	db := newDB(t)
+	defer db.Disconnect()
+
+	var _ database.Normalizer = db
+
+	e, err := openpgp.NewEntity("Alice", "", "Alice@Example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	e.PrivateKey = nil
+	if err := db.Add(openpgp.EntityList{e}); err != nil {
+		t.Fatalf("unexpected error while adding key: %s", err)
+	}
+
+	email := func() string {
+		var email string
+		if err := db.db.QueryRow("SELECT email FROM user_ids").Scan(&email); err != nil {
+			t.Fatalf("unexpected error while reading user ID: %s", err)
+		}
+		return email
+	}
+	if got := email(); got != "alice@example.com" {
+		t.Errorf("unexpected stored email: got %s instead of alice@example.com", got)
+	}
+
+	// user IDs are only normalized again when the normalization changes
+	if _, err := db.db.Exec("UPDATE user_ids SET email = 'unchanged'"); err != nil {
+		t.Fatalf("unexpected error while updating user ID: %s", err)
+	}
+	if err := db.normalizeUserIDs(); err != nil {
+		t.Fatalf("unexpected error while normalizing user IDs: %s", err)
+	}
+	if got := email(); got != "unchanged" {
+		t.Errorf("user IDs normalized again: got %s", got)
+	}
+
+	db.SetLocalPartFolding(database.NoFolding)
+	if err := db.normalizeUserIDs(); err != nil {
+		t.Fatalf("unexpected error while normalizing user IDs: %s", err)
+	}
+	if got := email(); got != "Alice@example.com" {
+		t.Errorf("unexpected stored email: got %s instead of Alice@example.com", got)
+	}
+	if keys, _ := db.Get("Alice@example.com", database.SearchOptions{Exact: true}); len(keys) != 1 {
+		t.Errorf("key not found with case-sensitive local part")
+	}
+	if keys, _ := db.Get("alice@example.com", database.SearchOptions{Exact: true}); len(keys) != 0 {
+		t.Errorf("key found with another local part case")
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package database
+
+// Compacter is an optional interface implemented by database engines
+// able to reclaim the space used by deleted or updated records.
+type Compacter interface {
+	// Compact compacts the database storage.
+	Compact() error
+}
+
+// GetCompacter returns the compacter implemented by the database
+// engine if any.
+func GetCompacter(db Engine) (Compacter, bool) {
+	c, ok := db.(Compacter)
+	return c, ok
+}
@@ -18,6 +18,38 @@ const (
 	SigningKey
 )
 
+// SearchOptions describes how keys are searched and which part of the
+// matching keys is returned.
+type SearchOptions struct {
+	// Fingerprint searches keys by fingerprint or key ID instead of
+	// user ID.
+	Fingerprint bool
+	// Exact only returns the keys matching the search exactly.
+	Exact bool
+	// KeyType is the type of the searched keys.
+	KeyType KeyType
+	// Offset is the number of matching keys skipped.
+	Offset int
+	// Limit is the maximum number of keys returned, all the
+	// matching keys are returned if zero.
+	Limit int
+}
+
+// Bounds returns the bounds of the returned part of n matching keys.
+func (o SearchOptions) Bounds(n int) (int, int) {
+	low := o.Offset
+	if low < 0 {
+		low = 0
+	} else if low > n {
+		low = n
+	}
+	high := n
+	if o.Limit > 0 && low+o.Limit < n {
+		high = low + o.Limit
+	}
+	return low, high
+}
+
 // Config is a generic config type for database used essentially during
 // YAML configuration parsing, so database engines are free to implement
 // their own configuration requirements.
@@ -53,6 +85,8 @@ type Engine interface {
 	Add(e openpgp.EntityList) error
 	// Del removes the provided keys from the database.
 	Del(e openpgp.EntityList) error
-	// Get retrieves keys corresponding to the search pattern.
-	Get(s string, isFingerprint bool, exact bool, kt KeyType) (openpgp.EntityList, error)
+	// Get retrieves keys corresponding to the search pattern, keys
+	// are returned in the same order for the same search so they
+	// can be paginated with the search options.
+	Get(s string, opts SearchOptions) (openpgp.EntityList, error)
 }
@@ -0,0 +1,42 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package database
+
+import (
+	"fmt"
+
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Merge merges the provided public keys with their stored counterpart
+// if any, and adds the resulting keys into the database. The provided
+// entities are updated in place with the merged key material. Identity
+// signatures issued by other keys than the key itself and the server
+// signing keys are dropped beforehand, see keyring.DropForeignSignatures.
+func Merge(db Engine, el openpgp.EntityList) error {
+	signingKeys, err := db.Get("", SearchOptions{Fingerprint: true, KeyType: SigningKey})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range el {
+		keyring.DropForeignSignatures(e, signingKeys)
+
+		fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+		eldb, err := db.Get(fp, SearchOptions{Fingerprint: true, Exact: true})
+		if err != nil {
+			return err
+		}
+		for _, dbe := range eldb {
+			if dbe.PrimaryKey.Fingerprint != e.PrimaryKey.Fingerprint {
+				continue
+			}
+			if err := keyring.Merge(e, dbe); err != nil {
+				return err
+			}
+		}
+	}
+	return db.Add(el)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// LocalPartFolding describes how Normalize case folds the local part
+// of mail addresses.
+type LocalPartFolding string
+
+const (
+	// FullFolding applies the Unicode full case folding to the local
+	// part, so Straße@example.com and strasse@example.com designate the
+	// same identity. It's the default.
+	FullFolding LocalPartFolding = "full"
+	// ASCIIFolding only lowercases the ASCII letters of the local part.
+	ASCIIFolding LocalPartFolding = "ascii"
+	// NoFolding keeps the local part case-sensitive.
+	NoFolding LocalPartFolding = "none"
+)
+
+// Check returns an error if the folding is unknown, an empty value
+// selects FullFolding.
+func (f LocalPartFolding) Check() error {
+	switch f {
+	case "", FullFolding, ASCIIFolding, NoFolding:
+		return nil
+	}
+	return fmt.Errorf("unknown local part folding %q", f)
+}
+
+// Normalize returns the canonical form of an identity name, a mail
+// address or a text search used by database engines to store, search
+// and compare identities. The text is case folded and put in Unicode
+// NFC form. With FullFolding, the default, mail addresses are case
+// folded as a whole: like WKD hashes and verification tokens, both the
+// local part and the domain are considered case-insensitive so that
+// Alice@Example.com and alice@example.com designate the same identity.
+// The domain is always case folded while the folding of the local part,
+// the text before the last @, depends on f.
+func (f LocalPartFolding) Normalize(s string) string {
+	i := strings.LastIndex(s, "@")
+	if f == "" || f == FullFolding || i < 0 {
+		// casers are stateful, they can't be shared
+		return norm.NFC.String(cases.Fold().String(s))
+	}
+
+	local, domain := s[:i], s[i:]
+	if f == ASCIIFolding {
+		local = strings.Map(func(r rune) rune {
+			if r >= 'A' && r <= 'Z' {
+				return r + 'a' - 'A'
+			}
+			return r
+		}, local)
+	}
+
+	return norm.NFC.String(local) + norm.NFC.String(cases.Fold().String(domain))
+}
+
+// Normalizer is an optional interface implemented by database engines
+// storing normalized identities.
+type Normalizer interface {
+	// SetLocalPartFolding sets the folding used to normalize the
+	// stored and searched identities, it's called before Connect.
+	SetLocalPartFolding(f LocalPartFolding)
+}
+
+// SetLocalPartFolding sets how the database engine case folds the local
+// part of mail addresses if it normalizes identities, it must be called
+// before connecting to the database. Identities stored with another
+// folding must be stored again, for example with a dump and restore of
+// the database.
+func SetLocalPartFolding(db Engine, f LocalPartFolding) error {
+	if err := f.Check(); err != nil {
+		return err
+	}
+	if n, ok := db.(Normalizer); ok {
+		n.SetLocalPartFolding(f)
+	}
+	return nil
+}
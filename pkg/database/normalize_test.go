@@ -0,0 +1,43 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package database
+
+import (
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		folding LocalPartFolding
+		s       string
+		want    string
+	}{
+		{"", "Alice@Example.COM", "alice@example.com"},
+		{FullFolding, "Alice Smith", "alice smith"},
+		{FullFolding, "Alice@Example.COM", "alice@example.com"},
+		{FullFolding, "Straße@Example.com", "strasse@example.com"},
+		{ASCIIFolding, "Alice Straße", "alice strasse"},
+		{ASCIIFolding, "Alice@Example.COM", "alice@example.com"},
+		{ASCIIFolding, "Straße@STRAßE.com", "straße@strasse.com"},
+		{ASCIIFolding, "Ünal@example.com", "Ünal@example.com"},
+		{NoFolding, "Alice@Example.COM", "Alice@example.com"},
+		{NoFolding, "Straße@example.com", "Straße@example.com"},
+		{NoFolding, "a@b@Example.com", "a@b@example.com"},
+		// NFC form applies to the local part in all cases
+		{NoFolding, "Cafe\u0301@example.com", "Caf\u00e9@example.com"},
+	}
+
+	for _, tt := range tests {
+		if err := tt.folding.Check(); err != nil {
+			t.Fatalf("unexpected error while checking local part folding: %s", err)
+		}
+		if got := tt.folding.Normalize(tt.s); got != tt.want {
+			t.Errorf("unexpected normalization of %q with %s folding: got %q instead of %q", tt.s, tt.folding, got, tt.want)
+		}
+	}
+
+	if err := LocalPartFolding("lower").Check(); err == nil {
+		t.Errorf("unexpected success while checking unknown local part folding")
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package database
+
+import (
+	"errors"
+)
+
+// ErrReadOnly is returned by read-only database engines when keys
+// are added or deleted.
+var ErrReadOnly = errors.New("read-only database")
+
+// ReadOnly is an optional interface implemented by database engines
+// serving keys from an external source, their Add and Del methods
+// return ErrReadOnly.
+type ReadOnly interface {
+	// ReadOnly reports whether the database rejects updates.
+	ReadOnly() bool
+}
+
+// IsReadOnly returns whether the database engine is read-only.
+func IsReadOnly(db Engine) bool {
+	ro, ok := db.(ReadOnly)
+	return ok && ro.ReadOnly()
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// StateSep is the separator used between the components of a state key.
+const StateSep = ":"
+
+// ErrNotFound is returned by state engines when a value doesn't
+// exist or has expired.
+var ErrNotFound = errors.New("not found")
+
+// StateEngine is an optional interface implemented by database engines
+// able to persist server state (secrets, pending operations, ...) alongside
+// the keys, so it survives server restarts.
+type StateEngine interface {
+	// SetState stores the value associated to key, the value
+	// automatically expires after ttl unless ttl is zero.
+	SetState(key string, value []byte, ttl time.Duration) error
+	// GetState returns the value associated to key or ErrNotFound.
+	GetState(key string) ([]byte, error)
+	// DelState removes the value associated to key.
+	DelState(key string) error
+	// ListState calls fn for each non expired value whose key starts
+	// with prefix, the iteration stops when fn returns false.
+	ListState(prefix string, fn func(key string, value []byte) bool) error
+}
+
+// GetStateEngine returns the state engine implemented by the
+// database engine if any.
+func GetStateEngine(db Engine) (StateEngine, bool) {
+	s, ok := db.(StateEngine)
+	return s, ok
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package database
+
+// Volatile is an optional interface implemented by database engines
+// which may keep their keys in memory only, the keys are then lost
+// on disconnection.
+type Volatile interface {
+	// Volatile reports whether the keys are only kept in memory.
+	Volatile() bool
+}
+
+// IsVolatile returns whether the database engine only keeps its keys
+// in memory.
+func IsVolatile(db Engine) bool {
+	v, ok := db.(Volatile)
+	return ok && v.Volatile()
+}
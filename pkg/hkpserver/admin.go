@@ -0,0 +1,450 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hkpserver
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"github.com/ctrliq/spks/pkg/pending"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	AdminKeysRoute       = "/admin/v1/keys"
+	AdminPendingRoute    = "/admin/v1/pending"
+	AdminRateLimitsRoute = "/admin/v1/ratelimits"
+	AdminCompactRoute    = "/admin/v1/compact"
+)
+
+// AdminKey describes a key as returned by the administrative API.
+type AdminKey struct {
+	Fingerprint string          `json:"fingerprint"`
+	KeyID       string          `json:"keyid"`
+	Revoked     bool            `json:"revoked"`
+	Identities  []AdminIdentity `json:"identities"`
+}
+
+// AdminIdentity describes a key identity as returned by the
+// administrative API.
+type AdminIdentity struct {
+	Name      string `json:"name"`
+	Revoked   bool   `json:"revoked"`
+	Certified bool   `json:"certified"`
+	// CertificationExpires is the expiration time of the server
+	// certification, omitted if the certification doesn't expire.
+	CertificationExpires *time.Time `json:"certification_expires,omitempty"`
+}
+
+// AdminIdentityRequest describes the JSON body of the certify and
+// uncertify requests.
+type AdminIdentityRequest struct {
+	Identity string `json:"identity"`
+}
+
+// AdminRateLimit describes the key push rate limit state of a client.
+type AdminRateLimit struct {
+	IP         string  `json:"ip"`
+	Throttled  bool    `json:"throttled"`
+	RetryAfter float64 `json:"retry_after"`
+}
+
+// adminHandler provides the administrative API handlers.
+type adminHandler struct {
+	*hkpHandler
+	token   string
+	pending *pending.Store
+}
+
+// newAdminServer returns the administrative API server and its TLS
+// configuration if any, the server TLS configuration is reused for the
+// administrative API.
+func newAdminServer(cfg Config, h *hkpHandler, tlsConfig *tls.Config) (*http.Server, *tls.Config, error) {
+	if cfg.AdminToken == "" && cfg.AdminClientCA == "" {
+		return nil, nil, fmt.Errorf("a bearer token or a client CA certificate is required")
+	}
+
+	var adminTLSConfig *tls.Config
+
+	if tlsConfig != nil {
+		adminTLSConfig = tlsConfig.Clone()
+	}
+
+	// bearer tokens are sent in clear text without TLS
+	if cfg.AdminToken != "" && adminTLSConfig == nil && !isLoopback(cfg.AdminAddr) {
+		return nil, nil, fmt.Errorf("bearer token authentication requires server TLS certificates unless bound to a loopback address")
+	}
+
+	if cfg.AdminClientCA != "" {
+		if adminTLSConfig == nil {
+			return nil, nil, fmt.Errorf("client certificate authentication requires server TLS certificates")
+		}
+		ca, err := readPem(cfg.AdminClientCA)
+		if err != nil {
+			return nil, nil, fmt.Errorf("while reading client CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, nil, fmt.Errorf("no valid client CA certificate found")
+		}
+		adminTLSConfig.ClientCAs = pool
+		adminTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	a := &adminHandler{
+		hkpHandler: h,
+		token:      cfg.AdminToken,
+	}
+	// pending submissions are only available with state storage
+	if store, err := pending.NewStore(h.db); err == nil {
+		a.pending = store
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminKeysRoute, a.keys)
+	mux.HandleFunc(AdminKeysRoute+"/", a.key)
+	mux.HandleFunc(AdminPendingRoute, a.pendingSubmissions)
+	mux.HandleFunc(AdminRateLimitsRoute, a.rateLimits)
+	mux.HandleFunc(AdminCompactRoute, a.compact)
+
+	var handler http.Handler = a.authorize(mux)
+	if cfg.CustomHandler != nil {
+		handler = cfg.CustomHandler(handler)
+	}
+
+	return &http.Server{Addr: cfg.AdminAddr, Handler: handler}, adminTLSConfig, nil
+}
+
+// isLoopback returns whether the bind address only listens on
+// a loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	} else if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorize checks the bearer token of administrative requests,
+// client certificates are verified by the TLS layer.
+func (a *adminHandler) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" {
+			auth := r.Header.Get("Authorization")
+			token := strings.TrimPrefix(auth, "Bearer ")
+			if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				NewUnauthorizedStatus().Write(w)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// signingKeys returns the server signing keys.
+func (a *adminHandler) signingKeys() (openpgp.EntityList, error) {
+	return a.db.Get("", database.SearchOptions{Fingerprint: true, KeyType: database.SigningKey})
+}
+
+func newAdminKey(e *openpgp.Entity, signingKeys openpgp.EntityList) AdminKey {
+	k := AdminKey{
+		Fingerprint: fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]),
+		KeyID:       e.PrimaryKey.KeyIdString(),
+		Revoked:     len(e.Revocations) > 0,
+		Identities:  make([]AdminIdentity, 0, len(e.Identities)),
+	}
+	for _, id := range keyring.SortedIdentities(e) {
+		ai := AdminIdentity{
+			Name:      id.Name,
+			Revoked:   keyring.IdentityRevoked(e, id),
+			Certified: keyring.IdentityCertifiedBy(e, id, signingKeys),
+		}
+		if expiry, ok := keyring.CertificationExpiry(e, id, signingKeys); ok && !expiry.IsZero() {
+			expiry = expiry.UTC()
+			ai.CertificationExpires = &expiry
+		}
+		k.Identities = append(k.Identities, ai)
+	}
+	return k
+}
+
+// keys provides the key listing handler, keys are filtered with
+// the search and exact query parameters and paginated with the offset
+// and limit query parameters. Keys are listed in the database order so
+// the pages are consistent with each other.
+func (a *adminHandler) keys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	query := r.URL.Query()
+
+	// the administrative API isn't subject to the lookup limit
+	opts := database.SearchOptions{Exact: query.Get("exact") == "on"}
+	if status := pageOptions(query, &opts, 0); status != nil {
+		status.Write(w)
+		return
+	}
+
+	el, err := a.db.Get(query.Get("search"), opts)
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+	signingKeys, err := a.signingKeys()
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+
+	keys := make([]AdminKey, 0, len(el))
+	for _, e := range el {
+		keys = append(keys, newAdminKey(e, signingKeys))
+	}
+	writeJSON(w, keys)
+}
+
+// key provides the single key handlers:
+//
+//	GET    /admin/v1/keys/<fingerprint>
+//	DELETE /admin/v1/keys/<fingerprint>
+//	POST   /admin/v1/keys/<fingerprint>/certify
+//	POST   /admin/v1/keys/<fingerprint>/uncertify
+func (a *adminHandler) key(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, AdminKeysRoute+"/")
+	fp, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		fp, action = path[:i], path[i+1:]
+	}
+
+	fp = strings.ToUpper(fp)
+	if !isHex(fp, 40) {
+		NewBadRequestStatus("Fingerprint must be 40 hexadecimal characters").Write(w)
+		return
+	}
+
+	e, err := a.storedKey(fp)
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	} else if e == nil {
+		NewNotFoundStatus().Write(w)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeKeys(w, openpgp.EntityList{e})
+	case action == "" && r.Method == http.MethodDelete:
+		if err := a.db.Del(openpgp.EntityList{e}); err != nil {
+			newDatabaseErrorStatus(err).Write(w)
+			return
+		}
+		NewOKStatus("Key deleted successfully").Write(w)
+	case action == "certify" && r.Method == http.MethodPost:
+		a.certify(w, r, e)
+	case action == "uncertify" && r.Method == http.MethodPost:
+		a.uncertify(w, r, e)
+	case action == "" || action == "certify" || action == "uncertify":
+		NewMethodNotAllowedStatus().Write(w)
+	default:
+		NewNotFoundStatus().Write(w)
+	}
+}
+
+// identity returns the key identity designated by the request body.
+func (a *adminHandler) identity(w http.ResponseWriter, r *http.Request, e *openpgp.Entity) *openpgp.Identity {
+	r.Body = http.MaxBytesReader(w, r.Body, a.maxBodyBytes)
+
+	var req AdminIdentityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		NewBadRequestStatus("Invalid JSON request").Write(w)
+		return nil
+	}
+	id, ok := e.Identities[req.Identity]
+	if !ok {
+		NewNotFoundStatus("Identity not found").Write(w)
+		return nil
+	}
+	return id
+}
+
+// certify signs the key identity with the server signing key
+// without going through the verification process, the certification
+// expires after the configured certification lifetime.
+func (a *adminHandler) certify(w http.ResponseWriter, r *http.Request, e *openpgp.Entity) {
+	if a.signingKey == nil {
+		NewNotImplementedStatus("No signing key configured").Write(w)
+		return
+	}
+
+	id := a.identity(w, r, e)
+	if id == nil {
+		return
+	}
+
+	if err := keyring.Certify(e, id.Name, a.signingKey, a.certLifetime); err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+	if err := a.db.Add(openpgp.EntityList{e}); err != nil {
+		newDatabaseErrorStatus(err).Write(w)
+		return
+	}
+
+	NewOKStatus("Identity certified").Write(w)
+}
+
+// uncertify removes the certifications made by the server signing
+// keys from the key identity.
+func (a *adminHandler) uncertify(w http.ResponseWriter, r *http.Request, e *openpgp.Entity) {
+	id := a.identity(w, r, e)
+	if id == nil {
+		return
+	}
+
+	signingKeys, err := a.signingKeys()
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+
+	isSigningKey := func(sig *packet.Signature) bool {
+		if sig.IssuerKeyId == nil {
+			return false
+		}
+		for _, sk := range signingKeys {
+			if sk.PrimaryKey.KeyId == *sig.IssuerKeyId {
+				return true
+			}
+		}
+		return false
+	}
+
+	var sigs []*packet.Signature
+
+	removed := 0
+	for _, sig := range id.Signatures {
+		if isSigningKey(sig) {
+			removed++
+			continue
+		}
+		sigs = append(sigs, sig)
+	}
+	if removed == 0 {
+		NewNotFoundStatus("Identity not certified by the server").Write(w)
+		return
+	}
+	id.Signatures = sigs
+
+	if err := a.db.Add(openpgp.EntityList{e}); err != nil {
+		newDatabaseErrorStatus(err).Write(w)
+		return
+	}
+
+	NewOKStatus("Identity certification removed").Write(w)
+}
+
+// pendingSubmissions lists the pending submissions or purges them,
+// optionally restricted to the fingerprint query parameter.
+func (a *adminHandler) pendingSubmissions(w http.ResponseWriter, r *http.Request) {
+	if a.pending == nil {
+		NewNotImplementedStatus("Database engine doesn't store pending submissions").Write(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list, err := a.pending.List()
+		if err != nil {
+			NewInternalServerErrorStatus(err.Error()).Write(w)
+			return
+		}
+		if list == nil {
+			list = []*pending.Submission{}
+		}
+		writeJSON(w, list)
+	case http.MethodDelete:
+		n, err := a.pending.Purge(r.URL.Query().Get("fingerprint"))
+		if err != nil {
+			NewInternalServerErrorStatus(err.Error()).Write(w)
+			return
+		}
+		NewOKStatus(fmt.Sprintf("%d pending submission(s) removed", n)).Write(w)
+	default:
+		NewMethodNotAllowedStatus().Write(w)
+	}
+}
+
+// rateLimits returns the key push rate limit state of the clients.
+func (a *adminHandler) rateLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	limits := []AdminRateLimit{}
+
+	a.usersLimitMutex.Lock()
+	for ip, lim := range a.usersLimit {
+		now := time.Now()
+		res := lim.ReserveN(now, 1)
+		delay := res.DelayFrom(now)
+		res.CancelAt(now)
+
+		limits = append(limits, AdminRateLimit{
+			IP:         ip,
+			Throttled:  delay > 0,
+			RetryAfter: delay.Seconds(),
+		})
+	}
+	a.usersLimitMutex.Unlock()
+
+	sort.Slice(limits, func(i, j int) bool {
+		return limits[i].IP < limits[j].IP
+	})
+
+	writeJSON(w, limits)
+}
+
+// compact triggers the database compaction.
+func (a *adminHandler) compact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	c, ok := database.GetCompacter(a.db)
+	if !ok {
+		NewNotImplementedStatus("Database engine doesn't support compaction").Write(w)
+		return
+	}
+	if err := c.Compact(); err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+
+	NewOKStatus("Database compacted").Write(w)
+}
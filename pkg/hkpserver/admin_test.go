@@ -0,0 +1,224 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hkpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestAdmin(t *testing.T) {
+	handler := new(hkpHandler)
+	handler.maxBodyBytes = 1 << 18
+
+	handler.db, _ = database.GetDatabaseEngine(defaultdb.Name)
+	if handler.db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := handler.db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer handler.db.Disconnect()
+
+	el := getEntities(t, 2)
+	signingKey := el[1]
+
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(getArmored(t, el[0], false)))
+	if err != nil {
+		t.Fatalf("unexpected error while reading key: %s", err)
+	}
+	if err := handler.db.Add(append(keys, signingKey)); err != nil {
+		t.Fatalf("unexpected error while adding keys: %s", err)
+	}
+
+	if _, _, err := newAdminServer(Config{AdminAddr: "localhost:0"}, handler, nil); err == nil {
+		t.Errorf("unexpected success without authentication")
+	}
+	if _, _, err := newAdminServer(Config{AdminAddr: "localhost:0", AdminClientCA: "ca.pem"}, handler, nil); err == nil {
+		t.Errorf("unexpected success with client CA without TLS")
+	}
+	for _, addr := range []string{":0", "0.0.0.0:0", "192.0.2.1:0", "example.com:0"} {
+		if _, _, err := newAdminServer(Config{AdminAddr: addr, AdminToken: "secret"}, handler, nil); err == nil {
+			t.Errorf("unexpected success with token without TLS on %s", addr)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		if _, _, err := newAdminServer(Config{AdminAddr: addr, AdminToken: "secret"}, handler, nil); err != nil {
+			t.Errorf("unexpected error with token without TLS on %s: %s", addr, err)
+		}
+	}
+
+	handler.signingKey = signingKey
+
+	cfg := Config{
+		AdminAddr:  "localhost:0",
+		AdminToken: "secret",
+	}
+	srv, _, err := newAdminServer(cfg, handler, nil)
+	if err != nil {
+		t.Fatalf("unexpected error while creating administrative server: %s", err)
+	}
+
+	fp := fmt.Sprintf("%X", el[0].PrimaryKey.Fingerprint[:])
+	identity := `{"identity": "` + keyring.PrimaryIdentity(el[0]).Name + `"}`
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		code   int
+	}{
+		{
+			name:   "no token",
+			method: "GET",
+			path:   AdminKeysRoute,
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name:   "bad token",
+			method: "GET",
+			path:   AdminKeysRoute,
+			token:  "bad",
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name:   "list keys",
+			method: "GET",
+			path:   AdminKeysRoute,
+			token:  "secret",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "get key",
+			method: "GET",
+			path:   AdminKeysRoute + "/" + fp,
+			token:  "secret",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "bad fingerprint",
+			method: "GET",
+			path:   AdminKeysRoute + "/0123",
+			token:  "secret",
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "uncertify not certified",
+			method: "POST",
+			path:   AdminKeysRoute + "/" + fp + "/uncertify",
+			token:  "secret",
+			body:   identity,
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "certify unknown identity",
+			method: "POST",
+			path:   AdminKeysRoute + "/" + fp + "/certify",
+			token:  "secret",
+			body:   `{"identity": "unknown"}`,
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "certify",
+			method: "POST",
+			path:   AdminKeysRoute + "/" + fp + "/certify",
+			token:  "secret",
+			body:   identity,
+			code:   http.StatusOK,
+		},
+		{
+			name:   "uncertify",
+			method: "POST",
+			path:   AdminKeysRoute + "/" + fp + "/uncertify",
+			token:  "secret",
+			body:   identity,
+			code:   http.StatusOK,
+		},
+		{
+			name:   "pending submissions",
+			method: "GET",
+			path:   AdminPendingRoute,
+			token:  "secret",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "rate limits",
+			method: "GET",
+			path:   AdminRateLimitsRoute,
+			token:  "secret",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "compact",
+			method: "POST",
+			path:   AdminCompactRoute,
+			token:  "secret",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "delete key",
+			method: "DELETE",
+			path:   AdminKeysRoute + "/" + fp,
+			token:  "secret",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "get deleted key",
+			method: "GET",
+			path:   AdminKeysRoute + "/" + fp,
+			token:  "secret",
+			code:   http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+
+		srv.Handler.ServeHTTP(resp, req)
+
+		if resp.Code != tt.code {
+			t.Errorf("unexpected http status returned for %q: got %d instead of %d", tt.name, resp.Code, tt.code)
+			continue
+		}
+
+		if tt.name == "list keys" {
+			var list []AdminKey
+			if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+				t.Errorf("unexpected error while decoding key list: %s", err)
+			} else if len(list) != 2 {
+				t.Errorf("unexpected number of keys listed: got %d instead of 2", len(list))
+			}
+
+			// pages follow the order of the full listing
+			for i, k := range list {
+				resp := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", fmt.Sprintf("%s?offset=%d&limit=1", AdminKeysRoute, i), nil)
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+				srv.Handler.ServeHTTP(resp, req)
+
+				var page []AdminKey
+				if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+					t.Errorf("unexpected error while decoding key page: %s", err)
+				} else if len(page) != 1 || page[0].Fingerprint != k.Fingerprint {
+					t.Errorf("unexpected key page at offset %d", i)
+				}
+			}
+		}
+	}
+}
@@ -5,116 +5,296 @@ package hkpserver
 
 import (
 	"fmt"
+	"html/template"
 	"io"
 	"strings"
 	"time"
 
+	"github.com/ctrliq/spks/pkg/keyring"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/packet"
 )
 
-type printEntity struct {
-	entity  *openpgp.Entity
-	selfSig *packet.Signature
+// IndexOptions controls the output format of WriteIndex.
+type IndexOptions struct {
+	// MachineReadable selects the colon-delimited format requested
+	// with options=mr, otherwise an HTML listing is written.
+	MachineReadable bool
+	// Verbose lists the signatures of each user ID (op=vindex).
+	Verbose bool
+	// SigningKeys are the server signing keys used to flag the
+	// certifications issued by the server in verbose mode.
+	SigningKeys openpgp.EntityList
 }
 
-func newPrintEntity(e *openpgp.Entity) *printEntity {
-	pe := &printEntity{entity: e}
+// indexSignature holds the index fields of a user ID signature.
+type indexSignature struct {
+	IssuerKeyID string
+	Type        packet.SignatureType
+	Creation    time.Time
+	Expiration  time.Time
+	Flags       string
+}
 
-	for _, id := range pe.entity.Identities {
-		if id.SelfSignature.IsPrimaryId != nil && *id.SelfSignature.IsPrimaryId {
-			pe.selfSig = id.SelfSignature
-			break
-		}
-		pe.selfSig = id.SelfSignature
-	}
+// indexIdentity holds the index fields of a key user ID.
+type indexIdentity struct {
+	Name       string
+	Creation   time.Time
+	Expiration time.Time
+	Flags      string
+	Signatures []indexSignature
+}
 
-	return pe
+// indexEntity holds the index fields of a key.
+type indexEntity struct {
+	Fingerprint string
+	KeyID       string
+	Algo        packet.PublicKeyAlgorithm
+	BitLength   uint16
+	Creation    time.Time
+	Expiration  time.Time
+	Flags       string
+	Identities  []indexIdentity
 }
 
-func (pe *printEntity) print(w io.Writer) error {
-	key := pe.entity.PrimaryKey
+func newIndexEntity(e *openpgp.Entity, now time.Time, opts IndexOptions) (*indexEntity, error) {
+	key := e.PrimaryKey
 
 	bitLength, err := key.BitLength()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	ct := uint64(key.CreationTime.Unix())
-	et := uint64(0)
-	if pe.selfSig.KeyLifetimeSecs != nil {
-		et = ct + uint64(*pe.selfSig.KeyLifetimeSecs)
-	}
-	expiration := ""
-	if et != 0 {
-		expiration = fmt.Sprint(et)
+	ie := &indexEntity{
+		Fingerprint: fmt.Sprintf("%X", key.Fingerprint[:]),
+		KeyID:       key.KeyIdString(),
+		Algo:        key.PubKeyAlgo,
+		BitLength:   bitLength,
+		Creation:    key.CreationTime,
 	}
 
-	flags := ""
-	if pe.selfSig.SigExpired(time.Now()) {
-		flags += "e"
-	}
-	if len(pe.entity.Revocations) > 0 {
-		flags += "r"
+	// the key expiration is carried by the self-signature
+	// of the primary identity
+	if id := keyring.PrimaryIdentity(e); id != nil && id.SelfSignature != nil {
+		selfSig := id.SelfSignature
+		if selfSig.KeyLifetimeSecs != nil && *selfSig.KeyLifetimeSecs != 0 {
+			ie.Expiration = key.CreationTime.Add(time.Duration(*selfSig.KeyLifetimeSecs) * time.Second)
+		}
+		if key.KeyExpired(selfSig, now) {
+			ie.Flags += "e"
+		}
 	}
-
-	_, err = fmt.Fprintf(
-		w,
-		"pub:%X:%d:%d:%d:%s:%s\n",
-		key.Fingerprint[:], key.PubKeyAlgo, bitLength, ct, expiration, flags,
-	)
-	if err != nil {
-		return err
+	if len(e.Revocations) > 0 {
+		ie.Flags += "r"
 	}
+	// spks has no notion of disabled keys, so the "d" flag
+	// is never set
 
-	for _, id := range pe.entity.Identities {
+	for _, id := range keyring.SortedIdentities(e) {
 		if id.SelfSignature == nil {
 			continue
 		}
 
-		ct := uint64(id.SelfSignature.CreationTime.Unix())
-		et := uint64(0)
-		if id.SelfSignature.KeyLifetimeSecs != nil {
-			et = ct + uint64(*id.SelfSignature.KeyLifetimeSecs)
+		ii := indexIdentity{
+			Name:     id.Name,
+			Creation: id.SelfSignature.CreationTime,
+		}
+		if id.SelfSignature.SigLifetimeSecs != nil && *id.SelfSignature.SigLifetimeSecs != 0 {
+			ii.Expiration = ii.Creation.Add(time.Duration(*id.SelfSignature.SigLifetimeSecs) * time.Second)
+		}
+		if id.SelfSignature.SigExpired(now) {
+			ii.Flags += "e"
 		}
-		expiration := ""
-		if et != 0 {
-			expiration = fmt.Sprint(et)
+		if keyring.IdentityRevoked(e, id) {
+			ii.Flags += "r"
 		}
+		if opts.Verbose {
+			ii.Signatures = newIndexSignatures(e, id, now, opts.SigningKeys)
+		}
+
+		ie.Identities = append(ie.Identities, ii)
+	}
+
+	return ie, nil
+}
+
+// newIndexSignatures returns the index fields of the signatures
+// attached to the identity.
+func newIndexSignatures(e *openpgp.Entity, id *openpgp.Identity, now time.Time, signingKeys openpgp.EntityList) []indexSignature {
+	sigs := make([]indexSignature, 0, len(id.Signatures))
 
-		flags := ""
-		if id.SelfSignature.SigExpired(time.Now()) {
-			flags += "e"
+	for _, sig := range id.Signatures {
+		is := indexSignature{
+			Type:     sig.SigType,
+			Creation: sig.CreationTime,
+		}
+		if sig.IssuerKeyId != nil {
+			is.IssuerKeyID = fmt.Sprintf("%016X", *sig.IssuerKeyId)
+		}
+		if sig.SigLifetimeSecs != nil && *sig.SigLifetimeSecs != 0 {
+			is.Expiration = is.Creation.Add(time.Duration(*sig.SigLifetimeSecs) * time.Second)
 		}
-		if id.SelfSignature.RevocationReason != nil {
-			flags += "r"
+		if sig.SigExpired(now) {
+			is.Flags += "e"
+		}
+		if keyring.CertificationIssuer(e, id, sig, signingKeys) != nil {
+			is.Flags += "s"
+		}
+		sigs = append(sigs, is)
+	}
+
+	return sigs
+}
+
+// timestamp returns the unix timestamp of t or an empty string
+// if t is not set.
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return fmt.Sprint(t.Unix())
+}
+
+// escapeField percent-encodes the characters of s which are not
+// allowed in an index field: the field separator, the escape character
+// itself and any non printable or non ASCII bytes.
+func escapeField(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ':' || c == '%' || c < 0x20 || c > 0x7e {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
 		}
+	}
+
+	return b.String()
+}
+
+func (ie *indexEntity) writeMachineReadable(w io.Writer) error {
+	_, err := fmt.Fprintf(
+		w,
+		"pub:%s:%d:%d:%s:%s:%s\n",
+		ie.Fingerprint, ie.Algo, ie.BitLength, timestamp(ie.Creation), timestamp(ie.Expiration), ie.Flags,
+	)
+	if err != nil {
+		return err
+	}
 
+	for _, id := range ie.Identities {
 		_, err := fmt.Fprintf(
 			w,
-			"uid:%s:%d:%s:%s\n",
-			strings.ReplaceAll(id.Name, ":", "%3A"), ct, expiration, flags,
+			"uid:%s:%s:%s:%s\n",
+			escapeField(id.Name), timestamp(id.Creation), timestamp(id.Expiration), id.Flags,
 		)
 		if err != nil {
 			return err
 		}
+		for _, sig := range id.Signatures {
+			_, err := fmt.Fprintf(
+				w,
+				"sig:%s:%s:%s:%02x:%s\n",
+				sig.IssuerKeyID, timestamp(sig.Creation), timestamp(sig.Expiration), uint8(sig.Type), sig.Flags,
+			)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
-// WriteIndex writes on w a readable index based on the entity list
-// provided. The index format follows the one described in the HKP draft
-// https://tools.ietf.org/html/draft-shaw-openpgp-hkp-00#section-5.2
-func WriteIndex(w io.Writer, el openpgp.EntityList) error {
-	_, err := fmt.Fprintf(w, "info:1:%d\n", len(el))
-	if err != nil {
-		return err
-	}
+var algoNames = map[packet.PublicKeyAlgorithm]string{
+	packet.PubKeyAlgoRSA:            "rsa",
+	packet.PubKeyAlgoRSAEncryptOnly: "rsa",
+	packet.PubKeyAlgoRSASignOnly:    "rsa",
+	packet.PubKeyAlgoElGamal:        "elg",
+	packet.PubKeyAlgoDSA:            "dsa",
+	packet.PubKeyAlgoECDH:           "ecdh",
+	packet.PubKeyAlgoECDSA:          "ecdsa",
+	packet.PubKeyAlgoEdDSA:          "eddsa",
+}
+
+var indexFuncs = template.FuncMap{
+	"algo": func(a packet.PublicKeyAlgorithm) string {
+		if name, ok := algoNames[a]; ok {
+			return name
+		}
+		return fmt.Sprintf("algo%d", a)
+	},
+	"date": func(t time.Time) string {
+		return t.UTC().Format("2006-01-02")
+	},
+	"has": strings.Contains,
+}
 
+var htmlIndexTemplate = template.Must(template.New("index").Funcs(indexFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Search results</title>
+</head>
+<body>
+<h1>Search results</h1>
+<p>{{len .}} key(s) found</p>
+{{- range .}}
+<hr>
+<pre>
+pub  {{algo .Algo}}{{.BitLength}}/<a href="/pks/lookup?op=get&amp;search=0x{{.Fingerprint}}">{{.KeyID}}</a> {{date .Creation}}
+{{- if not .Expiration.IsZero}} [{{if has .Flags "e"}}expired{{else}}expires{{end}}: {{date .Expiration}}]{{end}}
+{{- if has .Flags "r"}} [revoked]{{end}}
+     Fingerprint={{.Fingerprint}}
+{{- range .Identities}}
+uid  {{.Name}}
+{{- if has .Flags "e"}} [expired]{{end}}
+{{- if has .Flags "r"}} [revoked]{{end}}
+{{- range .Signatures}}
+sig  {{printf "%02x" .Type}} {{.IssuerKeyID}} {{date .Creation}}
+{{- if not .Expiration.IsZero}} [{{if has .Flags "e"}}expired{{else}}expires{{end}}: {{date .Expiration}}]{{end}}
+{{- if has .Flags "s"}} [server]{{end}}
+{{- end}}
+{{- end}}
+</pre>
+{{- end}}
+</body>
+</html>
+`))
+
+// WriteIndex writes on w an index based on the entity list provided.
+// The machine readable format follows the one described in the HKP draft
+// https://tools.ietf.org/html/draft-shaw-openpgp-hkp-00#section-5.2,
+// otherwise a human readable HTML listing is written.
+//
+// In verbose mode, each uid line is followed by one line per signature
+// of the following form, where type is the hexadecimal signature type and
+// flags may contain "e" for an expired signature and "s" for a
+// certification issued by one of the server signing keys:
+//
+//	sig:<issuer key ID>:<creation date>:<expiration date>:<type>:<flags>
+func WriteIndex(w io.Writer, el openpgp.EntityList, opts IndexOptions) error {
+	now := time.Now()
+
+	entities := make([]*indexEntity, 0, len(el))
 	for _, e := range el {
-		pe := newPrintEntity(e)
-		if err := pe.print(w); err != nil {
+		ie, err := newIndexEntity(e, now, opts)
+		if err != nil {
+			return err
+		}
+		entities = append(entities, ie)
+	}
+
+	if !opts.MachineReadable {
+		return htmlIndexTemplate.Execute(w, entities)
+	}
+
+	if _, err := fmt.Fprintf(w, "info:1:%d\n", len(entities)); err != nil {
+		return err
+	}
+	for _, ie := range entities {
+		if err := ie.writeMachineReadable(w); err != nil {
 			return err
 		}
 	}
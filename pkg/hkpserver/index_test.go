@@ -0,0 +1,144 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hkpserver
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestEscapeField(t *testing.T) {
+	tests := []struct {
+		name     string
+		field    string
+		expected string
+	}{
+		{
+			name:     "plain ascii",
+			field:    "Test <test@example.com>",
+			expected: "Test <test@example.com>",
+		},
+		{
+			name:     "colon and percent",
+			field:    "a:b%c",
+			expected: "a%3Ab%25c",
+		},
+		{
+			name:     "non ascii",
+			field:    "Jérôme",
+			expected: "J%C3%A9r%C3%B4me",
+		},
+		{
+			name:     "control characters",
+			field:    "a\nb\x7f",
+			expected: "a%0Ab%7F",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := escapeField(tt.field); got != tt.expected {
+			t.Errorf("unexpected escaped field for %q: got %s instead of %s", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestWriteIndex(t *testing.T) {
+	e, err := openpgp.NewEntity("Jérôme", "No comment", "jerome@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+
+	revoked, err := openpgp.NewEntity("Revoked", "No comment", "revoked@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	if err := revoked.RevokeKey(packet.KeyCompromised, "", nil); err != nil {
+		t.Fatalf("unexpected error while revoking pgp key: %s", err)
+	}
+
+	b := new(bytes.Buffer)
+	if err := WriteIndex(b, openpgp.EntityList{e, revoked}, IndexOptions{MachineReadable: true}); err != nil {
+		t.Fatalf("unexpected error while writing index: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("unexpected number of index lines: got %d instead of 5", len(lines))
+	}
+	if lines[0] != "info:1:2" {
+		t.Errorf("unexpected info line: %s", lines[0])
+	}
+
+	pub := fmt.Sprintf("pub:%X:", e.PrimaryKey.Fingerprint[:])
+	if !strings.HasPrefix(lines[1], pub) || !strings.HasSuffix(lines[1], "::") {
+		t.Errorf("unexpected pub line: %s", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "uid:J%C3%A9r%C3%B4me (No comment) <jerome@example.com>:") {
+		t.Errorf("unexpected uid line: %s", lines[2])
+	}
+	if !strings.HasSuffix(lines[3], ":r") {
+		t.Errorf("revoked flag not set: %s", lines[3])
+	}
+
+	b.Reset()
+	if err := WriteIndex(b, openpgp.EntityList{e}, IndexOptions{}); err != nil {
+		t.Fatalf("unexpected error while writing index: %s", err)
+	}
+	if !strings.Contains(b.String(), "<html>") {
+		t.Errorf("human readable index is not an HTML document")
+	} else if !strings.Contains(b.String(), "Jérôme (No comment) &lt;jerome@example.com&gt;") {
+		t.Errorf("identity not found in HTML index")
+	}
+}
+
+func TestWriteVerboseIndex(t *testing.T) {
+	el := getEntities(t, 2)
+	e, signer := el[0], el[1]
+
+	id := e.PrimaryIdentity()
+	if err := e.SignIdentity(id.Name, signer, nil); err != nil {
+		t.Fatalf("unexpected error while signing identity: %s", err)
+	}
+
+	opts := IndexOptions{
+		MachineReadable: true,
+		Verbose:         true,
+		SigningKeys:     openpgp.EntityList{signer},
+	}
+
+	b := new(bytes.Buffer)
+	if err := WriteIndex(b, openpgp.EntityList{e}, opts); err != nil {
+		t.Fatalf("unexpected error while writing index: %s", err)
+	}
+
+	selfSig := fmt.Sprintf("sig:%s:", e.PrimaryKey.KeyIdString())
+	serverSig := fmt.Sprintf("sig:%s:", signer.PrimaryKey.KeyIdString())
+	foundSelf, foundServer := false, false
+
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, selfSig) {
+			foundSelf = true
+			if strings.HasSuffix(line, "s") {
+				t.Errorf("self-signature flagged as server certification: %s", line)
+			}
+		} else if strings.HasPrefix(line, serverSig) {
+			foundServer = true
+			if !strings.HasSuffix(line, ":10:s") {
+				t.Errorf("unexpected server certification line: %s", line)
+			}
+		}
+	}
+
+	if !foundSelf {
+		t.Errorf("no self-signature line found")
+	}
+	if !foundServer {
+		t.Errorf("no server certification line found")
+	}
+}
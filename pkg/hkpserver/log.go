@@ -34,8 +34,8 @@ func (lw *logResponseWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
-// remoteIP attempts to find the remote IP associated with a HTTP request.
-func remoteIP(req *http.Request) string {
+// RemoteIP attempts to find the remote IP associated with a HTTP request.
+func RemoteIP(req *http.Request) string {
 	realIP := ""
 	forwardedFor := ""
 
@@ -83,7 +83,7 @@ func LogRequestHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		lw := &logResponseWriter{w, http.StatusOK, 0, remoteIP(r)}
+		lw := &logResponseWriter{w, http.StatusOK, 0, RemoteIP(r)}
 		h.ServeHTTP(lw, r)
 
 		entry := logrus.WithFields(logrus.Fields{
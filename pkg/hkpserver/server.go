@@ -31,6 +31,7 @@ const (
 	BaseRoute   = "/"
 	AddRoute    = "/pks/add"
 	LookupRoute = "/pks/lookup"
+	WKDRoute    = "/.well-known/openpgpkey/"
 )
 
 type RateLimit string
@@ -65,6 +66,29 @@ type Config struct {
 	MaxHeaderBytes   int
 	MaxBodyBytes     int64
 	KeyPushRateLimit RateLimit
+	// MaxResults is the maximum number of keys returned by lookups,
+	// lookups are not limited if zero or negative.
+	MaxResults int
+	// WKDDomains restricts the domains served by the Web Key
+	// Directory, all domains are served if empty.
+	WKDDomains []string
+	// AdminAddr is the address of the administrative API listener,
+	// the administrative API is disabled if empty.
+	AdminAddr string
+	// AdminToken is the bearer token required to access the
+	// administrative API.
+	AdminToken string
+	// AdminClientCA is the path to (or base64 encoded) CA certificate
+	// used to verify the administrative API client certificates, it
+	// requires PublicPem and PrivatePem.
+	AdminClientCA string
+	// SigningKey is the server signing key used by the administrative
+	// API to certify key identities, its fingerprint is published by
+	// the server info endpoint.
+	SigningKey *openpgp.Entity
+	// CertLifetime is the lifetime of the certifications issued
+	// by the administrative API, zero for no expiration.
+	CertLifetime time.Duration
 }
 
 type hkpHandler struct {
@@ -75,6 +99,12 @@ type hkpHandler struct {
 	usersLimitMutex sync.Mutex
 	rateRequests    int
 	rateMinutes     int
+	maxResults      int
+	wkdDomains      []string
+	vksSessions     vksSessions
+	nonces          nonces
+	signingKey      *openpgp.Entity
+	certLifetime    time.Duration
 }
 
 func (h *hkpHandler) pushLimitReached(ip string) bool {
@@ -137,13 +167,18 @@ func (h *hkpHandler) add(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.submit(el, r).Write(w)
+}
+
+// submit runs the submitted keys through the verifier if any and
+// adds the accepted keys into the database.
+func (h *hkpHandler) submit(el openpgp.EntityList, r *http.Request) Status {
 	// prevents private keys from being stored, this also
 	// helps database engine to distinguish key added
 	// internally (server signing key) or from this handler
 	for _, e := range el {
 		if e.PrivateKey != nil {
-			NewBadRequestStatus("Keys submitted must not contain private key").Write(w)
-			return
+			return NewBadRequestStatus("Keys submitted must not contain private key")
 		}
 	}
 
@@ -154,12 +189,10 @@ func (h *hkpHandler) add(w http.ResponseWriter, r *http.Request) {
 	if h.verifier != nil {
 		keys, status = h.verifier.Verify(el, r)
 		if status == nil {
-			NewInternalServerErrorStatus("Broken verifier").Write(w)
-			return
+			return NewInternalServerErrorStatus("Broken verifier")
 		}
 		if len(keys) == 0 || status.IsError() {
-			status.Write(w)
-			return
+			return status
 		}
 	} else {
 		keys = el
@@ -169,12 +202,68 @@ func (h *hkpHandler) add(w http.ResponseWriter, r *http.Request) {
 		status = NewOKStatus("Key(s) submitted successfully")
 	}
 
-	if err := h.db.Add(keys); err != nil {
-		NewInternalServerErrorStatus(err.Error()).Write(w)
-		return
+	// merge with stored keys to preserve server certifications
+	// and previously published key material
+	if err := database.Merge(h.db, keys); err != nil {
+		return newDatabaseErrorStatus(err)
+	}
+
+	return status
+}
+
+// pageOptions sets the search options offset and limit from the offset
+// and limit query parameters, the limit is capped to maxResults if
+// positive.
+func pageOptions(query url.Values, opts *database.SearchOptions, maxResults int) Status {
+	min := map[string]int{"offset": 0, "limit": 1}
+
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{
+		{"offset", &opts.Offset},
+		{"limit", &opts.Limit},
+	} {
+		v := query.Get(param.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min[param.name] {
+			return NewBadRequestStatus(fmt.Sprintf("Bad %s parameter", param.name))
+		}
+		*param.value = n
+	}
+
+	if maxResults > 0 && (opts.Limit == 0 || opts.Limit > maxResults) {
+		opts.Limit = maxResults
+	}
+
+	return nil
+}
+
+// search returns the keys matching the search within the page requested
+// by the offset and limit query parameters. Unless a limit is requested,
+// searches matching more keys than the server returns at once are
+// rejected rather than truncated.
+func (h *hkpHandler) search(query url.Values, search string, opts database.SearchOptions) (openpgp.EntityList, Status) {
+	if status := pageOptions(query, &opts, h.maxResults); status != nil {
+		return nil, status
 	}
 
-	status.Write(w)
+	limited := h.maxResults > 0 && query.Get("limit") == ""
+	if limited {
+		opts.Limit = h.maxResults + 1
+	}
+
+	el, err := h.db.Get(search, opts)
+	if err != nil {
+		return nil, NewInternalServerErrorStatus(err.Error())
+	} else if limited && len(el) > h.maxResults {
+		return nil, NewTooManyResultsStatus()
+	}
+
+	return el, nil
 }
 
 // lookup provides the /pks/lookup HKP handler.
@@ -186,8 +275,12 @@ func (h *hkpHandler) lookup(w http.ResponseWriter, r *http.Request) {
 
 	query := r.URL.Query()
 
+	machineReadable := false
+
 	for _, opt := range strings.Split(query.Get("options"), ",") {
 		switch strings.TrimSpace(opt) {
+		case "mr":
+			machineReadable = true
 		case "nm":
 			NewNotImplementedStatus().Write(w)
 			return
@@ -207,7 +300,11 @@ func (h *hkpHandler) lookup(w http.ResponseWriter, r *http.Request) {
 		search = strings.TrimPrefix(search, "0x")
 		search = strings.ToUpper(search)
 		length := len(search)
-		if length < 8 {
+		// only key IDs and v4 fingerprints are searched
+		if strings.Trim(search, "0123456789ABCDEF") != "" || length > 40 {
+			NewBadRequestStatus("Fingerprint search must be 8, 16 or 40 hexadecimal characters").Write(w)
+			return
+		} else if length < 8 {
 			NewBadRequestStatus("Fingerprint search must have at least 8 characters").Write(w)
 			return
 		} else if length < 16 {
@@ -217,11 +314,13 @@ func (h *hkpHandler) lookup(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	opts := database.SearchOptions{Fingerprint: isFingerprint, Exact: exact}
+
 	switch query.Get("op") {
 	case "get":
-		el, err := h.db.Get(search, isFingerprint, exact, database.PublicKey)
-		if err != nil {
-			NewInternalServerErrorStatus(err.Error()).Write(w)
+		el, status := h.search(query, search, opts)
+		if status != nil {
+			status.Write(w)
 			return
 		} else if len(el) == 0 {
 			NewNotFoundStatus().Write(w)
@@ -233,16 +332,32 @@ func (h *hkpHandler) lookup(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	case "index", "vindex":
-		el, err := h.db.Get(search, isFingerprint, exact, database.PublicKey)
-		if err != nil {
-			NewInternalServerErrorStatus(err.Error()).Write(w)
+		el, status := h.search(query, search, opts)
+		if status != nil {
+			status.Write(w)
 			return
 		} else if len(el) == 0 {
 			NewNotFoundStatus().Write(w)
 			return
 		}
-		w.Header().Set("Content-Type", "text/plain")
-		if err := WriteIndex(w, el); err != nil {
+		indexOpts := IndexOptions{
+			MachineReadable: machineReadable,
+			Verbose:         query.Get("op") == "vindex",
+		}
+		if indexOpts.Verbose {
+			var err error
+			indexOpts.SigningKeys, err = h.db.Get("", database.SearchOptions{Fingerprint: true, KeyType: database.SigningKey})
+			if err != nil {
+				NewInternalServerErrorStatus(err.Error()).Write(w)
+				return
+			}
+		}
+		if machineReadable {
+			w.Header().Set("Content-Type", "text/plain")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		if err := WriteIndex(w, el, indexOpts); err != nil {
 			NewInternalServerErrorStatus(err.Error()).Write(w)
 			return
 		}
@@ -276,6 +391,10 @@ func Start(ctx context.Context, cfg Config) error {
 		maxBodyBytes: maxBodyBytes,
 		db:           cfg.DB,
 		verifier:     cfg.Verifier,
+		maxResults:   cfg.MaxResults,
+		wkdDomains:   cfg.WKDDomains,
+		signingKey:   cfg.SigningKey,
+		certLifetime: cfg.CertLifetime,
 	}
 
 	handler.rateRequests, handler.rateMinutes, err = cfg.KeyPushRateLimit.Parse()
@@ -310,6 +429,16 @@ func Start(ctx context.Context, cfg Config) error {
 	mux.HandleFunc(BaseRoute, handler.base)
 	mux.HandleFunc(AddRoute, handler.add)
 	mux.HandleFunc(LookupRoute, handler.lookup)
+	mux.HandleFunc(WKDRoute, handler.wkd)
+	mux.HandleFunc(VKSFingerprintRoute, handler.vksByFingerprint)
+	mux.HandleFunc(VKSKeyIDRoute, handler.vksByKeyID)
+	mux.HandleFunc(VKSEmailRoute, handler.vksByEmail)
+	mux.HandleFunc(VKSUploadRoute, handler.vksUpload)
+	mux.HandleFunc(VKSRequestVerifyRoute, handler.vksRequestVerify)
+	mux.HandleFunc(ChallengeRoute, handler.challenge)
+	mux.HandleFunc(SignedRoute, handler.signed)
+	mux.HandleFunc(ServerKeyRoute, handler.serverKey)
+	mux.HandleFunc(ServerInfoRoute, handler.serverInfo)
 
 	if cfg.Verifier != nil {
 		// Init can panic if the verifier registers one of the
@@ -319,6 +448,9 @@ func Start(ctx context.Context, cfg Config) error {
 		if err := cfg.Verifier.Init(cfg.DB, mux); err != nil {
 			return fmt.Errorf("while initializing verifier: %s", err)
 		}
+		if bv, ok := cfg.Verifier.(BackgroundVerifier); ok {
+			go bv.Run(ctx)
+		}
 	}
 
 	addr := cfg.Addr
@@ -335,17 +467,59 @@ func Start(ctx context.Context, cfg Config) error {
 		Addr:           addr,
 		MaxHeaderBytes: maxHeaderBytes,
 	}
+	srv.Handler = mux
 	if cfg.CustomHandler != nil {
 		srv.Handler = cfg.CustomHandler(mux)
 	}
 
+	var tlsConfig *tls.Config
+
+	if cfg.PublicPem != "" && cfg.PrivatePem != "" {
+		tlsConfig, err = newTLSConfig(cfg.PublicPem, cfg.PrivatePem)
+		if err != nil {
+			return err
+		}
+	}
+
+	var adminSrv *http.Server
+	adminErrCh := make(chan error, 1)
+
+	if cfg.AdminAddr != "" {
+		var adminTLSConfig *tls.Config
+
+		adminSrv, adminTLSConfig, err = newAdminServer(cfg, handler, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("while configuring administrative API: %s", err)
+		}
+		adminSrv.MaxHeaderBytes = maxHeaderBytes
+		// the administrative API stops with the server
+		defer adminSrv.Shutdown(context.Background())
+
+		go func() {
+			var err error
+			if adminTLSConfig != nil {
+				err = serveTLS(adminSrv, adminTLSConfig)
+			} else {
+				err = adminSrv.ListenAndServe()
+			}
+			// stop the server if the administrative API can't be served
+			if err != http.ErrServerClosed {
+				adminErrCh <- fmt.Errorf("administrative API: %s", err)
+				srv.Shutdown(context.Background())
+			}
+		}()
+	}
+
 	go func() {
 		<-ctx.Done()
+		if adminSrv != nil {
+			adminSrv.Shutdown(context.Background())
+		}
 		shutdownCh <- srv.Shutdown(context.Background())
 	}()
 
-	if cfg.PublicPem != "" && cfg.PrivatePem != "" {
-		err = serveTLS(srv, cfg.PublicPem, cfg.PrivatePem)
+	if tlsConfig != nil {
+		err = serveTLS(srv, tlsConfig)
 	} else {
 		err = srv.ListenAndServe()
 	}
@@ -354,33 +528,43 @@ func Start(ctx context.Context, cfg Config) error {
 		return err
 	}
 
-	return <-shutdownCh
+	select {
+	case err := <-adminErrCh:
+		return err
+	case err := <-shutdownCh:
+		return err
+	}
 }
 
-func serveTLS(srv *http.Server, publicPem, privatePem string) error {
-	pubCert, err := base64.StdEncoding.DecodeString(publicPem)
+// readPem reads PEM data either base64 encoded or from a file.
+func readPem(pem string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(pem)
 	if err != nil {
-		pubCert, err = ioutil.ReadFile(publicPem)
-		if err != nil {
-			return fmt.Errorf("while reading public certificate: %s", err)
-		}
+		return ioutil.ReadFile(pem)
 	}
-	privCert, err := base64.StdEncoding.DecodeString(privatePem)
+	return b, nil
+}
+
+func newTLSConfig(publicPem, privatePem string) (*tls.Config, error) {
+	pubCert, err := readPem(publicPem)
 	if err != nil {
-		privCert, err = ioutil.ReadFile(privatePem)
-		if err != nil {
-			return fmt.Errorf("while reading private certificate: %s", err)
-		}
+		return nil, fmt.Errorf("while reading public certificate: %s", err)
+	}
+	privCert, err := readPem(privatePem)
+	if err != nil {
+		return nil, fmt.Errorf("while reading private certificate: %s", err)
 	}
 	c, err := tls.X509KeyPair(pubCert, privCert)
 	if err != nil {
-		return fmt.Errorf("while loading TLS certificates: %s", err)
+		return nil, fmt.Errorf("while loading TLS certificates: %s", err)
 	}
-	config := &tls.Config{
+	return &tls.Config{
 		NextProtos:   []string{"http/1.1"},
 		Certificates: []tls.Certificate{c},
-	}
+	}, nil
+}
 
+func serveTLS(srv *http.Server, config *tls.Config) error {
 	ln, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
 		return fmt.Errorf("while listening on %s: %s", srv.Addr, err)
@@ -18,6 +18,7 @@ import (
 
 	"github.com/ctrliq/spks/internal/pkg/defaultdb"
 	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/time/rate"
@@ -122,14 +123,15 @@ func TestHandler(t *testing.T) {
 	kvEmpty.Set("keytext", getArmored(t, nil, false))
 
 	tests := []struct {
-		name     string
-		method   string
-		path     string
-		handler  func(http.ResponseWriter, *http.Request)
-		verifier Verifier
-		body     io.Reader
-		code     int
-		content  string
+		name        string
+		method      string
+		path        string
+		handler     func(http.ResponseWriter, *http.Request)
+		verifier    Verifier
+		body        io.Reader
+		code        int
+		content     string
+		contentType string
 	}{
 		{
 			name:    "post lookup",
@@ -168,6 +170,22 @@ func TestHandler(t *testing.T) {
 			content: "Fingerprint search must have at least 8 characters",
 			handler: handler.lookup,
 		},
+		{
+			name:    "too long fingerprint search",
+			method:  "GET",
+			path:    "/pks/lookup?search=0x" + strings.Repeat("0", 41) + "&op=get",
+			code:    http.StatusBadRequest,
+			content: "Fingerprint search must be 8, 16 or 40 hexadecimal characters",
+			handler: handler.lookup,
+		},
+		{
+			name:    "non hexadecimal fingerprint search",
+			method:  "GET",
+			path:    "/pks/lookup?search=0xzz00000000&op=index",
+			code:    http.StatusBadRequest,
+			content: "Fingerprint search must be 8, 16 or 40 hexadecimal characters",
+			handler: handler.lookup,
+		},
 		{
 			name:    "get null short fingerprint",
 			method:  "GET",
@@ -320,6 +338,22 @@ func TestHandler(t *testing.T) {
 			code:    http.StatusOK,
 			handler: handler.lookup,
 		},
+		{
+			name:        "index machine readable",
+			method:      "GET",
+			path:        "/pks/lookup?op=index&options=mr&search=0x" + keyOne.PrimaryKey.KeyIdString(),
+			code:        http.StatusOK,
+			contentType: "text/plain",
+			handler:     handler.lookup,
+		},
+		{
+			name:        "index human readable",
+			method:      "GET",
+			path:        "/pks/lookup?op=index&search=0x" + keyOne.PrimaryKey.KeyIdString(),
+			code:        http.StatusOK,
+			contentType: "text/html; charset=utf-8",
+			handler:     handler.lookup,
+		},
 	}
 
 	for _, tt := range tests {
@@ -342,6 +376,8 @@ func TestHandler(t *testing.T) {
 
 		if resp.Code != tt.code {
 			t.Errorf("unexpected http status returned for %q: got %d instead of %d", tt.name, resp.Code, tt.code)
+		} else if tt.contentType != "" && resp.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("unexpected content type returned for %q: got %s instead of %s", tt.name, resp.Header().Get("Content-Type"), tt.contentType)
 		} else if tt.content != "" {
 			ct := resp.Header().Get("Content-Type")
 			if ct == "application/json" {
@@ -360,6 +396,69 @@ func TestHandler(t *testing.T) {
 	}
 }
 
+func TestLookupLimit(t *testing.T) {
+	handler := new(hkpHandler)
+	handler.maxResults = 2
+
+	handler.db, _ = database.GetDatabaseEngine(defaultdb.Name)
+	if handler.db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := handler.db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer handler.db.Disconnect()
+
+	if err := handler.db.Add(getEntities(t, 3)); err != nil {
+		t.Fatalf("unexpected error while adding keys: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		code    int
+		content string
+	}{
+		{"get too many keys", "op=get&search=example", http.StatusUnprocessableEntity, ""},
+		{"get page", "op=get&search=example&limit=1", http.StatusOK, ""},
+		{"get within limit", "op=get&search=test1", http.StatusOK, ""},
+		{"index too many keys", "op=index&options=mr&search=example", http.StatusUnprocessableEntity, ""},
+		{"index first page", "op=index&options=mr&search=example&limit=2", http.StatusOK, "info:1:2\n"},
+		{"index capped limit", "op=index&options=mr&search=example&limit=5", http.StatusOK, "info:1:2\n"},
+		{"index last page", "op=index&options=mr&search=example&offset=2", http.StatusOK, "info:1:1\n"},
+		{"index past last page", "op=index&options=mr&search=example&offset=3", http.StatusNotFound, ""},
+		{"bad limit", "op=index&search=example&limit=-1", http.StatusBadRequest, ""},
+		{"zero limit", "op=index&search=example&limit=0", http.StatusBadRequest, ""},
+		{"bad offset", "op=index&search=example&offset=a", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		resp := httptest.NewRecorder()
+		handler.lookup(resp, httptest.NewRequest("GET", "http://localhost/pks/lookup?"+tt.query, nil))
+
+		if resp.Code != tt.code {
+			t.Errorf("unexpected http status returned for %q: got %d instead of %d", tt.name, resp.Code, tt.code)
+		} else if !strings.HasPrefix(resp.Body.String(), tt.content) {
+			t.Errorf("unexpected content returned for %q: got %s", tt.name, resp.Body.String())
+		}
+	}
+
+	// pages don't overlap
+	found := make(map[string]bool)
+	for offset := 0; offset < 3; offset++ {
+		resp := httptest.NewRecorder()
+		handler.lookup(resp, httptest.NewRequest("GET", fmt.Sprintf("http://localhost/pks/lookup?op=index&options=mr&search=example&limit=1&offset=%d", offset), nil))
+		for _, line := range strings.Split(resp.Body.String(), "\n") {
+			if strings.HasPrefix(line, "pub:") {
+				found[line] = true
+			}
+		}
+	}
+	if len(found) != 3 {
+		t.Errorf("unexpected number of paginated keys: got %d instead of 3", len(found))
+	}
+}
+
 func TestRateLimit(t *testing.T) {
 	// http handler
 	handler := new(hkpHandler)
@@ -400,3 +499,63 @@ func TestRateLimit(t *testing.T) {
 		}
 	}
 }
+
+func TestSubmitForeignCertification(t *testing.T) {
+	handler := new(hkpHandler)
+
+	handler.db, _ = database.GetDatabaseEngine(defaultdb.Name)
+	if handler.db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := handler.db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer handler.db.Disconnect()
+
+	el := getEntities(t, 3)
+	owner, signingKey, foreign := el[0], el[1], el[2]
+
+	if err := handler.db.Add(openpgp.EntityList{signingKey}); err != nil {
+		t.Fatalf("unexpected error while adding signing key: %s", err)
+	}
+	published, err := openpgp.ReadArmoredKeyRing(strings.NewReader(getArmored(t, owner, false)))
+	if err != nil {
+		t.Fatalf("unexpected error while reading key: %s", err)
+	}
+	if err := handler.db.Add(published); err != nil {
+		t.Fatalf("unexpected error while adding key: %s", err)
+	}
+
+	// the key is resubmitted with a server certification and
+	// a certification by a third party key
+	resubmitted, err := openpgp.ReadArmoredKeyRing(strings.NewReader(getArmored(t, owner, false)))
+	if err != nil {
+		t.Fatalf("unexpected error while reading key: %s", err)
+	}
+	id := keyring.PrimaryIdentity(resubmitted[0])
+	for _, signer := range []*openpgp.Entity{signingKey, foreign} {
+		if err := keyring.Certify(resubmitted[0], id.Name, signer, 0); err != nil {
+			t.Fatalf("unexpected error while certifying key: %s", err)
+		}
+	}
+
+	if status := handler.submit(resubmitted, httptest.NewRequest("POST", "/pks/add", nil)); status.IsError() {
+		t.Fatalf("unexpected error status while submitting key")
+	}
+
+	fp := fmt.Sprintf("%X", owner.PrimaryKey.Fingerprint[:])
+	stored, err := handler.db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true})
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("unexpected error while retrieving key: %v", err)
+	}
+	id = keyring.PrimaryIdentity(stored[0])
+
+	if !keyring.IdentityCertifiedBy(stored[0], id, openpgp.EntityList{signingKey}) {
+		t.Errorf("server certification not stored")
+	}
+	for _, sig := range id.Signatures {
+		if sig.IssuerKeyId != nil && *sig.IssuerKeyId == foreign.PrimaryKey.KeyId {
+			t.Errorf("third party certification stored")
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hkpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	ServerKeyRoute  = "/pks/server-key"
+	ServerInfoRoute = "/pks/server-info"
+)
+
+// serverKeySignaturesPrefix is the state key prefix of the opaque
+// identity signatures published with the server signing keys.
+const serverKeySignaturesPrefix = "hkpserver" + database.StateSep + "server-key-signatures" + database.StateSep
+
+// GetServerKeySignatures returns the opaque identity signatures published
+// with the server signing key identified by its fingerprint, like GnuPG
+// trust signatures issued by an organisation key.
+func GetServerKeySignatures(state database.StateEngine, fp string) (keyring.OpaqueSignatures, error) {
+	b, err := state.GetState(serverKeySignaturesPrefix + fp)
+	if err == database.ErrNotFound {
+		return keyring.OpaqueSignatures{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	opaque := make(keyring.OpaqueSignatures)
+	if err := json.Unmarshal(b, &opaque); err != nil {
+		return nil, fmt.Errorf("while decoding server key signatures: %s", err)
+	}
+	return opaque, nil
+}
+
+// SetServerKeySignatures stores the opaque identity signatures published
+// with the server signing key identified by its fingerprint.
+func SetServerKeySignatures(state database.StateEngine, fp string, opaque keyring.OpaqueSignatures) error {
+	b, err := json.Marshal(opaque)
+	if err != nil {
+		return err
+	}
+	return state.SetState(serverKeySignaturesPrefix+fp, b, 0)
+}
+
+// ServerInfo describes the JSON response returned by the server
+// info endpoint.
+type ServerInfo struct {
+	// SigningKey is the fingerprint of the key currently used
+	// by the server to certify key identities.
+	SigningKey string `json:"signing_key"`
+	// ServerKeyURL is the path of the endpoint serving the public
+	// part of the signing keys.
+	ServerKeyURL string `json:"server_key_url"`
+	// SigningKeys lists the current and previous signing keys.
+	SigningKeys []ServerSigningKey `json:"signing_keys"`
+}
+
+// ServerSigningKey describes a server signing key.
+type ServerSigningKey struct {
+	Fingerprint string    `json:"fingerprint"`
+	Created     time.Time `json:"created"`
+	Current     bool      `json:"current"`
+	Revoked     bool      `json:"revoked"`
+}
+
+// serverSigningKeys returns the server signing keys, the current
+// signing key first followed by the previous signing keys from the
+// most recent to the oldest.
+func (h *hkpHandler) serverSigningKeys() (openpgp.EntityList, error) {
+	el, err := h.db.Get("", database.SearchOptions{Fingerprint: true, KeyType: database.SigningKey})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(el, func(i, j int) bool {
+		if h.isCurrentSigningKey(el[i]) {
+			return true
+		} else if h.isCurrentSigningKey(el[j]) {
+			return false
+		}
+		return el[i].PrimaryKey.CreationTime.After(el[j].PrimaryKey.CreationTime)
+	})
+
+	return el, nil
+}
+
+func (h *hkpHandler) isCurrentSigningKey(e *openpgp.Entity) bool {
+	return h.signingKey != nil && h.signingKey.PrimaryKey.Fingerprint == e.PrimaryKey.Fingerprint
+}
+
+// serverKey provides the /pks/server-key handler returning the public
+// part of the server signing keys, previous signing keys and their
+// revocations are included so past certifications remain checkable.
+// The imported opaque identity signatures are included as well.
+func (h *hkpHandler) serverKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	el, err := h.serverSigningKeys()
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	} else if len(el) == 0 {
+		NewNotFoundStatus().Write(w)
+		return
+	}
+
+	opaque := make(map[string]keyring.OpaqueSignatures)
+	if state, ok := database.GetStateEngine(h.db); ok {
+		for _, e := range el {
+			fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+			if opaque[fp], err = GetServerKeySignatures(state, fp); err != nil {
+				NewInternalServerErrorStatus(err.Error()).Write(w)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	if err := keyring.WriteArmoredKeyRingWithSignatures(w, el, opaque); err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+}
+
+// serverInfo provides the /pks/server-info handler returning the
+// fingerprint of the server signing keys so clients can pin them.
+func (h *hkpHandler) serverInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	el, err := h.serverSigningKeys()
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+
+	info := &ServerInfo{
+		ServerKeyURL: ServerKeyRoute,
+		SigningKeys:  make([]ServerSigningKey, 0, len(el)),
+	}
+
+	for _, e := range el {
+		sk := ServerSigningKey{
+			Fingerprint: fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]),
+			Created:     e.PrimaryKey.CreationTime.UTC(),
+			Current:     h.isCurrentSigningKey(e),
+			Revoked:     len(e.Revocations) > 0,
+		}
+		if sk.Current {
+			info.SigningKey = sk.Fingerprint
+		}
+		info.SigningKeys = append(info.SigningKeys, sk)
+	}
+
+	writeJSON(w, info)
+}
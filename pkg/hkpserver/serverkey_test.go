@@ -0,0 +1,102 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hkpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestServerKey(t *testing.T) {
+	handler := new(hkpHandler)
+
+	handler.db, _ = database.GetDatabaseEngine(defaultdb.Name)
+	if handler.db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := handler.db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer handler.db.Disconnect()
+
+	// no signing key stored yet
+	resp := httptest.NewRecorder()
+	handler.serverKey(resp, httptest.NewRequest("GET", ServerKeyRoute, nil))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("unexpected http status returned without signing key: got %d instead of %d", resp.Code, http.StatusNotFound)
+	}
+
+	// previous revoked signing key and current signing key
+	el := getEntities(t, 2)
+	previous, current := el[0], el[1]
+	if err := previous.RevokeKey(packet.KeySuperseded, "", nil); err != nil {
+		t.Fatalf("unexpected error while revoking key: %s", err)
+	}
+	if err := handler.db.Add(el); err != nil {
+		t.Fatalf("unexpected error while adding signing keys: %s", err)
+	}
+	handler.signingKey = current
+
+	resp = httptest.NewRecorder()
+	handler.serverKey(resp, httptest.NewRequest("GET", ServerKeyRoute, nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected http status: got %d instead of %d", resp.Code, http.StatusOK)
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error while reading server keys: %s", err)
+	} else if len(keys) != 2 {
+		t.Fatalf("unexpected number of server keys: got %d instead of 2", len(keys))
+	} else if keys[0].PrimaryKey.Fingerprint != current.PrimaryKey.Fingerprint {
+		t.Errorf("current signing key is not the first server key")
+	}
+	for _, k := range keys {
+		if k.PrivateKey != nil {
+			t.Errorf("private key of %X published", k.PrimaryKey.Fingerprint[:])
+		}
+		if k.PrimaryKey.Fingerprint == previous.PrimaryKey.Fingerprint && len(k.Revocations) == 0 {
+			t.Errorf("previous signing key published without its revocation")
+		}
+	}
+
+	resp = httptest.NewRecorder()
+	handler.serverInfo(resp, httptest.NewRequest("GET", ServerInfoRoute, nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected http status: got %d instead of %d", resp.Code, http.StatusOK)
+	}
+
+	info := new(ServerInfo)
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		t.Fatalf("unexpected error while decoding server info: %s", err)
+	}
+
+	fp := fmt.Sprintf("%X", current.PrimaryKey.Fingerprint[:])
+	if info.SigningKey != fp {
+		t.Errorf("unexpected signing key fingerprint: got %s instead of %s", info.SigningKey, fp)
+	} else if info.ServerKeyURL != ServerKeyRoute {
+		t.Errorf("unexpected server key url: got %s instead of %s", info.ServerKeyURL, ServerKeyRoute)
+	} else if len(info.SigningKeys) != 2 {
+		t.Fatalf("unexpected number of signing keys: got %d instead of 2", len(info.SigningKeys))
+	}
+	if sk := info.SigningKeys[0]; !sk.Current || sk.Revoked || sk.Fingerprint != fp {
+		t.Errorf("unexpected current signing key info: %+v", sk)
+	}
+	if sk := info.SigningKeys[1]; sk.Current || !sk.Revoked {
+		t.Errorf("unexpected previous signing key info: %+v", sk)
+	}
+
+	resp = httptest.NewRecorder()
+	handler.serverInfo(resp, httptest.NewRequest("POST", ServerInfoRoute, nil))
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected http status: got %d instead of %d", resp.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,351 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hkpserver
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	ChallengeRoute = "/pks/challenge"
+	SignedRoute    = "/pks/signed"
+)
+
+// Operations supported by signed requests.
+const (
+	SignedDelete = "delete"
+	SignedUpdate = "update"
+)
+
+const (
+	// nonceLifetime is the time during which a nonce can be used
+	// to sign a request.
+	nonceLifetime = 5 * time.Minute
+	// nonceRandomSize is the size of the random part of nonces.
+	nonceRandomSize = 16
+	// nonceMACSize is the size of the truncated nonce HMAC.
+	nonceMACSize = 16
+)
+
+// ChallengeResponse describes the JSON response returned by the
+// challenge endpoint.
+type ChallengeResponse struct {
+	Nonce   string    `json:"nonce"`
+	Expires time.Time `json:"expires"`
+}
+
+// SignedPayload returns the data to sign for a signed request, the
+// request signature is a detached signature of this payload made
+// with the key identified by the fingerprint. The key text is empty
+// for delete requests.
+func SignedPayload(op, fingerprint, nonce, keytext string) []byte {
+	return []byte(op + "\n" + strings.ToUpper(fingerprint) + "\n" + nonce + "\n" + keytext)
+}
+
+// nonces issues stateless nonces authenticated by an HMAC with a
+// per process secret, issuing nonces doesn't consume any server
+// resource. Nonces are encoded as the expiration time followed by
+// random bytes and the HMAC of both. Only the used nonces are stored,
+// until they expire, so they can't be replayed.
+type nonces struct {
+	sync.Mutex
+	once   sync.Once
+	secret []byte
+	err    error
+	used   map[string]struct{}
+	expiry nonceQueue
+}
+
+// usedNonce is a used nonce queued until it expires.
+type usedNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+// nonceQueue orders the used nonces by expiration time so the expired
+// ones are removed without going through all the used nonces.
+type nonceQueue []usedNonce
+
+func (q nonceQueue) Len() int            { return len(q) }
+func (q nonceQueue) Less(i, j int) bool  { return q[i].expires.Before(q[j].expires) }
+func (q nonceQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *nonceQueue) Push(x interface{}) { *q = append(*q, x.(usedNonce)) }
+
+func (q *nonceQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+func (n *nonces) key() ([]byte, error) {
+	n.once.Do(func() {
+		n.secret = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, n.secret); err != nil {
+			n.err = err
+		}
+	})
+	return n.secret, n.err
+}
+
+func (n *nonces) mac(secret, b []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(b)
+	return mac.Sum(nil)[:nonceMACSize]
+}
+
+func (n *nonces) add() (string, time.Time, error) {
+	secret, err := n.key()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expires := time.Unix(time.Now().Add(nonceLifetime).Unix(), 0)
+
+	b := make([]byte, 8+nonceRandomSize)
+	binary.BigEndian.PutUint64(b, uint64(expires.Unix()))
+	if _, err := io.ReadFull(rand.Reader, b[8:]); err != nil {
+		return "", time.Time{}, err
+	}
+	b = append(b, n.mac(secret, b)...)
+
+	return hex.EncodeToString(b), expires, nil
+}
+
+// check returns whether the nonce was issued by this server and
+// hasn't expired, without recording anything. The canonical form of
+// the nonce and its expiration time are returned along.
+func (n *nonces) check(nonce string) (string, time.Time, bool) {
+	secret, err := n.key()
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 8+nonceRandomSize+nonceMACSize {
+		return "", time.Time{}, false
+	}
+	data, sum := b[:8+nonceRandomSize], b[8+nonceRandomSize:]
+	if !hmac.Equal(sum, n.mac(secret, data)) {
+		return "", time.Time{}, false
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
+	if !time.Now().Before(expires) {
+		return "", time.Time{}, false
+	}
+
+	// nonces are hex decoded case insensitively
+	return hex.EncodeToString(b), expires, true
+}
+
+// consume marks the nonce as used and returns whether it was valid.
+// The used nonces expired in the meantime are removed first.
+func (n *nonces) consume(nonce string) bool {
+	nonce, expires, ok := n.check(nonce)
+	if !ok {
+		return false
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	now := time.Now()
+	for n.expiry.Len() > 0 && now.After(n.expiry[0].expires) {
+		delete(n.used, heap.Pop(&n.expiry).(usedNonce).nonce)
+	}
+
+	if n.used == nil {
+		n.used = make(map[string]struct{})
+	} else if _, ok := n.used[nonce]; ok {
+		return false
+	}
+	n.used[nonce] = struct{}{}
+	heap.Push(&n.expiry, usedNonce{nonce: nonce, expires: expires})
+
+	return true
+}
+
+// challenge provides the /pks/challenge handler returning a single
+// use nonce to sign requests with.
+func (h *hkpHandler) challenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	nonce, expires, err := h.nonces.add()
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(&ChallengeResponse{
+		Nonce:   nonce,
+		Expires: expires.UTC(),
+	})
+}
+
+// signed provides the /pks/signed handler, it deletes or updates
+// a stored key when the request is signed by the key itself over
+// a nonce obtained from the challenge endpoint.
+func (h *hkpHandler) signed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	if l, ok := w.(*logResponseWriter); ok {
+		if h.pushLimitReached(l.ip) {
+			NewTooManyRequestStatus().Write(w)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+
+	if err := r.ParseForm(); err != nil {
+		NewBadRequestStatus(err.Error()).Write(w)
+		return
+	}
+
+	op := r.PostForm.Get("op")
+	fp := strings.ToUpper(strings.TrimPrefix(r.PostForm.Get("fingerprint"), "0x"))
+	nonce := r.PostForm.Get("nonce")
+	keytext := r.PostForm.Get("keytext")
+	signature := r.PostForm.Get("signature")
+
+	if op != SignedDelete && op != SignedUpdate {
+		NewBadRequestStatus("Unknown operation", op).Write(w)
+		return
+	} else if !isHex(fp, 40) {
+		NewBadRequestStatus("Fingerprint must be 40 hexadecimal characters").Write(w)
+		return
+	} else if signature == "" {
+		NewBadRequestStatus("Missing request signature").Write(w)
+		return
+	}
+
+	// the nonce is only recorded once the request signature is
+	// verified, so unsigned requests don't grow the used nonces
+	if _, _, ok := h.nonces.check(nonce); !ok {
+		NewForbiddenStatus("Unknown or expired nonce").Write(w)
+		return
+	}
+
+	stored, err := h.storedKey(fp)
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	} else if stored == nil {
+		NewNotFoundStatus().Write(w)
+		return
+	}
+
+	payload := SignedPayload(op, fp, nonce, keytext)
+	_, err = openpgp.CheckArmoredDetachedSignature(
+		openpgp.EntityList{stored},
+		bytes.NewReader(payload),
+		strings.NewReader(signature),
+		nil,
+	)
+	if err != nil {
+		NewForbiddenStatus("Request signature verification failed").Write(w)
+		return
+	}
+
+	if !h.nonces.consume(nonce) {
+		NewForbiddenStatus("Nonce already used").Write(w)
+		return
+	}
+
+	switch op {
+	case SignedDelete:
+		h.signedDelete(stored).Write(w)
+	case SignedUpdate:
+		h.signedUpdate(stored, keytext).Write(w)
+	}
+}
+
+// storedKey returns the stored public key matching the fingerprint,
+// signing keys are never returned so they can't be altered by signed
+// requests.
+func (h *hkpHandler) storedKey(fp string) (*openpgp.Entity, error) {
+	el, err := h.db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true, KeyType: database.SigningKey})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range el {
+		if fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]) == fp {
+			return nil, nil
+		}
+	}
+
+	el, err = h.db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range el {
+		if fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]) == fp {
+			return e, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (h *hkpHandler) signedDelete(e *openpgp.Entity) Status {
+	if err := h.db.Del(openpgp.EntityList{e}); err != nil {
+		return newDatabaseErrorStatus(err)
+	}
+	return NewOKStatus("Key deleted successfully")
+}
+
+// signedUpdate merges the submitted key with the stored one, the
+// update can't add identities as they wouldn't go through the
+// verification process.
+func (h *hkpHandler) signedUpdate(stored *openpgp.Entity, keytext string) Status {
+	el, err := openpgp.ReadArmoredKeyRing(strings.NewReader(keytext))
+	if err != nil {
+		return NewBadRequestStatus(err.Error())
+	} else if len(el) != 1 {
+		return NewBadRequestStatus("Exactly one key must be submitted")
+	}
+
+	e := el[0]
+	if e.PrivateKey != nil {
+		return NewBadRequestStatus("Keys submitted must not contain private key")
+	} else if e.PrimaryKey.Fingerprint != stored.PrimaryKey.Fingerprint {
+		return NewBadRequestStatus("Submitted key doesn't match the request fingerprint")
+	}
+	for name := range e.Identities {
+		if _, ok := stored.Identities[name]; !ok {
+			return NewConflictStatus("Key rejected, identities can't be added by signed requests")
+		}
+	}
+
+	if err := database.Merge(h.db, el); err != nil {
+		return newDatabaseErrorStatus(err)
+	}
+
+	return NewOKStatus("Key updated successfully")
+}
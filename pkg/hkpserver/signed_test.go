@@ -0,0 +1,238 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hkpserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"golang.org/x/crypto/openpgp"
+)
+
+func getNonce(t *testing.T, h *hkpHandler) string {
+	resp := httptest.NewRecorder()
+	h.challenge(resp, httptest.NewRequest("GET", ChallengeRoute, nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected http status returned for challenge: got %d instead of %d", resp.Code, http.StatusOK)
+	}
+	var cr ChallengeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cr); err != nil {
+		t.Fatalf("unexpected error while decoding challenge: %s", err)
+	}
+	return cr.Nonce
+}
+
+func signRequest(t *testing.T, signer *openpgp.Entity, op, fp, nonce, keytext string) string {
+	b := new(bytes.Buffer)
+	payload := SignedPayload(op, fp, nonce, keytext)
+	if err := openpgp.ArmoredDetachSign(b, signer, bytes.NewReader(payload), nil); err != nil {
+		t.Fatalf("unexpected error while signing request: %s", err)
+	}
+	return b.String()
+}
+
+func TestSigned(t *testing.T) {
+	handler := new(hkpHandler)
+	handler.maxBodyBytes = 1 << 18
+
+	handler.db, _ = database.GetDatabaseEngine(defaultdb.Name)
+	if handler.db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := handler.db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer handler.db.Disconnect()
+
+	el := getEntities(t, 2)
+	owner, other := el[0], el[1]
+	fp := fmt.Sprintf("%X", owner.PrimaryKey.Fingerprint[:])
+
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(getArmored(t, owner, false)))
+	if err != nil {
+		t.Fatalf("unexpected error while reading key: %s", err)
+	}
+	if err := handler.db.Add(keys); err != nil {
+		t.Fatalf("unexpected error while adding keys: %s", err)
+	}
+
+	keytext := getArmored(t, owner, false)
+
+	tests := []struct {
+		name    string
+		op      string
+		signer  *openpgp.Entity
+		keytext string
+		nonce   string
+		code    int
+		// consumed is whether the nonce is used up by the request
+		consumed bool
+	}{
+		{
+			name:   "unknown operation",
+			op:     "add",
+			signer: owner,
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "unknown nonce",
+			op:     SignedDelete,
+			signer: owner,
+			nonce:  "unknown",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "signed by another key",
+			op:     SignedDelete,
+			signer: other,
+			code:   http.StatusForbidden,
+		},
+		{
+			name:     "update",
+			op:       SignedUpdate,
+			signer:   owner,
+			keytext:  keytext,
+			code:     http.StatusOK,
+			consumed: true,
+		},
+		{
+			name:     "update with another key",
+			op:       SignedUpdate,
+			signer:   owner,
+			keytext:  getArmored(t, other, false),
+			code:     http.StatusBadRequest,
+			consumed: true,
+		},
+		{
+			name:     "delete",
+			op:       SignedDelete,
+			signer:   owner,
+			code:     http.StatusOK,
+			consumed: true,
+		},
+		{
+			name:   "delete twice",
+			op:     SignedDelete,
+			signer: owner,
+			code:   http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		nonce := tt.nonce
+		if nonce == "" {
+			nonce = getNonce(t, handler)
+		}
+
+		form := url.Values{
+			"op":          {tt.op},
+			"fingerprint": {fp},
+			"nonce":       {nonce},
+			"keytext":     {tt.keytext},
+			"signature":   {signRequest(t, tt.signer, tt.op, fp, nonce, tt.keytext)},
+		}
+
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", SignedRoute, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		handler.signed(resp, req)
+
+		if resp.Code != tt.code {
+			t.Errorf("unexpected http status returned for %q: got %d instead of %d", tt.name, resp.Code, tt.code)
+		}
+
+		// nonces are single use and only used up by signed requests
+		if tt.consumed && handler.nonces.consume(nonce) {
+			t.Errorf("nonce not consumed for %q", tt.name)
+		} else if !tt.consumed && tt.nonce == "" && !handler.nonces.consume(nonce) {
+			t.Errorf("nonce consumed for %q", tt.name)
+		}
+	}
+
+	el, err = handler.db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true})
+	if err != nil {
+		t.Fatalf("unexpected error while retrieving key: %s", err)
+	} else if len(el) != 0 {
+		t.Errorf("deleted key still stored")
+	}
+}
+
+func TestNonces(t *testing.T) {
+	var n, other nonces
+
+	nonce, expires, err := n.add()
+	if err != nil {
+		t.Fatalf("unexpected error while issuing nonce: %s", err)
+	} else if d := time.Until(expires); d > nonceLifetime || d < nonceLifetime-time.Minute {
+		t.Errorf("unexpected nonce expiration: expires in %s", d)
+	}
+
+	b, err := hex.DecodeString(nonce)
+	if err != nil {
+		t.Fatalf("unexpected error while decoding nonce: %s", err)
+	}
+	secret, _ := n.key()
+
+	tampered := append([]byte{}, b...)
+	tampered[10] ^= 1
+
+	// nonce with a valid HMAC but expired
+	expired := append([]byte{}, b[:8+nonceRandomSize]...)
+	binary.BigEndian.PutUint64(expired, uint64(time.Now().Add(-time.Second).Unix()))
+	expired = append(expired, n.mac(secret, expired)...)
+
+	otherNonce, _, err := other.add()
+	if err != nil {
+		t.Fatalf("unexpected error while issuing nonce: %s", err)
+	}
+
+	tests := []struct {
+		name  string
+		nonce string
+		valid bool
+	}{
+		{"empty nonce", "", false},
+		{"malformed nonce", "not a nonce", false},
+		{"truncated nonce", nonce[:len(nonce)-2], false},
+		{"tampered nonce", hex.EncodeToString(tampered), false},
+		{"expired nonce", hex.EncodeToString(expired), false},
+		{"nonce issued by another server", otherNonce, false},
+		{"valid nonce", nonce, true},
+		{"used nonce", nonce, false},
+		{"used nonce capitalized", strings.ToUpper(nonce), false},
+	}
+
+	for _, tt := range tests {
+		if valid := n.consume(tt.nonce); valid != tt.valid {
+			t.Errorf("unexpected result for %s: got %v instead of %v", tt.name, valid, tt.valid)
+		}
+	}
+
+	// expired used nonces are removed once another nonce is used
+	n.expiry[0].expires = time.Now().Add(-time.Second)
+	next, _, err := n.add()
+	if err != nil {
+		t.Fatalf("unexpected error while issuing nonce: %s", err)
+	}
+	if !n.consume(next) {
+		t.Errorf("valid nonce rejected")
+	}
+	if _, ok := n.used[nonce]; ok {
+		t.Errorf("expired used nonce still stored")
+	} else if len(n.used) != 1 || n.expiry.Len() != 1 {
+		t.Errorf("unexpected number of used nonces: %d", len(n.used))
+	}
+}
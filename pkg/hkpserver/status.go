@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+
+	"github.com/ctrliq/spks/pkg/database"
 )
 
 // ErrorResponse describes a JSON error response.
@@ -53,6 +55,10 @@ func NewBadRequestStatus(message ...string) Status {
 	return NewStatus(http.StatusBadRequest, true, message...)
 }
 
+func NewUnauthorizedStatus(message ...string) Status {
+	return NewStatus(http.StatusUnauthorized, true, message...)
+}
+
 func NewForbiddenStatus(message ...string) Status {
 	return NewStatus(http.StatusForbidden, true, message...)
 }
@@ -81,14 +87,33 @@ func NewTooManyRequestStatus(message ...string) Status {
 	return NewStatus(http.StatusTooManyRequests, true, message...)
 }
 
+// NewTooManyResultsStatus returns the status of a lookup matching more
+// keys than the server returns at once, the lookup is valid but can't
+// be processed without a more specific search or a requested page.
+func NewTooManyResultsStatus(message ...string) Status {
+	if len(message) == 0 {
+		message = []string{"Too many keys found, refine the search or request a page with the offset and limit parameters"}
+	}
+	return NewStatus(http.StatusUnprocessableEntity, true, message...)
+}
+
+// newDatabaseErrorStatus returns the status corresponding to an error
+// returned while updating the database.
+func newDatabaseErrorStatus(err error) Status {
+	if err == database.ErrReadOnly {
+		return NewForbiddenStatus("Keys can't be updated, the server database is read-only")
+	}
+	return NewInternalServerErrorStatus(err.Error())
+}
+
 func (s *status) IsError() bool {
 	return s.isError
 }
 
 func (s *status) Write(w http.ResponseWriter) {
 	if s.isError || s.code == http.StatusAccepted {
-		w.WriteHeader(s.code)
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(s.code)
 		json.NewEncoder(w).Encode(&ErrorResponse{
 			&Error{
 				Code:    s.code,
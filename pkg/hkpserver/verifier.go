@@ -4,6 +4,7 @@
 package hkpserver
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/ctrliq/spks/pkg/database"
@@ -16,3 +17,10 @@ type Verifier interface {
 	Init(database.Engine, *http.ServeMux) error
 	Verify(openpgp.EntityList, *http.Request) (openpgp.EntityList, Status)
 }
+
+// BackgroundVerifier is an optional interface implemented by verifiers
+// running background jobs. Run is called in its own goroutine once the
+// verifier is initialized and must return when the context is done.
+type BackgroundVerifier interface {
+	Run(context.Context)
+}
@@ -0,0 +1,441 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hkpserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	VKSFingerprintRoute   = "/vks/v1/by-fingerprint/"
+	VKSKeyIDRoute         = "/vks/v1/by-keyid/"
+	VKSEmailRoute         = "/vks/v1/by-email/"
+	VKSUploadRoute        = "/vks/v1/upload"
+	VKSRequestVerifyRoute = "/vks/v1/request-verify"
+)
+
+// Email address status as returned by the VKS upload and
+// request-verify endpoints.
+const (
+	VKSStatusUnpublished = "unpublished"
+	VKSStatusPending     = "pending"
+	VKSStatusPublished   = "published"
+	VKSStatusRevoked     = "revoked"
+)
+
+// vksSessionLifetime is the time during which a verification
+// can be requested for an uploaded key.
+const vksSessionLifetime = 1 * time.Hour
+
+// vksMaxSessions is the maximum number of upload sessions kept, the
+// oldest session is dropped to make room for a new upload.
+const vksMaxSessions = 10000
+
+// VKSUploadRequest describes the JSON body of a VKS upload request.
+type VKSUploadRequest struct {
+	Keytext string `json:"keytext"`
+}
+
+// VKSVerifyRequest describes the JSON body of a VKS request-verify request.
+type VKSVerifyRequest struct {
+	Token     string   `json:"token"`
+	Addresses []string `json:"addresses"`
+	Locale    []string `json:"locale,omitempty"`
+}
+
+// VKSResponse describes the JSON response returned by the VKS upload
+// and request-verify endpoints.
+type VKSResponse struct {
+	KeyFingerprint string            `json:"key_fpr"`
+	Status         map[string]string `json:"status"`
+	Token          string            `json:"token"`
+}
+
+// vksSession holds an uploaded key until a verification is requested.
+// The key is kept serialized, each request reads its own copy as the
+// submission process modifies the submitted key.
+type vksSession struct {
+	key     []byte
+	pending map[string]bool
+	expires time.Time
+}
+
+// entity returns a copy of the uploaded key.
+func (s *vksSession) entity() (*openpgp.Entity, error) {
+	return openpgp.ReadEntity(packet.NewReader(bytes.NewReader(s.key)))
+}
+
+// vksSessions stores the VKS upload sessions by token.
+type vksSessions struct {
+	sync.Mutex
+	sessions map[string]*vksSession
+	// order holds the session tokens by creation time, which is also
+	// their expiration order as sessions share the same lifetime
+	order []string
+	// max is the maximum number of sessions, vksMaxSessions if zero
+	max int
+}
+
+func (vs *vksSessions) add(e *openpgp.Entity) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := keyring.Serialize(buf, e); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	vs.Lock()
+	defer vs.Unlock()
+
+	max := vs.max
+	if max <= 0 {
+		max = vksMaxSessions
+	}
+
+	// drop the expired sessions and the oldest ones above the limit
+	now := time.Now()
+	for len(vs.order) > 0 {
+		oldest := vs.order[0]
+		if len(vs.sessions) < max && !now.After(vs.sessions[oldest].expires) {
+			break
+		}
+		delete(vs.sessions, oldest)
+		vs.order = vs.order[1:]
+	}
+	if vs.sessions == nil {
+		vs.sessions = make(map[string]*vksSession)
+	}
+	vs.sessions[token] = &vksSession{
+		key:     buf.Bytes(),
+		pending: make(map[string]bool),
+		expires: now.Add(vksSessionLifetime),
+	}
+	vs.order = append(vs.order, token)
+
+	return token, nil
+}
+
+func (vs *vksSessions) get(token string) *vksSession {
+	vs.Lock()
+	defer vs.Unlock()
+
+	s, ok := vs.sessions[token]
+	if !ok || time.Now().After(s.expires) {
+		return nil
+	}
+	return s
+}
+
+// writeKeys writes the armored keys or a not found status if
+// the list is empty.
+func writeKeys(w http.ResponseWriter, el openpgp.EntityList) {
+	if len(el) == 0 {
+		NewNotFoundStatus().Write(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	if err := keyring.WriteArmoredKeyRing(w, el); err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+	}
+}
+
+// isHex returns whether s is an hexadecimal string of n characters.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// vksByFingerprint provides the /vks/v1/by-fingerprint handler.
+func (h *hkpHandler) vksByFingerprint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	fp := strings.ToUpper(strings.TrimPrefix(r.URL.Path, VKSFingerprintRoute))
+	if !isHex(fp, 40) {
+		NewBadRequestStatus("Fingerprint must be 40 hexadecimal characters").Write(w)
+		return
+	}
+
+	// the key is also found by one of its subkey fingerprints
+	el, status := h.search(r.URL.Query(), fp, database.SearchOptions{Fingerprint: true, Exact: true})
+	if status != nil {
+		status.Write(w)
+		return
+	}
+
+	writeKeys(w, el)
+}
+
+// vksByKeyID provides the /vks/v1/by-keyid handler.
+func (h *hkpHandler) vksByKeyID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	id := strings.ToUpper(strings.TrimPrefix(r.URL.Path, VKSKeyIDRoute))
+	if !isHex(id, 16) {
+		NewBadRequestStatus("Key ID must be 16 hexadecimal characters").Write(w)
+		return
+	}
+
+	el, status := h.search(r.URL.Query(), id, database.SearchOptions{Fingerprint: true, Exact: true})
+	if status != nil {
+		status.Write(w)
+		return
+	}
+
+	writeKeys(w, el)
+}
+
+// vksByEmail provides the /vks/v1/by-email handler.
+func (h *hkpHandler) vksByEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	email := strings.TrimPrefix(r.URL.Path, VKSEmailRoute)
+	if _, _, ok := splitEmail(email); !ok {
+		NewBadRequestStatus("Invalid email address").Write(w)
+		return
+	}
+
+	el, status := h.search(r.URL.Query(), email, database.SearchOptions{Exact: true})
+	if status != nil {
+		status.Write(w)
+		return
+	}
+
+	writeKeys(w, el)
+}
+
+// vksStatus returns the publication status of each email address
+// found in the key identities.
+func (h *hkpHandler) vksStatus(e *openpgp.Entity, pending map[string]bool) (map[string]string, error) {
+	var stored *openpgp.Entity
+
+	fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+	el, err := h.db.Get(fp, database.SearchOptions{Fingerprint: true, Exact: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, dbe := range el {
+		if dbe.PrimaryKey.Fingerprint == e.PrimaryKey.Fingerprint {
+			stored = dbe
+		}
+	}
+
+	var signingKeys openpgp.EntityList
+	if h.verifier != nil {
+		signingKeys, err = h.db.Get("", database.SearchOptions{Fingerprint: true, KeyType: database.SigningKey})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	status := make(map[string]string)
+
+	for name, id := range e.Identities {
+		email := id.UserId.Email
+		if email == "" {
+			continue
+		}
+		status[email] = VKSStatusUnpublished
+
+		if stored != nil {
+			if sid, ok := stored.Identities[name]; ok {
+				if keyring.IdentityRevoked(stored, sid) {
+					status[email] = VKSStatusRevoked
+					continue
+				} else if h.verifier == nil || keyring.IdentityCertifiedBy(stored, sid, signingKeys) {
+					status[email] = VKSStatusPublished
+					continue
+				}
+			}
+		}
+		if pending[email] {
+			status[email] = VKSStatusPending
+		}
+	}
+
+	return status, nil
+}
+
+func writeVKSResponse(w http.ResponseWriter, resp *VKSResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// vksUpload provides the /vks/v1/upload handler, the uploaded key
+// is kept until a verification is requested for its email addresses.
+func (h *hkpHandler) vksUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	if l, ok := w.(*logResponseWriter); ok {
+		if h.pushLimitReached(l.ip) {
+			NewTooManyRequestStatus().Write(w)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+
+	var req VKSUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		NewBadRequestStatus("Invalid JSON request").Write(w)
+		return
+	}
+
+	el, err := openpgp.ReadArmoredKeyRing(strings.NewReader(req.Keytext))
+	if err != nil {
+		NewBadRequestStatus(err.Error()).Write(w)
+		return
+	} else if len(el) != 1 {
+		NewBadRequestStatus("Exactly one key must be uploaded").Write(w)
+		return
+	} else if el[0].PrivateKey != nil {
+		NewBadRequestStatus("Keys submitted must not contain private key").Write(w)
+		return
+	}
+
+	e := el[0]
+
+	token, err := h.vksSessions.add(e)
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+
+	status, err := h.vksStatus(e, nil)
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+
+	writeVKSResponse(w, &VKSResponse{
+		KeyFingerprint: fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]),
+		Status:         status,
+		Token:          token,
+	})
+}
+
+// vksRequestVerify provides the /vks/v1/request-verify handler, the
+// uploaded key goes through the same submission process as /pks/add.
+func (h *hkpHandler) vksRequestVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	if l, ok := w.(*logResponseWriter); ok {
+		if h.pushLimitReached(l.ip) {
+			NewTooManyRequestStatus().Write(w)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+
+	var req VKSVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		NewBadRequestStatus("Invalid JSON request").Write(w)
+		return
+	}
+
+	session := h.vksSessions.get(req.Token)
+	if session == nil {
+		NewNotFoundStatus("Unknown or expired token").Write(w)
+		return
+	}
+
+	e, err := session.entity()
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+
+	requested := false
+	primary := keyring.PrimaryIdentity(e)
+
+	for _, address := range req.Addresses {
+		found := false
+		for _, id := range e.Identities {
+			if id.UserId.Email == address {
+				found = true
+				break
+			}
+		}
+		if !found {
+			NewBadRequestStatus("Address not found in key identities", address).Write(w)
+			return
+		}
+		if primary != nil && primary.UserId.Email == address {
+			requested = true
+		}
+	}
+
+	// only the primary identity goes through the verification
+	// process, so its address must be part of the request
+	if !requested {
+		NewBadRequestStatus("Only the address of the primary identity can be verified").Write(w)
+		return
+	}
+
+	status := h.submit(openpgp.EntityList{e}, r)
+	if status.IsError() {
+		status.Write(w)
+		return
+	}
+
+	// the pending addresses are copied so the sessions aren't locked
+	// while the status is read from the database
+	h.vksSessions.Lock()
+	if status.Is(http.StatusAccepted) {
+		session.pending[primary.UserId.Email] = true
+	}
+	pending := make(map[string]bool, len(session.pending))
+	for address := range session.pending {
+		pending[address] = true
+	}
+	h.vksSessions.Unlock()
+
+	addressStatus, err := h.vksStatus(e, pending)
+	if err != nil {
+		NewInternalServerErrorStatus(err.Error()).Write(w)
+		return
+	}
+
+	writeVKSResponse(w, &VKSResponse{
+		KeyFingerprint: fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]),
+		Status:         addressStatus,
+		Token:          req.Token,
+	})
+}
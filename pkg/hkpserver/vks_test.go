@@ -0,0 +1,261 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hkpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func vksPost(t *testing.T, handler func(http.ResponseWriter, *http.Request), path string, body interface{}) *httptest.ResponseRecorder {
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("unexpected error while marshaling request: %s", err)
+	}
+	resp := httptest.NewRecorder()
+	handler(resp, httptest.NewRequest("POST", "http://localhost"+path, bytes.NewReader(b)))
+	return resp
+}
+
+func vksResponse(t *testing.T, resp *httptest.ResponseRecorder) *VKSResponse {
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected http status returned: got %d instead of %d", resp.Code, http.StatusOK)
+	}
+	vr := new(VKSResponse)
+	if err := json.Unmarshal(resp.Body.Bytes(), vr); err != nil {
+		t.Fatalf("unexpected error while unmarshaling response: %s", err)
+	}
+	return vr
+}
+
+func TestVKS(t *testing.T) {
+	handler := new(hkpHandler)
+	handler.maxBodyBytes = int64(1 << 18)
+
+	handler.db, _ = database.GetDatabaseEngine(defaultdb.Name)
+	if handler.db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := handler.db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer handler.db.Disconnect()
+
+	el := getEntities(t, 1)
+	e := el[0]
+	fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+	email := "test0@example.com"
+
+	// upload doesn't publish the key
+	upload := &VKSUploadRequest{Keytext: getArmored(t, e, false)}
+	vr := vksResponse(t, vksPost(t, handler.vksUpload, VKSUploadRoute, upload))
+	if vr.KeyFingerprint != fp {
+		t.Errorf("unexpected fingerprint: got %s instead of %s", vr.KeyFingerprint, fp)
+	}
+	if vr.Status[email] != VKSStatusUnpublished {
+		t.Errorf("unexpected status for %s: got %s instead of %s", email, vr.Status[email], VKSStatusUnpublished)
+	}
+
+	resp := httptest.NewRecorder()
+	handler.vksByFingerprint(resp, httptest.NewRequest("GET", "http://localhost"+VKSFingerprintRoute+fp, nil))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("unexpected http status for unpublished key: got %d instead of %d", resp.Code, http.StatusNotFound)
+	}
+
+	// verification pending
+	handler.verifier = &acceptedVerifier{}
+	verify := &VKSVerifyRequest{Token: vr.Token, Addresses: []string{email}}
+	vr = vksResponse(t, vksPost(t, handler.vksRequestVerify, VKSRequestVerifyRoute, verify))
+	if vr.Status[email] != VKSStatusPending {
+		t.Errorf("unexpected status for %s: got %s instead of %s", email, vr.Status[email], VKSStatusPending)
+	}
+
+	// unknown address
+	verify.Addresses = []string{"unknown@example.com"}
+	resp = vksPost(t, handler.vksRequestVerify, VKSRequestVerifyRoute, verify)
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("unexpected http status for unknown address: got %d instead of %d", resp.Code, http.StatusBadRequest)
+	}
+
+	// unknown token
+	resp = vksPost(t, handler.vksRequestVerify, VKSRequestVerifyRoute, &VKSVerifyRequest{Token: "unknown"})
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("unexpected http status for unknown token: got %d instead of %d", resp.Code, http.StatusNotFound)
+	}
+
+	// verification succeeded
+	handler.verifier = nil
+	verify.Addresses = []string{email}
+	vr = vksResponse(t, vksPost(t, handler.vksRequestVerify, VKSRequestVerifyRoute, verify))
+	if vr.Status[email] != VKSStatusPublished {
+		t.Errorf("unexpected status for %s: got %s instead of %s", email, vr.Status[email], VKSStatusPublished)
+	}
+
+	tests := []struct {
+		name    string
+		handler func(http.ResponseWriter, *http.Request)
+		path    string
+		code    int
+	}{
+		{
+			name:    "by fingerprint",
+			handler: handler.vksByFingerprint,
+			path:    VKSFingerprintRoute + fp,
+			code:    http.StatusOK,
+		},
+		{
+			name:    "by bad fingerprint",
+			handler: handler.vksByFingerprint,
+			path:    VKSFingerprintRoute + e.PrimaryKey.KeyIdString(),
+			code:    http.StatusBadRequest,
+		},
+		{
+			name:    "by key ID",
+			handler: handler.vksByKeyID,
+			path:    VKSKeyIDRoute + e.PrimaryKey.KeyIdString(),
+			code:    http.StatusOK,
+		},
+		{
+			name:    "by unknown key ID",
+			handler: handler.vksByKeyID,
+			path:    VKSKeyIDRoute + "0000000000000000",
+			code:    http.StatusNotFound,
+		},
+		{
+			name:    "by email",
+			handler: handler.vksByEmail,
+			path:    VKSEmailRoute + email,
+			code:    http.StatusOK,
+		},
+		{
+			name:    "by unknown email",
+			handler: handler.vksByEmail,
+			path:    VKSEmailRoute + "unknown@example.com",
+			code:    http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		resp := httptest.NewRecorder()
+		tt.handler(resp, httptest.NewRequest("GET", "http://localhost"+tt.path, nil))
+		if resp.Code != tt.code {
+			t.Errorf("unexpected http status returned for %q: got %d instead of %d", tt.name, resp.Code, tt.code)
+		}
+	}
+}
+
+func TestVKSSessions(t *testing.T) {
+	handler := new(hkpHandler)
+	handler.maxBodyBytes = int64(1 << 18)
+	handler.verifier = &acceptedVerifier{}
+
+	handler.db, _ = database.GetDatabaseEngine(defaultdb.Name)
+	if handler.db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := handler.db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer handler.db.Disconnect()
+
+	e := getEntities(t, 1)[0]
+
+	// add a secondary identity
+	sig := *keyring.PrimaryIdentity(e).SelfSignature
+	notPrimary := false
+	sig.IsPrimaryId = &notPrimary
+	uid := packet.NewUserId("Secondary", "", "secondary@example.com")
+	if err := sig.SignUserId(uid.Id, e.PrimaryKey, e.PrivateKey, nil); err != nil {
+		t.Fatalf("unexpected error while signing user ID: %s", err)
+	}
+	e.Identities[uid.Id] = &openpgp.Identity{
+		Name:          uid.Id,
+		UserId:        uid,
+		SelfSignature: &sig,
+		Signatures:    []*packet.Signature{&sig},
+	}
+
+	upload := &VKSUploadRequest{Keytext: getArmored(t, e, false)}
+	vr := vksResponse(t, vksPost(t, handler.vksUpload, VKSUploadRoute, upload))
+
+	// each request reads its own copy of the uploaded key
+	session := handler.vksSessions.get(vr.Token)
+	e1, err := session.entity()
+	if err != nil {
+		t.Fatalf("unexpected error while reading session key: %s", err)
+	}
+	e1.Identities = nil
+	if e2, err := session.entity(); err != nil {
+		t.Fatalf("unexpected error while reading session key: %s", err)
+	} else if len(e2.Identities) != 2 {
+		t.Errorf("session key modified through a previous copy")
+	}
+
+	// the primary identity address must be requested
+	verify := &VKSVerifyRequest{Token: vr.Token, Addresses: []string{"secondary@example.com"}}
+	resp := vksPost(t, handler.vksRequestVerify, VKSRequestVerifyRoute, verify)
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("unexpected http status for secondary address: got %d instead of %d", resp.Code, http.StatusBadRequest)
+	}
+	verify.Addresses = nil
+	resp = vksPost(t, handler.vksRequestVerify, VKSRequestVerifyRoute, verify)
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("unexpected http status without address: got %d instead of %d", resp.Code, http.StatusBadRequest)
+	}
+
+	// only the primary identity is pending
+	verify.Addresses = []string{"test0@example.com", "secondary@example.com"}
+	vr = vksResponse(t, vksPost(t, handler.vksRequestVerify, VKSRequestVerifyRoute, verify))
+	if vr.Status["test0@example.com"] != VKSStatusPending {
+		t.Errorf("unexpected status for primary address: got %s instead of %s", vr.Status["test0@example.com"], VKSStatusPending)
+	}
+	if vr.Status["secondary@example.com"] != VKSStatusUnpublished {
+		t.Errorf("unexpected status for secondary address: got %s instead of %s", vr.Status["secondary@example.com"], VKSStatusUnpublished)
+	}
+
+	// the oldest session is dropped once the limit is reached
+	vs := &vksSessions{max: 2}
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		token, err := vs.add(e)
+		if err != nil {
+			t.Fatalf("unexpected error while adding session: %s", err)
+		}
+		tokens = append(tokens, token)
+		time.Sleep(time.Millisecond)
+	}
+	if len(vs.sessions) != 2 {
+		t.Errorf("unexpected number of sessions: got %d instead of 2", len(vs.sessions))
+	}
+	if vs.get(tokens[0]) != nil {
+		t.Errorf("oldest session not dropped")
+	}
+	if vs.get(tokens[2]) == nil {
+		t.Errorf("newest session dropped")
+	}
+
+	// expired sessions are dropped when a session is added
+	vs.max = 3
+	vs.sessions[tokens[1]].expires = time.Now().Add(-time.Second)
+	if _, err := vs.add(e); err != nil {
+		t.Fatalf("unexpected error while adding session: %s", err)
+	}
+	if len(vs.sessions) != 2 || len(vs.order) != 2 {
+		t.Errorf("unexpected number of sessions: got %d instead of 2", len(vs.sessions))
+	}
+	if vs.get(tokens[2]) == nil {
+		t.Errorf("unexpired session dropped")
+	}
+}
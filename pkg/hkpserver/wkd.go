@@ -0,0 +1,173 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hkpserver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+)
+
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// zbase32 encodes b with the z-base-32 encoding.
+func zbase32(b []byte) string {
+	var sb strings.Builder
+
+	acc, bits := uint(0), uint(0)
+	for _, c := range b {
+		acc = acc<<8 | uint(c)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			sb.WriteByte(zbase32Alphabet[(acc>>bits)&0x1f])
+		}
+	}
+	if bits > 0 {
+		sb.WriteByte(zbase32Alphabet[(acc<<(5-bits))&0x1f])
+	}
+
+	return sb.String()
+}
+
+// wkdHash returns the WKD hashed form of an email local part.
+func wkdHash(local string) string {
+	h := sha1.Sum([]byte(strings.ToLower(local)))
+	return zbase32(h[:])
+}
+
+// splitEmail returns the lowercased local part and domain of an
+// email address.
+func splitEmail(email string) (string, string, bool) {
+	i := strings.LastIndex(email, "@")
+	if i <= 0 || i == len(email)-1 {
+		return "", "", false
+	}
+	return strings.ToLower(email[:i]), strings.ToLower(email[i+1:]), true
+}
+
+// wkdDomainAllowed returns whether keys are served for the domain.
+func (h *hkpHandler) wkdDomainAllowed(domain string) bool {
+	if len(h.wkdDomains) == 0 {
+		return true
+	}
+	for _, d := range h.wkdDomains {
+		if strings.ToLower(strings.TrimPrefix(d, "@")) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// wkdKeys returns the keys having a server certified identity with
+// an email address matching the domain and the hashed local part.
+func (h *hkpHandler) wkdKeys(domain, hash, local string) (openpgp.EntityList, error) {
+	el, err := h.db.Get(local+"@"+domain, database.SearchOptions{Exact: true})
+	if err != nil {
+		return nil, err
+	}
+
+	signingKeys, err := h.db.Get("", database.SearchOptions{Fingerprint: true, KeyType: database.SigningKey})
+	if err != nil {
+		return nil, err
+	}
+
+	var keys openpgp.EntityList
+
+	for _, e := range el {
+		if len(e.Revocations) > 0 {
+			continue
+		}
+		for _, id := range e.Identities {
+			l, d, ok := splitEmail(id.UserId.Email)
+			if !ok || d != domain || wkdHash(l) != hash {
+				continue
+			}
+			if keyring.IdentityRevoked(e, id) || !keyring.IdentityCertifiedBy(e, id, signingKeys) {
+				continue
+			}
+			keys = append(keys, e)
+			break
+		}
+	}
+
+	return keys, nil
+}
+
+// wkd provides the Web Key Directory handler for both the direct
+// (/.well-known/openpgpkey/hu/<hash>) and the advanced
+// (/.well-known/openpgpkey/<domain>/hu/<hash>) layouts as described in
+// https://tools.ietf.org/html/draft-koch-openpgp-webkey-service.
+func (h *hkpHandler) wkd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		NewMethodNotAllowedStatus().Write(w)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, WKDRoute), "/")
+
+	var domain string
+
+	// advanced layout, the domain is part of the path
+	if len(path) == 3 || len(path) == 2 && path[1] == "policy" {
+		domain = strings.ToLower(path[0])
+		path = path[1:]
+	} else {
+		domain = r.Host
+		if host, _, err := net.SplitHostPort(domain); err == nil {
+			domain = host
+		}
+		domain = strings.ToLower(domain)
+	}
+
+	if !h.wkdDomainAllowed(domain) {
+		NewNotFoundStatus().Write(w)
+		return
+	}
+
+	switch {
+	case len(path) == 1 && path[0] == "policy":
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+	case len(path) == 2 && path[0] == "hu" && len(path[1]) == 32:
+		// the local part allows an exact search, requests without it
+		// would require a search through all the keys of the domain
+		local := r.URL.Query().Get("l")
+		if local == "" {
+			NewBadRequestStatus("Missing local part parameter").Write(w)
+			return
+		} else if _, err := mail.ParseAddress(local + "@" + domain); err != nil || wkdHash(local) != path[1] {
+			NewBadRequestStatus("Local part doesn't match hash").Write(w)
+			return
+		}
+		el, err := h.wkdKeys(domain, path[1], local)
+		if err != nil {
+			NewInternalServerErrorStatus(err.Error()).Write(w)
+			return
+		} else if len(el) == 0 {
+			NewNotFoundStatus().Write(w)
+			return
+		}
+		b := new(bytes.Buffer)
+		for _, e := range el {
+			if err := keyring.Serialize(b, e); err != nil {
+				NewInternalServerErrorStatus(err.Error()).Write(w)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b.Bytes())
+	default:
+		NewNotFoundStatus().Write(w)
+	}
+}
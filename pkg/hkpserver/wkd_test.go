@@ -0,0 +1,152 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hkpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestWKDHash(t *testing.T) {
+	// test vector from the WKD draft
+	if h := wkdHash("Joe.Doe"); h != "iy9q119eutrkn8s1mk4r39qejnbu3n5q" {
+		t.Errorf("unexpected hash: got %s instead of iy9q119eutrkn8s1mk4r39qejnbu3n5q", h)
+	}
+}
+
+func TestWKD(t *testing.T) {
+	handler := new(hkpHandler)
+	handler.wkdDomains = []string{"example.com"}
+
+	handler.db, _ = database.GetDatabaseEngine(defaultdb.Name)
+	if handler.db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := handler.db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer handler.db.Disconnect()
+
+	// test0@example.com is certified by the server, test1@example.com isn't
+	el := getEntities(t, 3)
+	signingKey := el[2]
+
+	id := el[0].PrimaryIdentity()
+	if err := el[0].SignIdentity(id.Name, signingKey, nil); err != nil {
+		t.Fatalf("unexpected error while signing identity: %s", err)
+	}
+	// store public keys only
+	for _, e := range el[:2] {
+		keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(getArmored(t, e, false)))
+		if err != nil {
+			t.Fatalf("unexpected error while reading key: %s", err)
+		}
+		if err := handler.db.Add(keys); err != nil {
+			t.Fatalf("unexpected error while adding keys: %s", err)
+		}
+	}
+
+	certified := wkdHash("test0")
+	uncertified := wkdHash("test1")
+
+	tests := []struct {
+		name string
+		host string
+		path string
+		code int
+	}{
+		{
+			name: "direct policy",
+			host: "example.com",
+			path: "/.well-known/openpgpkey/policy",
+			code: http.StatusOK,
+		},
+		{
+			name: "advanced policy",
+			host: "openpgpkey.example.com",
+			path: "/.well-known/openpgpkey/example.com/policy",
+			code: http.StatusOK,
+		},
+		{
+			name: "policy unknown domain",
+			host: "example.org",
+			path: "/.well-known/openpgpkey/policy",
+			code: http.StatusNotFound,
+		},
+		{
+			name: "missing local part",
+			host: "example.com",
+			path: "/.well-known/openpgpkey/hu/" + certified,
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "direct certified key with local part",
+			host: "example.com:443",
+			path: "/.well-known/openpgpkey/hu/" + certified + "?l=test0",
+			code: http.StatusOK,
+		},
+		{
+			name: "advanced certified key",
+			host: "openpgpkey.example.com",
+			path: "/.well-known/openpgpkey/example.com/hu/" + certified + "?l=test0",
+			code: http.StatusOK,
+		},
+		{
+			name: "wrong local part",
+			host: "example.com",
+			path: "/.well-known/openpgpkey/hu/" + certified + "?l=test1",
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "uncertified key",
+			host: "example.com",
+			path: "/.well-known/openpgpkey/hu/" + uncertified + "?l=test1",
+			code: http.StatusNotFound,
+		},
+		{
+			name: "unknown domain",
+			host: "openpgpkey.example.org",
+			path: "/.well-known/openpgpkey/example.org/hu/" + certified,
+			code: http.StatusNotFound,
+		},
+	}
+
+	// signing key is not stored yet, no key is served
+	resp := httptest.NewRecorder()
+	handler.wkd(resp, httptest.NewRequest("GET", "http://example.com/.well-known/openpgpkey/hu/"+certified+"?l=test0", nil))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("unexpected http status returned without signing key: got %d instead of %d", resp.Code, http.StatusNotFound)
+	}
+
+	if err := handler.db.Add(openpgp.EntityList{signingKey}); err != nil {
+		t.Fatalf("unexpected error while adding signing key: %s", err)
+	}
+
+	for _, tt := range tests {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://"+tt.host+tt.path, nil)
+
+		handler.wkd(resp, req)
+
+		if resp.Code != tt.code {
+			t.Errorf("unexpected http status returned for %q: got %d instead of %d", tt.name, resp.Code, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK || resp.Body.Len() == 0 {
+			continue
+		}
+		keys, err := openpgp.ReadKeyRing(resp.Body)
+		if err != nil {
+			t.Errorf("unexpected error while reading key for %q: %s", tt.name, err)
+		} else if len(keys) != 1 || keys[0].PrimaryKey.KeyId != el[0].PrimaryKey.KeyId {
+			t.Errorf("unexpected key returned for %q", tt.name)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package keyring
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// SigTypeCertificationRevocation is the signature type of a user ID
+// revocation (RFC 4880 section 5.2.1), not exported by the openpgp package.
+const SigTypeCertificationRevocation = packet.SignatureType(0x30)
+
+// IdentityRevoked returns whether the identity has been revoked by the
+// key owner with a valid certification revocation signature issued after
+// the current self-signature.
+func IdentityRevoked(e *openpgp.Entity, id *openpgp.Identity) bool {
+	for _, sig := range id.Signatures {
+		if sig.SigType != SigTypeCertificationRevocation {
+			continue
+		} else if sig.IssuerKeyId == nil || *sig.IssuerKeyId != e.PrimaryKey.KeyId {
+			continue
+		} else if id.SelfSignature != nil && id.SelfSignature.CreationTime.After(sig.CreationTime) {
+			continue
+		}
+		if e.PrimaryKey.VerifyUserIdSignature(id.Name, e.PrimaryKey, sig) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// PrimaryIdentity returns the primary identity of the entity if any,
+// otherwise the first identity in lexical order. Unlike the
+// openpgp.Entity method, the returned identity doesn't depend on
+// the map iteration order.
+func PrimaryIdentity(e *openpgp.Entity) *openpgp.Identity {
+	ids := SortedIdentities(e)
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids[0]
+}
+
+// SortedIdentities returns the entity identities with the primary
+// identity first followed by the other identities in lexical order.
+func SortedIdentities(e *openpgp.Entity) []*openpgp.Identity {
+	ids := make([]*openpgp.Identity, 0, len(e.Identities))
+	for _, id := range e.Identities {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		pi, pj := isPrimary(ids[i]), isPrimary(ids[j])
+		if pi != pj {
+			return pi
+		}
+		return ids[i].Name < ids[j].Name
+	})
+	return ids
+}
+
+func isPrimary(id *openpgp.Identity) bool {
+	sig := id.SelfSignature
+	return sig != nil && sig.IsPrimaryId != nil && *sig.IsPrimaryId
+}
+
+// CertificationIssuer returns the key among signers which issued the
+// certification sig over the entity identity, or nil if none of them
+// issued it or if the signature doesn't verify.
+func CertificationIssuer(e *openpgp.Entity, id *openpgp.Identity, sig *packet.Signature, signers openpgp.EntityList) *openpgp.Entity {
+	if sig.IssuerKeyId == nil {
+		return nil
+	}
+	for _, s := range signers {
+		if s.PrimaryKey.KeyId != *sig.IssuerKeyId {
+			continue
+		}
+		if s.PrimaryKey.VerifyUserIdSignature(id.Name, e.PrimaryKey, sig) == nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// DropForeignSignatures removes from the entity identities the
+// signatures which are neither issued by the key itself nor by one of
+// the certifier keys, as well as those which don't verify. The OpenPGP
+// library only verifies the self-certifications, any third party could
+// otherwise flood a key with certifications.
+func DropForeignSignatures(e *openpgp.Entity, certifiers openpgp.EntityList) {
+	issuers := append(openpgp.EntityList{e}, certifiers...)
+
+	for _, id := range e.Identities {
+		var sigs []*packet.Signature
+		for _, sig := range id.Signatures {
+			if CertificationIssuer(e, id, sig, issuers) != nil {
+				sigs = append(sigs, sig)
+			}
+		}
+		id.Signatures = sigs
+	}
+}
+
+// isCertification returns whether the signature is a user ID
+// certification.
+func isCertification(sig *packet.Signature) bool {
+	switch sig.SigType {
+	case packet.SigTypeGenericCert, packet.SigTypePersonaCert, packet.SigTypeCasualCert, packet.SigTypePositiveCert:
+		return true
+	}
+	return false
+}
+
+// unrevokedSigners returns the signer keys which are not revoked, the
+// certifications of a revoked signer key don't certify anything.
+func unrevokedSigners(signers openpgp.EntityList) openpgp.EntityList {
+	var el openpgp.EntityList
+	for _, signer := range signers {
+		if len(signer.Revocations) == 0 {
+			el = append(el, signer)
+		}
+	}
+	return el
+}
+
+// IdentityCertifiedBy returns whether the identity holds a valid and
+// non expired certification issued by one of the unrevoked signer keys.
+func IdentityCertifiedBy(e *openpgp.Entity, id *openpgp.Identity, signers openpgp.EntityList) bool {
+	now := time.Now()
+	signers = unrevokedSigners(signers)
+
+	for _, sig := range id.Signatures {
+		if !isCertification(sig) {
+			continue
+		} else if sig.SigExpired(now) {
+			continue
+		}
+		if CertificationIssuer(e, id, sig, signers) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// CertificationExpiry returns the expiration time of the most durable
+// certification issued by one of the unrevoked signer keys over the
+// identity, expired certifications included. The returned time is zero
+// if one of the certifications never expires and the boolean is false
+// if the identity holds no certification issued by the signer keys.
+func CertificationExpiry(e *openpgp.Entity, id *openpgp.Identity, signers openpgp.EntityList) (time.Time, bool) {
+	var expiry time.Time
+	found := false
+	signers = unrevokedSigners(signers)
+
+	for _, sig := range id.Signatures {
+		if !isCertification(sig) {
+			continue
+		} else if CertificationIssuer(e, id, sig, signers) == nil {
+			continue
+		}
+		if sig.SigLifetimeSecs == nil || *sig.SigLifetimeSecs == 0 {
+			return time.Time{}, true
+		}
+		t := sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs) * time.Second)
+		if !found || t.After(expiry) {
+			expiry = t
+		}
+		found = true
+	}
+
+	return expiry, found
+}
+
+// Certify certifies the entity identity with the signer key, the
+// certification expires after the lifetime unless the lifetime is
+// zero. Unlike openpgp.Entity.SignIdentity, the certification can
+// be time limited.
+func Certify(e *openpgp.Entity, identity string, signer *openpgp.Entity, lifetime time.Duration) error {
+	if err := checkSigner(signer); err != nil {
+		return err
+	}
+	id, ok := e.Identities[identity]
+	if !ok {
+		return fmt.Errorf("identity %q not found", identity)
+	}
+
+	var config *packet.Config
+
+	sig := &packet.Signature{
+		SigType:      packet.SigTypeGenericCert,
+		PubKeyAlgo:   signer.PrivateKey.PubKeyAlgo,
+		Hash:         config.Hash(),
+		CreationTime: config.Now(),
+		IssuerKeyId:  &signer.PrivateKey.KeyId,
+	}
+	if lifetime > 0 {
+		secs := lifetimeSecs(lifetime)
+		sig.SigLifetimeSecs = &secs
+	}
+	if err := sig.SignUserId(identity, e.PrimaryKey, signer.PrivateKey, config); err != nil {
+		return err
+	}
+	id.Signatures = append(id.Signatures, sig)
+
+	return nil
+}
+
+// lifetimeSecs returns the lifetime in seconds rounded up, a lifetime
+// below one second would otherwise be encoded as zero which means the
+// certification never expires.
+func lifetimeSecs(lifetime time.Duration) uint32 {
+	return uint32((lifetime + time.Second - 1) / time.Second)
+}
+
+// checkSigner ensures the signer key is usable to issue certifications.
+func checkSigner(signer *openpgp.Entity) error {
+	if signer.PrivateKey == nil {
+		return fmt.Errorf("signing key must have a private key")
+	} else if signer.PrivateKey.Encrypted {
+		return fmt.Errorf("signing key must be decrypted")
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package keyring
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestCertify(t *testing.T) {
+	signer, err := openpgp.NewEntity("Server", "No comment", "server@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	other, err := openpgp.NewEntity("Other", "No comment", "other@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+
+	signers := openpgp.EntityList{signer}
+
+	tests := []struct {
+		name      string
+		lifetimes []time.Duration
+		certified bool
+		expires   bool
+	}{
+		{"no certification", nil, false, false},
+		{"unlimited certification", []time.Duration{0}, true, false},
+		{"limited certification", []time.Duration{time.Hour}, true, true},
+		{"limited and unlimited certifications", []time.Duration{time.Hour, 0}, true, false},
+		{"limited certifications", []time.Duration{time.Hour, 2 * time.Hour}, true, true},
+	}
+
+	for _, tt := range tests {
+		e, err := openpgp.NewEntity("Test", "No comment", "test@example.com", nil)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		id := PrimaryIdentity(e)
+
+		// certifications from other keys are ignored
+		if err := Certify(e, id.Name, other, time.Minute); err != nil {
+			t.Fatalf("unexpected error while certifying identity: %s", err)
+		}
+
+		var longest time.Duration
+
+		for _, lifetime := range tt.lifetimes {
+			if err := Certify(e, id.Name, signer, lifetime); err != nil {
+				t.Fatalf("unexpected error while certifying identity for %s: %s", tt.name, err)
+			}
+			if lifetime > longest {
+				longest = lifetime
+			}
+		}
+
+		// check certifications survive serialization
+		e = reload(t, e)
+		id = PrimaryIdentity(e)
+
+		if certified := IdentityCertifiedBy(e, id, signers); certified != tt.certified {
+			t.Errorf("unexpected certification for %s: got %v instead of %v", tt.name, certified, tt.certified)
+		}
+
+		expiry, ok := CertificationExpiry(e, id, signers)
+		if ok != tt.certified {
+			t.Errorf("unexpected certification expiry for %s: got %v instead of %v", tt.name, ok, tt.certified)
+		} else if expiry.IsZero() == tt.expires {
+			t.Errorf("unexpected certification expiry for %s: %s", tt.name, expiry)
+		} else if tt.expires {
+			if d := time.Until(expiry); d > longest || d < longest-time.Minute {
+				t.Errorf("unexpected certification expiry for %s: expires in %s instead of %s", tt.name, d, longest)
+			}
+		}
+	}
+}
+
+func TestCertifiedByRevokedSigner(t *testing.T) {
+	signer, err := openpgp.NewEntity("Server", "No comment", "server@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	e, err := openpgp.NewEntity("Test", "No comment", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	id := PrimaryIdentity(e)
+	if err := Certify(e, id.Name, signer, time.Hour); err != nil {
+		t.Fatalf("unexpected error while certifying identity: %s", err)
+	}
+
+	signers := openpgp.EntityList{signer}
+	if !IdentityCertifiedBy(e, id, signers) {
+		t.Fatalf("identity not certified by signer")
+	}
+
+	sig := &packet.Signature{
+		SigType:      packet.SigTypeKeyRevocation,
+		PubKeyAlgo:   signer.PrivateKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &signer.PrimaryKey.KeyId,
+	}
+	if err := sig.RevokeKey(signer.PrimaryKey, signer.PrivateKey, nil); err != nil {
+		t.Fatalf("unexpected error while revoking signer: %s", err)
+	}
+	signer.Revocations = append(signer.Revocations, sig)
+
+	// certifications of a revoked signer are ignored
+	if IdentityCertifiedBy(e, id, signers) {
+		t.Errorf("identity certified by revoked signer")
+	}
+	if _, ok := CertificationExpiry(e, id, signers); ok {
+		t.Errorf("unexpected certification expiry returned for revoked signer")
+	}
+}
+
+func TestLifetimeSecs(t *testing.T) {
+	tests := []struct {
+		lifetime time.Duration
+		secs     uint32
+	}{
+		{time.Nanosecond, 1},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{time.Second + time.Millisecond, 2},
+		{time.Hour, 3600},
+	}
+
+	for _, tt := range tests {
+		if secs := lifetimeSecs(tt.lifetime); secs != tt.secs {
+			t.Errorf("unexpected lifetime for %s: got %d seconds instead of %d", tt.lifetime, secs, tt.secs)
+		}
+	}
+}
@@ -4,6 +4,7 @@
 package keyring
 
 import (
+	"fmt"
 	"io"
 
 	"golang.org/x/crypto/openpgp"
@@ -13,6 +14,13 @@ import (
 // WriteArmoredKeyRing writes the armored ASCII format of the
 // entity list to w.
 func WriteArmoredKeyRing(w io.Writer, el openpgp.EntityList) error {
+	return WriteArmoredKeyRingWithSignatures(w, el, nil)
+}
+
+// WriteArmoredKeyRingWithSignatures writes the armored ASCII format of
+// the entity list to w along with the opaque identity signatures of the
+// entities, indexed by key fingerprint.
+func WriteArmoredKeyRingWithSignatures(w io.Writer, el openpgp.EntityList, opaque map[string]OpaqueSignatures) error {
 	aw, err := armor.Encode(w, openpgp.PublicKeyType, nil)
 	if err != nil {
 		return err
@@ -20,10 +28,72 @@ func WriteArmoredKeyRing(w io.Writer, el openpgp.EntityList) error {
 	defer aw.Close()
 
 	for _, e := range el {
-		if err := e.Serialize(aw); err != nil {
+		fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+		if err := serialize(aw, e, false, opaque[fp]); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// Serialize writes the public part of the entity to w. Unlike
+// openpgp.Entity.Serialize, key revocation signatures are also
+// written and identities are written in a stable order, primary
+// identity first.
+func Serialize(w io.Writer, e *openpgp.Entity) error {
+	return serialize(w, e, false, nil)
+}
+
+// SerializePrivate writes the entity with its private keys to w. Unlike
+// openpgp.Entity.SerializePrivate, key revocation signatures and identity
+// certifications are also written.
+func SerializePrivate(w io.Writer, e *openpgp.Entity) error {
+	if e.PrivateKey == nil {
+		return fmt.Errorf("private key is missing")
+	}
+	return serialize(w, e, true, nil)
+}
+
+func serialize(w io.Writer, e *openpgp.Entity, private bool, opaque OpaqueSignatures) error {
+	if private {
+		if err := e.PrivateKey.Serialize(w); err != nil {
+			return err
+		}
+	} else if err := e.PrimaryKey.Serialize(w); err != nil {
+		return err
+	}
+	for _, sig := range e.Revocations {
+		if err := sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	for _, id := range SortedIdentities(e) {
+		if err := id.UserId.Serialize(w); err != nil {
+			return err
+		}
+		for _, sig := range id.Signatures {
+			if err := sig.Serialize(w); err != nil {
+				return err
+			}
+		}
+		for _, sig := range opaque[id.Name] {
+			if _, err := w.Write(sig); err != nil {
+				return err
+			}
+		}
+	}
+	for _, subkey := range e.Subkeys {
+		if private && subkey.PrivateKey != nil {
+			if err := subkey.PrivateKey.Serialize(w); err != nil {
+				return err
+			}
+		} else if err := subkey.PublicKey.Serialize(w); err != nil {
+			return err
+		}
+		if err := subkey.Sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package keyring
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// Merge merges the key material of src into dst. Identities, signatures,
+// subkeys and revocations found in src and missing from dst are added to
+// dst, identity self-signatures and subkey binding signatures are replaced
+// by their newest version and signatures already present in dst (like
+// server certifications) are preserved. Both entities must share the same
+// primary key.
+func Merge(dst, src *openpgp.Entity) error {
+	if dst.PrimaryKey.Fingerprint != src.PrimaryKey.Fingerprint {
+		return fmt.Errorf("can't merge keys with different fingerprints")
+	}
+
+	for _, sig := range src.Revocations {
+		if !containsSignature(dst.Revocations, sig) {
+			dst.Revocations = append(dst.Revocations, sig)
+		}
+	}
+
+	for name, sid := range src.Identities {
+		did, ok := dst.Identities[name]
+		if !ok {
+			dst.Identities[name] = sid
+			continue
+		}
+		for _, sig := range sid.Signatures {
+			if !containsSignature(did.Signatures, sig) {
+				did.Signatures = append(did.Signatures, sig)
+			}
+		}
+		if did.SelfSignature == nil || sid.SelfSignature.CreationTime.After(did.SelfSignature.CreationTime) {
+			did.SelfSignature = sid.SelfSignature
+		}
+	}
+
+	for _, ssk := range src.Subkeys {
+		found := false
+		for i, dsk := range dst.Subkeys {
+			if dsk.PublicKey.Fingerprint != ssk.PublicKey.Fingerprint {
+				continue
+			}
+			found = true
+			if replaceSubkeySignature(dsk.Sig, ssk.Sig) {
+				dst.Subkeys[i].Sig = ssk.Sig
+			}
+			break
+		}
+		if !found {
+			dst.Subkeys = append(dst.Subkeys, openpgp.Subkey{
+				PublicKey: ssk.PublicKey,
+				Sig:       ssk.Sig,
+			})
+		}
+	}
+
+	return nil
+}
+
+// replaceSubkeySignature returns whether the subkey signature
+// newSig takes precedence over the current signature: a revocation
+// is never replaced and otherwise the newest signature wins.
+func replaceSubkeySignature(sig, newSig *packet.Signature) bool {
+	if sig == nil {
+		return true
+	} else if sig.SigType == packet.SigTypeSubkeyRevocation {
+		return false
+	} else if newSig.SigType == packet.SigTypeSubkeyRevocation {
+		return true
+	}
+	return newSig.CreationTime.After(sig.CreationTime)
+}
+
+// containsSignature returns whether the signature list contains
+// a signature identical to sig.
+func containsSignature(sigs []*packet.Signature, sig *packet.Signature) bool {
+	b := new(bytes.Buffer)
+	if err := sig.Serialize(b); err != nil {
+		return false
+	}
+	for _, s := range sigs {
+		sb := new(bytes.Buffer)
+		if err := s.Serialize(sb); err != nil {
+			continue
+		}
+		if bytes.Equal(b.Bytes(), sb.Bytes()) {
+			return true
+		}
+	}
+	return false
+}
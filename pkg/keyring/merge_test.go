@@ -0,0 +1,90 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package keyring
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// reload returns a copy of the public part of the entity.
+func reload(t *testing.T, e *openpgp.Entity) *openpgp.Entity {
+	b := new(bytes.Buffer)
+	if err := Serialize(b, e); err != nil {
+		t.Fatalf("unexpected error while serializing key: %s", err)
+	}
+	el, err := openpgp.ReadKeyRing(b)
+	if err != nil {
+		t.Fatalf("unexpected error while reading key: %s", err)
+	} else if len(el) != 1 {
+		t.Fatalf("unexpected number of keys: got %d instead of 1", len(el))
+	}
+	return el[0]
+}
+
+func TestMerge(t *testing.T) {
+	e, err := openpgp.NewEntity("Test", "No comment", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	signer, err := openpgp.NewEntity("Server", "No comment", "server@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+
+	// stored key holds a server certification
+	stored := reload(t, e)
+	id := PrimaryIdentity(stored)
+	if err := stored.SignIdentity(id.Name, signer, nil); err != nil {
+		t.Fatalf("unexpected error while signing identity: %s", err)
+	}
+
+	// submitted key has its expiration extended and is revoked
+	id = PrimaryIdentity(e)
+	lifetime := uint32(24 * 3600)
+	selfSig := *id.SelfSignature
+	selfSig.CreationTime = time.Now().Add(time.Second)
+	selfSig.KeyLifetimeSecs = &lifetime
+	if err := selfSig.SignUserId(id.Name, e.PrimaryKey, e.PrivateKey, nil); err != nil {
+		t.Fatalf("unexpected error while signing identity: %s", err)
+	}
+	id.SelfSignature = &selfSig
+	id.Signatures = append(id.Signatures, &selfSig)
+	if err := e.RevokeKey(packet.KeySuperseded, "", nil); err != nil {
+		t.Fatalf("unexpected error while revoking key: %s", err)
+	}
+	submitted := reload(t, e)
+
+	if err := Merge(stored, submitted); err != nil {
+		t.Fatalf("unexpected error while merging keys: %s", err)
+	}
+	// merging twice must not duplicate signatures
+	if err := Merge(stored, submitted); err != nil {
+		t.Fatalf("unexpected error while merging keys: %s", err)
+	}
+
+	merged := reload(t, stored)
+	id = PrimaryIdentity(merged)
+
+	if len(merged.Revocations) != 1 {
+		t.Errorf("unexpected number of revocations: got %d instead of 1", len(merged.Revocations))
+	}
+	if id.SelfSignature.KeyLifetimeSecs == nil || *id.SelfSignature.KeyLifetimeSecs != lifetime {
+		t.Errorf("key expiration not updated")
+	}
+	if len(id.Signatures) != 3 {
+		t.Errorf("unexpected number of identity signatures: got %d instead of 3", len(id.Signatures))
+	}
+	if !IdentityCertifiedBy(merged, id, openpgp.EntityList{signer}) {
+		t.Errorf("server certification not preserved")
+	}
+
+	if err := Merge(stored, signer); err == nil {
+		t.Errorf("unexpected success while merging different keys")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package keyring
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// OpenPGP packet tags, see RFC 4880 section 4.3.
+const (
+	signatureTag     = 2
+	secretKeyTag     = 5
+	publicKeyTag     = 6
+	secretSubkeyTag  = 7
+	userIDTag        = 13
+	publicSubkeyTag  = 14
+	userAttributeTag = 17
+)
+
+// OpaqueSignatures holds the serialized identity signatures of a key
+// the OpenPGP library can't parse, indexed by identity name. GnuPG
+// trust signatures are such signatures as GnuPG marks their regular
+// expression subpacket as critical, the OpenPGP library would discard
+// the whole key because of them.
+type OpaqueSignatures map[string][][]byte
+
+// Add adds the signature packet to the identity signatures unless it's
+// already present, it returns whether the signature was added.
+func (o OpaqueSignatures) Add(identity string, sig []byte) bool {
+	for _, s := range o[identity] {
+		if bytes.Equal(s, sig) {
+			return false
+		}
+	}
+	o[identity] = append(o[identity], sig)
+	return true
+}
+
+// SplitOpaqueSignatures reads the binary key ring from r and splits out
+// the identity signatures the OpenPGP library can't parse. It returns
+// the key ring without those signatures, readable by openpgp.ReadKeyRing,
+// and the signatures indexed by key fingerprint.
+func SplitOpaqueSignatures(r io.Reader) ([]byte, map[string]OpaqueSignatures, error) {
+	keys := new(bytes.Buffer)
+	opaque := make(map[string]OpaqueSignatures)
+
+	var fp, identity string
+
+	or := packet.NewOpaqueReader(r)
+	for {
+		op, err := or.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("while reading packet: %s", err)
+		}
+
+		switch op.Tag {
+		case publicKeyTag, secretKeyTag:
+			fp, identity = "", ""
+			p, err := op.Parse()
+			if err != nil {
+				return nil, nil, fmt.Errorf("while parsing key: %s", err)
+			}
+			switch k := p.(type) {
+			case *packet.PublicKey:
+				fp = fmt.Sprintf("%X", k.Fingerprint[:])
+			case *packet.PrivateKey:
+				fp = fmt.Sprintf("%X", k.Fingerprint[:])
+			}
+		case userIDTag:
+			identity = ""
+			if p, err := op.Parse(); err == nil {
+				if id, ok := p.(*packet.UserId); ok {
+					identity = id.Id
+				}
+			}
+		case publicSubkeyTag, secretSubkeyTag, userAttributeTag:
+			identity = ""
+		case signatureTag:
+			if fp == "" || identity == "" {
+				break
+			}
+			if _, err := op.Parse(); err == nil {
+				break
+			} else if _, ok := err.(errors.UnsupportedError); !ok {
+				break
+			}
+			sig := new(bytes.Buffer)
+			if err := op.Serialize(sig); err != nil {
+				return nil, nil, err
+			}
+			if opaque[fp] == nil {
+				opaque[fp] = make(OpaqueSignatures)
+			}
+			opaque[fp].Add(identity, sig.Bytes())
+			continue
+		}
+
+		if err := op.Serialize(keys); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return keys.Bytes(), opaque, nil
+}
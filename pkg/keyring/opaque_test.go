@@ -0,0 +1,87 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package keyring
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestSplitOpaqueSignatures(t *testing.T) {
+	signer, err := openpgp.NewEntity("Organisation", "", "pgp@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	e, err := openpgp.NewEntity("Server", "", "server@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	id := PrimaryIdentity(e)
+
+	trust := &Trust{Amount: CompleteTrust, Domains: []string{"example.com"}}
+	if err := TrustCertify(e, id.Name, signer, 0, trust); err != nil {
+		t.Fatalf("unexpected error while certifying identity: %s", err)
+	}
+
+	b := new(bytes.Buffer)
+	if err := Serialize(b, e); err != nil {
+		t.Fatalf("unexpected error while serializing key: %s", err)
+	}
+
+	// mark the regular expression subpacket as critical like GnuPG does
+	regex := []byte("\x1a\x06<[^>]+[@.]example\\.com>$\x00")
+	i := bytes.Index(b.Bytes(), regex)
+	if i < 0 {
+		t.Fatalf("regular expression subpacket not found")
+	}
+	b.Bytes()[i+1] |= 0x80
+	sig := b.Bytes()[i+1 : i+len(regex)]
+
+	if _, err := openpgp.ReadKeyRing(bytes.NewReader(b.Bytes())); err == nil {
+		t.Fatalf("unexpected success while reading key with critical regular expression")
+	}
+
+	keys, opaque, err := SplitOpaqueSignatures(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error while splitting signatures: %s", err)
+	}
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(keys))
+	if err != nil {
+		t.Fatalf("unexpected error while reading split key: %s", err)
+	} else if len(el) != 1 || el[0].PrimaryKey.Fingerprint != e.PrimaryKey.Fingerprint {
+		t.Fatalf("unexpected split key")
+	}
+
+	fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+	if len(opaque) != 1 || len(opaque[fp][id.Name]) != 1 {
+		t.Fatalf("unexpected opaque signatures: %v", opaque)
+	} else if !bytes.Contains(opaque[fp][id.Name][0], sig) {
+		t.Errorf("unexpected opaque signature")
+	}
+	if opaque[fp].Add(id.Name, opaque[fp][id.Name][0]) {
+		t.Errorf("opaque signature added twice")
+	}
+
+	// the opaque signatures are written back after the identity
+	// signatures
+	out := new(bytes.Buffer)
+	if err := WriteArmoredKeyRingWithSignatures(out, el, opaque); err != nil {
+		t.Fatalf("unexpected error while writing key: %s", err)
+	}
+	block, err := armor.Decode(out)
+	if err != nil {
+		t.Fatalf("unexpected error while decoding key: %s", err)
+	}
+	data, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		t.Fatalf("unexpected error while decoding key: %s", err)
+	} else if !bytes.Equal(data, b.Bytes()) {
+		t.Errorf("written key doesn't match the original key")
+	}
+}
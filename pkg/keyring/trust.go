@@ -0,0 +1,234 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package keyring
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/openpgp/s2k"
+)
+
+const (
+	// PartialTrust is the trust amount of a partially trusted introducer.
+	PartialTrust uint8 = 60
+	// CompleteTrust is the trust amount of a fully trusted introducer.
+	CompleteTrust uint8 = 120
+)
+
+// signature subpacket types, see RFC 4880 section 5.2.3.1.
+const (
+	creationTimeSubpacket        byte = 2
+	signatureExpirationSubpacket byte = 3
+	trustSubpacket               byte = 5
+	regexSubpacket               byte = 6
+	issuerSubpacket              byte = 16
+)
+
+// Trust describes the trust carried by a level 0 trust signature, see
+// RFC 4880 section 5.2.3.13.
+type Trust struct {
+	// Amount is the amount of trust, PartialTrust or CompleteTrust.
+	Amount uint8
+	// Domains restricts the trust to the user IDs with an email
+	// address within one of the domains or their subdomains.
+	Domains []string
+}
+
+// DomainsRegexp returns the regular expression matching the user IDs
+// with an email address within one of the domains or their subdomains,
+// this is the regular expression used by GnuPG for scoped trust
+// signatures.
+func DomainsRegexp(domains []string) string {
+	quoted := make([]string, len(domains))
+	for i, d := range domains {
+		quoted[i] = regexp.QuoteMeta(strings.ToLower(d))
+	}
+	if len(quoted) == 1 {
+		return "<[^>]+[@.]" + quoted[0] + ">$"
+	}
+	return "<[^>]+[@.](" + strings.Join(quoted, "|") + ")>$"
+}
+
+// TrustCertify certifies the entity identity with a trust signature
+// issued by the signer key, the certification expires after the
+// lifetime unless the lifetime is zero. A nil trust issues a regular
+// certification as Certify does.
+//
+// The OpenPGP library neither generates nor understands the trust and
+// regular expression subpackets, and rejects keys holding signatures
+// with unknown critical subpackets, so both subpackets are marked as
+// non-critical. As implementations ignoring a non-critical regular
+// expression would trust introducers for any identity, only level 0
+// trust signatures, which don't make the key a trusted introducer, are
+// issued.
+func TrustCertify(e *openpgp.Entity, identity string, signer *openpgp.Entity, lifetime time.Duration, trust *Trust) error {
+	if trust == nil {
+		return Certify(e, identity, signer, lifetime)
+	}
+	if err := checkSigner(signer); err != nil {
+		return err
+	}
+	id, ok := e.Identities[identity]
+	if !ok {
+		return fmt.Errorf("identity %q not found", identity)
+	}
+
+	var config *packet.Config
+
+	hashFunc := config.Hash()
+	hashID, ok := s2k.HashToHashId(hashFunc)
+	if !ok {
+		return fmt.Errorf("unsupported hash function %s", hashFunc)
+	}
+	priv := signer.PrivateKey
+
+	// hashed subpackets
+	hashed := subpacket(creationTimeSubpacket, uint32Bytes(uint32(config.Now().Unix())))
+	if lifetime > 0 {
+		hashed = append(hashed, subpacket(signatureExpirationSubpacket, uint32Bytes(lifetimeSecs(lifetime)))...)
+	}
+	hashed = append(hashed, subpacket(trustSubpacket, []byte{0, trust.Amount})...)
+	if len(trust.Domains) > 0 {
+		regex := append([]byte(DomainsRegexp(trust.Domains)), 0)
+		hashed = append(hashed, subpacket(regexSubpacket, regex)...)
+	}
+	issuer := make([]byte, 8)
+	binary.BigEndian.PutUint64(issuer, priv.KeyId)
+	hashed = append(hashed, subpacket(issuerSubpacket, issuer)...)
+
+	if len(hashed) > 0xffff {
+		return fmt.Errorf("trust signature subpackets too long")
+	}
+
+	// RFC 4880 section 5.2.4
+	header := []byte{4, byte(packet.SigTypeGenericCert), byte(priv.PubKeyAlgo), hashID, byte(len(hashed) >> 8), byte(len(hashed))}
+	header = append(header, hashed...)
+
+	h := hashFunc.New()
+	if err := e.PrimaryKey.SerializeForHash(h); err != nil {
+		return err
+	}
+	h.Write(append([]byte{0xb4}, uint32Bytes(uint32(len(identity)))...))
+	h.Write([]byte(identity))
+	h.Write(header)
+	h.Write(append([]byte{4, 0xff}, uint32Bytes(uint32(len(header)))...))
+	digest := h.Sum(nil)
+
+	mpis, err := signDigest(priv, digest, hashFunc)
+	if err != nil {
+		return err
+	}
+
+	// no unhashed subpackets
+	body := append(header, 0, 0)
+	body = append(body, digest[:2]...)
+	body = append(body, mpis...)
+
+	buf := bytes.NewBuffer([]byte{0xc0 | 2, 0xff})
+	buf.Write(uint32Bytes(uint32(len(body))))
+	buf.Write(body)
+
+	p, err := packet.Read(buf)
+	if err != nil {
+		return fmt.Errorf("while reading trust signature: %s", err)
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok {
+		return fmt.Errorf("unexpected trust signature packet")
+	}
+	if err := signer.PrimaryKey.VerifyUserIdSignature(identity, e.PrimaryKey, sig); err != nil {
+		return fmt.Errorf("while verifying trust signature: %s", err)
+	}
+	id.Signatures = append(id.Signatures, sig)
+
+	return nil
+}
+
+// subpacket returns the serialized non-critical signature subpacket.
+func subpacket(typ byte, data []byte) []byte {
+	var b []byte
+
+	// RFC 4880 section 5.2.3.1, the length includes the type
+	length := len(data) + 1
+	switch {
+	case length < 192:
+		b = []byte{byte(length)}
+	case length < 16320:
+		length -= 192
+		b = []byte{byte(length>>8) + 192, byte(length)}
+	default:
+		b = append([]byte{255}, uint32Bytes(uint32(length))...)
+	}
+
+	b = append(b, typ)
+	return append(b, data...)
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// mpi returns the multiprecision integer encoding of b, see RFC 4880
+// section 3.2.
+func mpi(b []byte) []byte {
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	bitLength := 0
+	if len(b) > 0 {
+		bitLength = 8*(len(b)-1) + bits.Len8(b[0])
+	}
+	return append([]byte{byte(bitLength >> 8), byte(bitLength)}, b...)
+}
+
+// signDigest signs the digest with the private key and returns the
+// encoded signature MPIs.
+func signDigest(priv *packet.PrivateKey, digest []byte, hashFunc crypto.Hash) ([]byte, error) {
+	switch priv.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly:
+		signer, ok := priv.PrivateKey.(crypto.Signer)
+		if !ok {
+			break
+		}
+		sig, err := signer.Sign(rand.Reader, digest, hashFunc)
+		if err != nil {
+			return nil, err
+		}
+		return mpi(sig), nil
+	case packet.PubKeyAlgoECDSA:
+		k, ok := priv.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			break
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, err
+		}
+		return append(mpi(r.Bytes()), mpi(s.Bytes())...), nil
+	case packet.PubKeyAlgoEdDSA:
+		signer, ok := priv.PrivateKey.(crypto.Signer)
+		if !ok {
+			break
+		}
+		sig, err := signer.Sign(rand.Reader, digest, crypto.Hash(0))
+		if err != nil {
+			return nil, err
+		}
+		return append(mpi(sig[:32]), mpi(sig[32:])...), nil
+	}
+	return nil, fmt.Errorf("unsupported signing key algorithm %d", priv.PubKeyAlgo)
+}
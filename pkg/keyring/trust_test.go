@@ -0,0 +1,96 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package keyring
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestDomainsRegexp(t *testing.T) {
+	tests := []struct {
+		name    string
+		domains []string
+		regexp  string
+	}{
+		{"single domain", []string{"example.com"}, `<[^>]+[@.]example\.com>$`},
+		{"uppercase domain", []string{"Example.COM"}, `<[^>]+[@.]example\.com>$`},
+		{"multiple domains", []string{"example.com", "example.org"}, `<[^>]+[@.](example\.com|example\.org)>$`},
+	}
+
+	for _, tt := range tests {
+		if re := DomainsRegexp(tt.domains); re != tt.regexp {
+			t.Errorf("unexpected regexp for %s: got %s instead of %s", tt.name, re, tt.regexp)
+		}
+	}
+}
+
+func TestTrustCertify(t *testing.T) {
+	signer, err := openpgp.NewEntity("Server", "No comment", "server@example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while generating pgp key: %s", err)
+	}
+	signers := openpgp.EntityList{signer}
+
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		trust    *Trust
+		content  []string
+	}{
+		{
+			name: "regular certification",
+		},
+		{
+			name:     "unscoped trust signature",
+			lifetime: time.Hour,
+			trust:    &Trust{Amount: CompleteTrust},
+			content:  []string{"\x03\x05\x00\x78"},
+		},
+		{
+			name:    "scoped trust signature",
+			trust:   &Trust{Amount: CompleteTrust, Domains: []string{"example.com"}},
+			content: []string{"\x03\x05\x00\x78", "\x06<[^>]+[@.]example\\.com>$\x00"},
+		},
+	}
+
+	for _, tt := range tests {
+		e, err := openpgp.NewEntity("Test", "No comment", "test@example.com", nil)
+		if err != nil {
+			t.Fatalf("unexpected error while generating pgp key: %s", err)
+		}
+		id := PrimaryIdentity(e)
+
+		if err := TrustCertify(e, id.Name, signer, tt.lifetime, tt.trust); err != nil {
+			t.Fatalf("unexpected error while certifying identity for %s: %s", tt.name, err)
+		}
+
+		// check certifications survive serialization
+		e = reload(t, e)
+		id = PrimaryIdentity(e)
+
+		if !IdentityCertifiedBy(e, id, signers) {
+			t.Errorf("identity not certified for %s", tt.name)
+		}
+		expiry, ok := CertificationExpiry(e, id, signers)
+		if !ok || expiry.IsZero() != (tt.lifetime == 0) {
+			t.Errorf("unexpected certification expiry for %s: %s", tt.name, expiry)
+		}
+
+		b := new(bytes.Buffer)
+		for _, sig := range id.Signatures {
+			if err := sig.Serialize(b); err != nil {
+				t.Fatalf("unexpected error while serializing signature: %s", err)
+			}
+		}
+		for _, c := range tt.content {
+			if !bytes.Contains(b.Bytes(), []byte(c)) {
+				t.Errorf("subpacket %q missing for %s", c, tt.name)
+			}
+		}
+	}
+}
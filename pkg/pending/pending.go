@@ -0,0 +1,193 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package pending
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ctrliq/spks/pkg/database"
+	"github.com/ctrliq/spks/pkg/keyring"
+	"golang.org/x/crypto/openpgp"
+)
+
+// statePrefix is the state key prefix of pending submissions.
+const statePrefix = "pending" + database.StateSep
+
+// ErrNotFound is returned when a submission doesn't exist or has expired.
+var ErrNotFound = database.ErrNotFound
+
+// Submission describes a key submission waiting for verification.
+type Submission struct {
+	// Token is the verification token the submission is recorded
+	// under, it's only set by Get so listings never disclose it.
+	Token       string    `json:"-"`
+	Fingerprint string    `json:"fingerprint"`
+	Email       string    `json:"email"`
+	RemoteIP    string    `json:"remote_ip"`
+	Submitted   time.Time `json:"submitted"`
+	Expires     time.Time `json:"expires"`
+	Key         []byte    `json:"key,omitempty"`
+	// Challenge is the digest of the challenge encrypted to the
+	// submitted key, empty when no challenge was sent.
+	Challenge string `json:"challenge,omitempty"`
+}
+
+// NewSubmission returns a submission of the key for the email address
+// expiring after ttl.
+func NewSubmission(token string, e *openpgp.Entity, email, remoteIP string, ttl time.Duration) (*Submission, error) {
+	b := new(bytes.Buffer)
+	if err := keyring.Serialize(b, e); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	return &Submission{
+		Token:       token,
+		Fingerprint: fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]),
+		Email:       email,
+		RemoteIP:    remoteIP,
+		Submitted:   now,
+		Expires:     now.Add(ttl),
+		Key:         b.Bytes(),
+	}, nil
+}
+
+// Entity returns the submitted key.
+func (s *Submission) Entity() (*openpgp.Entity, error) {
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(s.Key))
+	if err != nil {
+		return nil, err
+	} else if len(el) != 1 {
+		return nil, fmt.Errorf("found %d keys in submission", len(el))
+	}
+	return el[0], nil
+}
+
+// Expired returns whether the submission has expired.
+func (s *Submission) Expired() bool {
+	return time.Now().After(s.Expires)
+}
+
+// Store stores pending submissions in the database state, expired
+// submissions are automatically removed by the database engine.
+type Store struct {
+	state database.StateEngine
+}
+
+// NewStore returns a pending submission store backed by the
+// database engine.
+func NewStore(db database.Engine) (*Store, error) {
+	state, ok := database.GetStateEngine(db)
+	if !ok {
+		return nil, fmt.Errorf("database engine doesn't support state storage required by pending submissions")
+	}
+	return &Store{state: state}, nil
+}
+
+// Add records the submission until it expires.
+func (ps *Store) Add(s *Submission) error {
+	ttl := time.Until(s.Expires)
+	if ttl <= 0 {
+		return fmt.Errorf("submission already expired")
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ps.state.SetState(statePrefix+s.Token, b, ttl)
+}
+
+// Get returns the submission associated to the token.
+func (ps *Store) Get(token string) (*Submission, error) {
+	b, err := ps.state.GetState(statePrefix + token)
+	if err != nil {
+		return nil, err
+	}
+	s := new(Submission)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	} else if s.Expired() {
+		return nil, ErrNotFound
+	}
+	s.Token = token
+	return s, nil
+}
+
+// Del removes the submission associated to the token.
+func (ps *Store) Del(token string) error {
+	return ps.state.DelState(statePrefix + token)
+}
+
+// walk calls fn with the state key of each non expired submission.
+func (ps *Store) walk(fn func(key string, s *Submission)) error {
+	var jsonErr error
+
+	err := ps.state.ListState(statePrefix, func(key string, value []byte) bool {
+		s := new(Submission)
+		if jsonErr = json.Unmarshal(value, s); jsonErr != nil {
+			return false
+		}
+		if !s.Expired() {
+			fn(key, s)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return jsonErr
+}
+
+// List returns the non expired submissions ordered by submission time.
+// The submitted keys and the verification tokens are omitted.
+func (ps *Store) List() ([]*Submission, error) {
+	var list []*Submission
+
+	err := ps.walk(func(key string, s *Submission) {
+		s.Key = nil
+		list = append(list, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Submitted.Before(list[j].Submitted)
+	})
+
+	return list, nil
+}
+
+// Purge removes the submissions matching the fingerprint, or all
+// submissions if the fingerprint is empty, and returns the number
+// of removed submissions. The verification tokens of the removed
+// submissions are rejected as they require a pending submission.
+func (ps *Store) Purge(fingerprint string) (int, error) {
+	var keys []string
+
+	fingerprint = strings.ToUpper(fingerprint)
+
+	err := ps.walk(func(key string, s *Submission) {
+		if fingerprint == "" || s.Fingerprint == fingerprint {
+			keys = append(keys, key)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range keys {
+		if err := ps.state.DelState(key); err != nil {
+			return i, err
+		}
+	}
+
+	return len(keys), nil
+}
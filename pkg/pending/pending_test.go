@@ -0,0 +1,99 @@
+// Copyright (c) 2020-2021, Ctrl IQ, Inc. All rights reserved
+// SPDX-License-Identifier: BSD-3-Clause
+
+package pending
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ctrliq/spks/internal/pkg/defaultdb"
+	"github.com/ctrliq/spks/pkg/database"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestStore(t *testing.T) {
+	db, _ := database.GetDatabaseEngine(defaultdb.Name)
+	if db == nil {
+		t.Fatalf("no default database found")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("unexpected error while connecting to database: %s", err)
+	}
+	defer db.Disconnect()
+
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatalf("unexpected error while creating store: %s", err)
+	}
+
+	var subs []*Submission
+
+	for i := 0; i < 3; i++ {
+		email := fmt.Sprintf("test%d@example.com", i)
+		e, err := openpgp.NewEntity("Test", "", email, nil)
+		if err != nil {
+			t.Fatalf("unexpected error while creating entity: %s", err)
+		}
+		s, err := NewSubmission(fmt.Sprintf("token%d", i), e, email, "127.0.0.1", time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error while creating submission: %s", err)
+		}
+		if err := store.Add(s); err != nil {
+			t.Fatalf("unexpected error while adding submission: %s", err)
+		}
+		subs = append(subs, s)
+	}
+
+	s, err := store.Get("token0")
+	if err != nil {
+		t.Fatalf("unexpected error while getting submission: %s", err)
+	}
+	e, err := s.Entity()
+	if err != nil {
+		t.Fatalf("unexpected error while reading submitted key: %s", err)
+	} else if fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]) != subs[0].Fingerprint {
+		t.Errorf("unexpected key returned for submission")
+	}
+	if s.Token != "token0" {
+		t.Errorf("unexpected token returned for submission: %q", s.Token)
+	}
+
+	if _, err := store.Get("unknown"); err != ErrNotFound {
+		t.Errorf("unexpected error for unknown token: got %v instead of %v", err, ErrNotFound)
+	}
+
+	list, err := store.List()
+	if err != nil {
+		t.Fatalf("unexpected error while listing submissions: %s", err)
+	} else if len(list) != 3 {
+		t.Fatalf("unexpected number of submissions: got %d instead of 3", len(list))
+	}
+	for _, s := range list {
+		if s.Key != nil {
+			t.Errorf("unexpected key returned in submission list")
+		}
+		if s.Token != "" {
+			t.Errorf("unexpected token returned in submission list")
+		}
+	}
+
+	if err := store.Del("token0"); err != nil {
+		t.Fatalf("unexpected error while deleting submission: %s", err)
+	}
+	if _, err := store.Get("token0"); err != ErrNotFound {
+		t.Errorf("unexpected error for deleted token: got %v instead of %v", err, ErrNotFound)
+	}
+
+	if n, err := store.Purge(subs[1].Fingerprint); err != nil {
+		t.Fatalf("unexpected error while purging submissions: %s", err)
+	} else if n != 1 {
+		t.Errorf("unexpected number of purged submissions: got %d instead of 1", n)
+	}
+	if n, err := store.Purge(""); err != nil {
+		t.Fatalf("unexpected error while purging submissions: %s", err)
+	} else if n != 1 {
+		t.Errorf("unexpected number of purged submissions: got %d instead of 1", n)
+	}
+}